@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Proxy modes
+const (
+	modeRecord = "record" // always forward upstream and record
+	modeAuto   = "auto"   // serve from the cassette when possible, otherwise forward + record into it
+)
+
+// cassette is a JSONL archive of recorded events that the proxy can answer
+// requests from (VCR style), appending any new request/response pairs to it
+type cassette struct {
+	path string
+	mock *mockServer
+	// serializes appends to the archive file
+	mu sync.Mutex
+}
+
+// Set when running with --mode=auto, nil otherwise
+var proxyCassette *cassette
+
+// loadCassette reads the events already in the archive; a missing archive
+// is treated as an empty cassette that will be created on the first record
+func loadCassette(path string, matcher mockMatcher) (*cassette, error) {
+	events := []HTTPEvent{}
+	f, err := os.Open(path)
+	if err == nil {
+		events, err = readRecording(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read cassette %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &cassette{
+		path: path,
+		mock: newMockServer(events, matcher, playbackSequential),
+	}, nil
+}
+
+func (c *cassette) lookup(r *http.Request, body string) (HTTPEvent, bool) {
+	return c.mock.findMatch(r, body)
+}
+
+// record appends a new event to the archive and makes it available for playback
+func (c *cassette) record(event HTTPEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(httpEventToString(event) + "\n"); err != nil {
+		return err
+	}
+	c.mock.addEvent(event)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Collects every event passed to it
+type capturingHandler struct {
+	events []HTTPEvent
+}
+
+func (h *capturingHandler) handleEvent(e HTTPEvent) { h.events = append(h.events, e) }
+func (h *capturingHandler) flushBuffer()            {}
+
+func tempCassettePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "cassette.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+func TestLoadCassette(t *testing.T) {
+	path, cleanup := tempCassettePath(t)
+	defer cleanup()
+
+	c, err := loadCassette(path, mockMatcher{strictness: matchQuery})
+	if err != nil {
+		t.Fatalf("Expected a missing cassette to load as empty, got %v", err)
+	}
+	if len(c.mock.events) != 0 {
+		t.Errorf("Expected an empty cassette, got %d events", len(c.mock.events))
+	}
+
+	if err := ioutil.WriteFile(path, []byte(exampleHTTPEventJSON+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err = loadCassette(path, mockMatcher{strictness: matchQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.lookup(httptest.NewRequest("GET", "/path/to", nil), ""); !ok {
+		t.Error("Expected the archived event to be found")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{oops\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCassette(path, mockMatcher{strictness: matchQuery}); err == nil {
+		t.Error("Expected an error for a corrupt cassette, but got <nil>")
+	}
+}
+
+func TestCassetteRecord(t *testing.T) {
+	path, cleanup := tempCassettePath(t)
+	defer cleanup()
+
+	c, err := loadCassette(path, mockMatcher{strictness: matchQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.record(exampleHTTPEvent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := readRecordings([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("Expected 2 archived events, got %d", len(events))
+	}
+
+	c.path = filepath.Join(path, "not-a-dir", "cassette.jsonl")
+	if err := c.record(exampleHTTPEvent); err == nil {
+		t.Error("Expected an error writing to an invalid path, but got <nil>")
+	}
+}
+
+func TestServerHandlerAutoModeSkipsFaults(t *testing.T) {
+	path, cleanup := tempCassettePath(t)
+	defer cleanup()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("from upstream"))
+	}))
+	defer upstream.Close()
+
+	c, err := loadCassette(path, mockMatcher{strictness: matchQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyCassette = c
+	defer func() { proxyCassette = nil }()
+	injector, err := newFaultInjector([]faultRule{{Fault: faultStatus, Status: 503}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyFaults = injector
+	defer func() { proxyFaults = nil }()
+
+	h := &capturingHandler{}
+	createServerHandler(h)(httptest.NewRecorder(), httptest.NewRequest("GET", upstream.URL+"/api", nil))
+	if len(h.events) != 1 || h.events[0].Fault == nil {
+		t.Fatalf("Expected the faulted event to be handled, got %v", h.events)
+	}
+	if _, ok := c.lookup(httptest.NewRequest("GET", upstream.URL+"/api", nil), ""); ok {
+		t.Error("Expected the faulted response to be left out of the cassette")
+	}
+}
+
+func TestServerHandlerAutoMode(t *testing.T) {
+	path, cleanup := tempCassettePath(t)
+	defer cleanup()
+
+	upstreamCalls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("X-Upstream", "true")
+		_, _ = w.Write([]byte("from upstream " + r.URL.RawQuery))
+	}))
+	defer upstream.Close()
+
+	c, err := loadCassette(path, mockMatcher{strictness: matchQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyCassette = c
+	defer func() { proxyCassette = nil }()
+
+	h := &capturingHandler{}
+	serve := createServerHandler(h)
+	for _, query := range []string{"a=1", "a=1", "a=2"} {
+		w := httptest.NewRecorder()
+		serve(w, httptest.NewRequest("GET", upstream.URL+"/api?"+query, strings.NewReader("")))
+		if body := w.Body.String(); body != "from upstream "+query {
+			t.Errorf("Expected the upstream response for %s, got %q", query, body)
+		}
+		if w.Header().Get("X-Upstream") != "true" {
+			t.Errorf("Expected upstream headers to be served for %s", query)
+		}
+	}
+
+	if upstreamCalls != 2 {
+		t.Errorf("Expected the repeated request to be played back, but upstream was called %d times", upstreamCalls)
+	}
+	if len(h.events) != 2 {
+		t.Errorf("Expected only the 2 new events to be handled, got %d", len(h.events))
+	}
+	archived, err := readRecordings([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 2 || archived[1].Query != "a=2" {
+		t.Errorf("Expected both new events in the cassette, got %v", archived)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/intuit/replay-zero/envelope"
+	flag "github.com/spf13/pflag"
+)
+
+// Where consumed events go
+const (
+	consumeOffline = "offline" // rendered with a template, like recording in offline mode
+	consumeArchive = "archive" // appended to a JSONL archive
+	consumeMock    = "mock"    // served by a mock server as they come in
+)
+
+// Builds the Kinesis client for `replay-zero consume`, replaced in tests
+var consumeClient = func(streamName, streamRole string) kinesisiface.KinesisAPI {
+	return buildClient(streamName, streamRole, log.Printf).client
+}
+
+// streamPosition is where reading a shard starts
+type streamPosition struct {
+	iteratorType string
+	// for AT_TIMESTAMP
+	timestamp time.Time
+}
+
+func parseStreamPosition(from string) (streamPosition, error) {
+	switch strings.ToUpper(from) {
+	case kinesis.ShardIteratorTypeTrimHorizon, kinesis.ShardIteratorTypeLatest:
+		return streamPosition{iteratorType: strings.ToUpper(from)}, nil
+	}
+	timestamp, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return streamPosition{}, fmt.Errorf("Invalid position %q, expected [TRIM_HORIZON], [LATEST] or an RFC 3339 timestamp (ex. 2020-06-01T12:00:00Z)", from)
+	}
+	return streamPosition{iteratorType: kinesis.ShardIteratorTypeAtTimestamp, timestamp: timestamp}, nil
+}
+
+// runConsume implements `replay-zero consume`, returning the process exit code
+func runConsume(args []string) int {
+	fs := flag.NewFlagSet("consume", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of replay-zero consume:\n  replay-zero consume --stream-name NAME [flags]\n")
+		fs.PrintDefaults()
+	}
+	streamName := fs.StringP("stream-name", "s", "", "AWS Kinesis Stream name to read recorded events from ("+kinesaliteStreamName+" for a local Kinesalite)")
+	streamRole := fs.StringP("stream-role-arn", "r", "", "AWS Kinesis Stream ARN (not needed for Kinesalite)")
+	from := fs.String("from", kinesis.ShardIteratorTypeTrimHorizon, "Where to start reading: [TRIM_HORIZON], [LATEST] or an RFC 3339 timestamp")
+	output := fs.String("output", consumeOffline, "What to do with the events: [offline] (write them out with --template), [archive] (append them to --archive) or [mock] (serve them on --listen)")
+	template := fs.StringP("template", "t", "karate", "One of [karate, gatling, k6, go, jmeter, hurl, http, jsonl] or [path/to/custom/template] (offline output only)")
+	extension := fs.StringP("extension", "e", "", "For custom output template (offline output only)")
+	batchSize := fs.IntP("batch-size", "b", -1, "Events per output file, negative for all of them in one file (offline output only)")
+	archive := fs.String("archive", "consumed.jsonl", "JSONL archive to append the events to (archive output only)")
+	listen := fs.String("listen", "localhost:8080", "Address the mock server listens on (mock output only)")
+	chunkTimeout := fs.Duration("chunk-timeout", time.Minute, "How long to wait for the missing chunks of an event before dropping it")
+	pollInterval := fs.Duration("poll-interval", time.Second, "Wait between reads once caught up with the stream")
+	kmsKeyID := fs.String("decrypt-kms-key", "", "Decrypt events encrypted with data keys from this KMS key (ID, ARN or alias/NAME)")
+	keyFile := fs.String("decrypt-key-file", "", "Decrypt events encrypted with data keys wrapped by the key in this file")
+	follow := fs.Bool("follow", false, "Keep reading new events until interrupted, rather than stopping once caught up (always on for mock output)")
+	fs.BoolVar(&flags.debug, "debug", false, "Set logging to also print debug messages")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *streamName == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if *streamRole == "" && *streamName != kinesaliteStreamName {
+		fmt.Fprintln(os.Stderr, "AWS Kinesis Stream ARN required to read from a stream other than "+kinesaliteStreamName)
+		return 2
+	}
+	position, err := parseStreamPosition(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	keys, err := newKeyProvider(*kmsKeyID, *keyFile, *streamRole)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	consumer := &streamConsumer{
+		stream:       *streamName,
+		position:     position,
+		pollInterval: *pollInterval,
+		follow:       *follow,
+		assembler:    newChunkAssembler(*chunkTimeout),
+	}
+	consumer.assembler.keys = keys
+	var done func()
+	switch *output {
+	case consumeOffline:
+		flags.batchSize = *batchSize
+		h := getOfflineHandler(*template, *extension)
+		consumer.handle = h.handleEvent
+		done = h.flushBuffer
+	case consumeArchive:
+		h, err := newArchiveHandler(*archive)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer h.file.Close()
+		consumer.handle = h.handleEvent
+		done = func() {
+			h.flushBuffer()
+			log.Printf("Appended events to %s\n", *archive)
+		}
+	case consumeMock:
+		server := newMockServer(nil, mockMatcher{strictness: matchQuery}, playbackSequential)
+		go func() {
+			log.Fatal(http.ListenAndServe(*listen, server))
+		}()
+		log.Printf("Serving consumed events on %s\n", *listen)
+		consumer.handle = server.addEvent
+		consumer.follow = true
+		done = func() {}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output %q, expected one of [offline, archive, mock]\n", *output)
+		return 2
+	}
+
+	consumer.client = consumeClient(*streamName, *streamRole)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+	err = consumer.run(stop)
+	done()
+	log.Printf("Consumed %d events (%d dropped for missing chunks, %d duplicate chunks skipped, %d corrupt)\n",
+		consumer.consumed, consumer.assembler.dropped, consumer.assembler.duplicates, consumer.assembler.corrupt)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// streamConsumer reads every shard of a stream and hands the reassembled events to handle
+type streamConsumer struct {
+	client       kinesisiface.KinesisAPI
+	stream       string
+	position     streamPosition
+	pollInterval time.Duration
+	// keep polling once caught up
+	follow    bool
+	assembler *chunkAssembler
+	handle    func(HTTPEvent)
+	consumed  int
+}
+
+// shardReader tracks how far a shard has been read
+type shardReader struct {
+	id       string
+	iterator *string
+}
+
+// run reads until caught up with the stream (or, when following, until stopped)
+func (c *streamConsumer) run(stop <-chan os.Signal) error {
+	seen := map[string]bool{}
+	readers, err := c.newShards(seen, c.position)
+	if err != nil {
+		return err
+	}
+	log.Printf("Reading %d shards of stream=%s from %s\n", len(readers), c.stream, c.position.iteratorType)
+	for len(readers) > 0 {
+		caughtUp, throttled := true, false
+		open := []*shardReader{}
+		for _, reader := range readers {
+			output, err := c.client.GetRecords(&kinesis.GetRecordsInput{ShardIterator: reader.iterator})
+			if err != nil {
+				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kinesis.ErrCodeProvisionedThroughputExceededException {
+					logDebug("Throttled reading shard %s, retrying", reader.id)
+					open = append(open, reader)
+					caughtUp, throttled = false, true
+					continue
+				}
+				return fmt.Errorf("Could not read shard %s: %w", reader.id, err)
+			}
+			for _, record := range output.Records {
+				c.process(record)
+			}
+			if len(output.Records) > 0 || aws.Int64Value(output.MillisBehindLatest) > 0 {
+				caughtUp = false
+			}
+			if output.NextShardIterator == nil {
+				// the shard was closed (split or merged), read the shards that replaced it
+				logDebug("Shard %s is closed", reader.id)
+				children, err := c.newShards(seen, streamPosition{iteratorType: kinesis.ShardIteratorTypeTrimHorizon})
+				if err != nil {
+					return err
+				}
+				open = append(open, children...)
+				caughtUp = false
+				continue
+			}
+			reader.iterator = output.NextShardIterator
+			open = append(open, reader)
+		}
+		readers = open
+		c.assembler.expire(time.Now())
+		if caughtUp && !c.follow {
+			break
+		}
+		wait := time.Duration(0)
+		if caughtUp || throttled {
+			wait = c.pollInterval
+		}
+		select {
+		case <-stop:
+			readers = nil
+		case <-time.After(wait):
+		}
+	}
+	// chunks still missing at this point are never coming
+	c.assembler.expire(time.Now().Add(c.assembler.timeout + time.Nanosecond))
+	return nil
+}
+
+// newShards starts reading the shards of the stream that haven't been seen yet
+func (c *streamConsumer) newShards(seen map[string]bool, position streamPosition) ([]*shardReader, error) {
+	readers := []*shardReader{}
+	input := &kinesis.DescribeStreamInput{StreamName: aws.String(c.stream)}
+	for {
+		output, err := c.client.DescribeStream(input)
+		if err == nil && output.StreamDescription == nil {
+			err = fmt.Errorf("empty response")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not list the shards of stream=%s: %w", c.stream, err)
+		}
+		shards := output.StreamDescription.Shards
+		for _, shard := range shards {
+			id := aws.StringValue(shard.ShardId)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			iteratorInput := &kinesis.GetShardIteratorInput{
+				StreamName:        aws.String(c.stream),
+				ShardId:           shard.ShardId,
+				ShardIteratorType: aws.String(position.iteratorType),
+			}
+			if position.iteratorType == kinesis.ShardIteratorTypeAtTimestamp {
+				iteratorInput.Timestamp = aws.Time(position.timestamp)
+			}
+			iterator, err := c.client.GetShardIterator(iteratorInput)
+			if err != nil {
+				return nil, fmt.Errorf("Could not start reading shard %s: %w", id, err)
+			}
+			readers = append(readers, &shardReader{id: id, iterator: iterator.ShardIterator})
+		}
+		if !aws.BoolValue(output.StreamDescription.HasMoreShards) || len(shards) == 0 {
+			return readers, nil
+		}
+		input.ExclusiveStartShardId = shards[len(shards)-1].ShardId
+	}
+}
+
+// process reassembles the event chunks in a record, handling the events they complete
+func (c *streamConsumer) process(record *kinesis.Record) {
+	records, err := deaggregateRecord(streamRecord{partitionKey: aws.StringValue(record.PartitionKey), data: record.Data})
+	if err != nil {
+		log.Printf("[ERROR] Skipping record %s: %v\n", aws.StringValue(record.SequenceNumber), err)
+		return
+	}
+	for _, r := range records {
+		chunk, err := envelope.Decode(r.data)
+		if err != nil {
+			log.Printf("[ERROR] Skipping record %s: %v\n", aws.StringValue(record.SequenceNumber), err)
+			continue
+		}
+		if chunk.ContentType != "" && chunk.ContentType != envelope.ContentTypeEvent {
+			log.Printf("[ERROR] Skipping record %s, it holds %s rather than a recorded event\n", aws.StringValue(record.SequenceNumber), chunk.ContentType)
+			continue
+		}
+		line, complete := c.assembler.add(chunk, time.Now())
+		if !complete {
+			continue
+		}
+		event := HTTPEvent{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			log.Printf("[ERROR] Skipping event %s, it isn't a recorded event: %v\n", chunk.UUID, err)
+			continue
+		}
+		if event.SchemaVersion > eventSchemaVersion {
+			logWarn(fmt.Sprintf("Event %s has schema version %d, newer than this version of Replay Zero knows (%d): some of its fields may be lost",
+				chunk.UUID, event.SchemaVersion, eventSchemaVersion))
+		}
+		logDebug("Consumed event %s (%s %s)", chunk.UUID, event.HTTPMethod, event.Endpoint)
+		c.handle(event)
+		c.consumed++
+	}
+}
+
+// - - - - - - - - - - - - -
+//     CHUNK REASSEMBLY
+// - - - - - - - - - - - - -
+
+// Most chunks an event can be split into. A 1MB Kinesis record per chunk puts
+// this well above any recorded event, while keeping what a corrupt chunk count
+// makes the assembler allocate small.
+const maxEventChunks = 10000
+
+// chunkAssembler puts events back together from their chunks, which can come
+// in any order, more than once (retried sends), or not at all
+type chunkAssembler struct {
+	// how long to wait for the rest of an event once its first chunk came in
+	timeout time.Duration
+	// decrypts encrypted events, nil if there's no key
+	keys    envelope.KeyProvider
+	pending map[string]*partialEvent
+	// when recently completed events were completed, to skip chunks sent twice
+	completed  map[string]time.Time
+	dropped    int
+	duplicates int
+	// chunks or whole events that didn't match their hash
+	corrupt int
+}
+
+type partialEvent struct {
+	chunks    []EventChunk
+	received  []bool
+	count     int
+	firstSeen time.Time
+}
+
+func newChunkAssembler(timeout time.Duration) *chunkAssembler {
+	return &chunkAssembler{
+		timeout:   timeout,
+		pending:   map[string]*partialEvent{},
+		completed: map[string]time.Time{},
+	}
+}
+
+// add returns the whole event once chunk was the last one missing
+func (a *chunkAssembler) add(chunk EventChunk, now time.Time) ([]byte, bool) {
+	// read from the stream, so checked before sizing or indexing anything with them
+	if chunk.NumChunks < 1 || chunk.NumChunks > maxEventChunks || chunk.ChunkNumber < 0 || chunk.ChunkNumber >= chunk.NumChunks {
+		log.Printf("[ERROR] Skipping chunk %d of %d of event %s, chunk numbers must be in range and events have at most %d chunks\n", chunk.ChunkNumber, chunk.NumChunks, chunk.UUID, maxEventChunks)
+		return nil, false
+	}
+	if err := chunk.Verify(); err != nil {
+		log.Printf("[ERROR] Skipping chunk: %v\n", err)
+		if errors.Is(err, envelope.ErrCorrupt) {
+			a.corrupt++
+		}
+		return nil, false
+	}
+	if _, ok := a.completed[chunk.UUID]; ok {
+		a.duplicates++
+		return nil, false
+	}
+	p, ok := a.pending[chunk.UUID]
+	if !ok {
+		p = &partialEvent{chunks: make([]EventChunk, chunk.NumChunks), received: make([]bool, chunk.NumChunks), firstSeen: now}
+		a.pending[chunk.UUID] = p
+	}
+	if len(p.chunks) != chunk.NumChunks {
+		log.Printf("[ERROR] Skipping chunk of event %s, it has %d chunks rather than %d\n", chunk.UUID, chunk.NumChunks, len(p.chunks))
+		return nil, false
+	}
+	if p.received[chunk.ChunkNumber] {
+		a.duplicates++
+		return nil, false
+	}
+	p.chunks[chunk.ChunkNumber] = chunk
+	p.received[chunk.ChunkNumber] = true
+	p.count++
+	if p.count < len(p.chunks) {
+		return nil, false
+	}
+	delete(a.pending, chunk.UUID)
+	a.completed[chunk.UUID] = now
+	line, err := envelope.Join(p.chunks, a.keys)
+	if err != nil {
+		log.Printf("[ERROR] Dropping event %s: %v\n", chunk.UUID, err)
+		if errors.Is(err, envelope.ErrCorrupt) {
+			a.corrupt++
+		}
+		return nil, false
+	}
+	return line, true
+}
+
+// expire drops the events still missing chunks after the timeout
+func (a *chunkAssembler) expire(now time.Time) {
+	for id, p := range a.pending {
+		if now.Sub(p.firstSeen) > a.timeout {
+			logWarn(fmt.Sprintf("Dropping event %s, only got %d of its %d chunks", id, p.count, len(p.chunks)))
+			delete(a.pending, id)
+			a.dropped++
+		}
+	}
+	// duplicates come from retried sends, which are over well before this
+	for id, completed := range a.completed {
+		if now.Sub(completed) > 10*a.timeout {
+			delete(a.completed, id)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/intuit/replay-zero/envelope"
+)
+
+// fakeStream serves records from in-memory shards, two at a time. Iterators
+// are "shard:offset", and shards listed in closed end once read, at which
+// point children get added to the stream.
+type fakeStream struct {
+	kinesisiface.KinesisAPI
+	mu         sync.Mutex
+	shards     []string
+	records    map[string][][]byte
+	closed     map[string]bool
+	children   []string
+	throttleOn map[string]bool
+	positions  []string
+}
+
+func (f *fakeStream) DescribeStream(inp *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// one shard per page
+	next := 0
+	if inp.ExclusiveStartShardId != nil {
+		for i, id := range f.shards {
+			if id == *inp.ExclusiveStartShardId {
+				next = i + 1
+			}
+		}
+	}
+	description := &kinesis.StreamDescription{HasMoreShards: aws.Bool(next < len(f.shards)-1)}
+	if next < len(f.shards) {
+		description.Shards = []*kinesis.Shard{{ShardId: aws.String(f.shards[next])}}
+	}
+	return &kinesis.DescribeStreamOutput{StreamDescription: description}, nil
+}
+
+func (f *fakeStream) GetShardIterator(inp *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.positions = append(f.positions, *inp.ShardIteratorType)
+	offset := 0
+	if *inp.ShardIteratorType == kinesis.ShardIteratorTypeLatest {
+		offset = len(f.records[*inp.ShardId])
+	}
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s:%d", *inp.ShardId, offset))}, nil
+}
+
+func (f *fakeStream) GetRecords(inp *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.SplitN(*inp.ShardIterator, ":", 2)
+	shard := parts[0]
+	offset, _ := strconv.Atoi(parts[1])
+	if f.throttleOn[*inp.ShardIterator] {
+		delete(f.throttleOn, *inp.ShardIterator)
+		return nil, awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "Rate exceeded", nil)
+	}
+	if shard == "missing" {
+		return nil, awserr.New(kinesis.ErrCodeResourceNotFoundException, "Shard not found", nil)
+	}
+	end := min(offset+2, len(f.records[shard]))
+	output := &kinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(int64(len(f.records[shard]) - end))}
+	for i, data := range f.records[shard][offset:end] {
+		output.Records = append(output.Records, &kinesis.Record{
+			Data:           data,
+			PartitionKey:   aws.String("key"),
+			SequenceNumber: aws.String(strconv.Itoa(offset + i)),
+		})
+	}
+	if !f.closed[shard] || end < len(f.records[shard]) {
+		output.NextShardIterator = aws.String(fmt.Sprintf("%s:%d", shard, end))
+	} else {
+		f.shards = append(f.shards, f.children...)
+		f.children = nil
+	}
+	return output, nil
+}
+
+// chunkEvent splits an event into chunks of size bytes, encoded as stream records
+func chunkEvent(t *testing.T, event HTTPEvent, id string, size int) [][]byte {
+	chunks, err := envelope.Split([]byte(httpEventToString(event)), id, size, envelope.Options{ContentType: envelope.ContentTypeEvent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := [][]byte{}
+	for _, chunk := range chunks {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, data)
+	}
+	return records
+}
+
+func TestParseStreamPosition(t *testing.T) {
+	var positionTests = []struct {
+		input    string
+		expected streamPosition
+		valid    bool
+	}{
+		{"TRIM_HORIZON", streamPosition{iteratorType: kinesis.ShardIteratorTypeTrimHorizon}, true},
+		{"latest", streamPosition{iteratorType: kinesis.ShardIteratorTypeLatest}, true},
+		{"2020-06-01T12:00:00Z", streamPosition{iteratorType: kinesis.ShardIteratorTypeAtTimestamp, timestamp: time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)}, true},
+		{"yesterday", streamPosition{}, false},
+	}
+	for _, tt := range positionTests {
+		position, err := parseStreamPosition(tt.input)
+		if (err == nil) != tt.valid || !reflect.DeepEqual(position, tt.expected) {
+			t.Errorf("parseStreamPosition(%q): expected %+v (valid=%v), got %+v %v", tt.input, tt.expected, tt.valid, position, err)
+		}
+	}
+}
+
+func TestChunkAssembler(t *testing.T) {
+	a := newChunkAssembler(time.Minute)
+	now := time.Now()
+	chunk := func(number, total int, id, data string) EventChunk {
+		return EventChunk{ChunkNumber: number, NumChunks: total, UUID: id, Data: data}
+	}
+
+	if line, ok := a.add(chunk(0, 1, "single", "whole"), now); !ok || string(line) != "whole" {
+		t.Errorf("Expected a single chunk event right away, got %q %v", line, ok)
+	}
+	// out of order, with a duplicate
+	for _, c := range []EventChunk{chunk(2, 3, "multi", "c"), chunk(0, 3, "multi", "a"), chunk(2, 3, "multi", "c")} {
+		if _, ok := a.add(c, now); ok {
+			t.Fatalf("Expected %+v to leave the event incomplete", c)
+		}
+	}
+	if line, ok := a.add(chunk(1, 3, "multi", "b"), now); !ok || string(line) != "abc" {
+		t.Errorf("Expected the chunks in order, got %q %v", line, ok)
+	}
+	// sent again after it was complete
+	if _, ok := a.add(chunk(0, 3, "multi", "a"), now); ok {
+		t.Error("Expected a chunk of a completed event to be skipped")
+	}
+	if a.duplicates != 2 {
+		t.Errorf("Expected 2 duplicates, got %d", a.duplicates)
+	}
+
+	for _, invalid := range []EventChunk{chunk(0, 0, "x", ""), chunk(0, -5, "x", ""), chunk(3, 3, "x", ""), chunk(-1, 3, "x", ""), chunk(0, maxEventChunks+1, "x", ""), chunk(0, 1<<40, "x", ""), chunk(0, 1, "", "")} {
+		if _, ok := a.add(invalid, now); ok {
+			t.Errorf("Expected invalid chunk %+v to be skipped", invalid)
+		}
+	}
+	if len(a.pending) != 0 {
+		t.Errorf("Expected invalid chunks to be skipped without waiting for the rest of their event, got %d pending", len(a.pending))
+	}
+	tampered, err := envelope.Split([]byte("abc"), "tampered", 1, envelope.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered[1].Data = "x"
+	if _, ok := a.add(tampered[1], now); ok || a.corrupt != 1 {
+		t.Errorf("Expected a chunk that doesn't match its hash to be skipped, got %d corrupt", a.corrupt)
+	}
+
+	a.add(chunk(0, 2, "mismatch", "a"), now)
+	if _, ok := a.add(chunk(1, 3, "mismatch", "b"), now); ok {
+		t.Error("Expected a chunk disagreeing on the number of chunks to be skipped")
+	}
+
+	a.add(chunk(0, 2, "incomplete", "a"), now)
+	a.expire(now.Add(30 * time.Second))
+	if len(a.pending) != 2 || a.dropped != 0 {
+		t.Errorf("Expected incomplete events to wait for the timeout, got %d pending", len(a.pending))
+	}
+	a.expire(now.Add(2 * time.Minute))
+	if len(a.pending) != 0 || a.dropped != 2 {
+		t.Errorf("Expected incomplete events to be dropped after the timeout, got %d pending %d dropped", len(a.pending), a.dropped)
+	}
+	a.expire(now.Add(11 * time.Minute))
+	if len(a.completed) != 0 {
+		t.Errorf("Expected completed events to be forgotten eventually, got %d", len(a.completed))
+	}
+}
+
+func newFakeStream(t *testing.T) *fakeStream {
+	first := HTTPEvent{PairID: "first", HTTPMethod: "GET", Endpoint: "/a", ResponseCode: "200"}
+	second := HTTPEvent{PairID: "second", HTTPMethod: "POST", Endpoint: "/b", ReqBody: strings.Repeat("x", 100), ResponseCode: "201"}
+	third := HTTPEvent{PairID: "third", HTTPMethod: "GET", Endpoint: "/c", ResponseCode: "200"}
+
+	secondChunks := chunkEvent(t, second, "uuid-2", 40)
+	shard0 := [][]byte{}
+	shard0 = append(shard0, chunkEvent(t, first, "uuid-1", 1000)...)
+	shard0 = append(shard0, secondChunks[1], []byte("not a chunk"), secondChunks[0])
+	shard0 = append(shard0, secondChunks[2:]...)
+	shard0 = append(shard0, secondChunks[0])
+	// an event that never gets its second chunk
+	shard0 = append(shard0, chunkEvent(t, third, "uuid-3", 30)[0])
+
+	// KPL aggregated records on the second shard
+	fourth := HTTPEvent{PairID: "fourth", HTTPMethod: "DELETE", Endpoint: "/d", ResponseCode: "204"}
+	fifth := HTTPEvent{PairID: "fifth", HTTPMethod: "GET", Endpoint: "/e", ResponseCode: "200"}
+	aggregated := aggregateRecords([]streamRecord{
+		{"a", chunkEvent(t, fourth, "uuid-4", 1000)[0]},
+		{"a", chunkEvent(t, fifth, "uuid-5", 1000)[0]},
+	})
+	return &fakeStream{
+		shards:     []string{"shard-0", "shard-1"},
+		records:    map[string][][]byte{"shard-0": shard0, "shard-1": {aggregated[0].data}},
+		closed:     map[string]bool{},
+		throttleOn: map[string]bool{"shard-0:2": true},
+	}
+}
+
+func TestStreamConsumer(t *testing.T) {
+	stream := newFakeStream(t)
+	events := []string{}
+	consumer := &streamConsumer{
+		client:       stream,
+		stream:       "test",
+		position:     streamPosition{iteratorType: kinesis.ShardIteratorTypeTrimHorizon},
+		pollInterval: time.Millisecond,
+		assembler:    newChunkAssembler(time.Minute),
+		handle:       func(e HTTPEvent) { events = append(events, e.PairID) },
+	}
+	if err := consumer.run(nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"first", "fourth", "fifth", "second"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+	if consumer.consumed != 4 || consumer.assembler.dropped != 1 || consumer.assembler.duplicates != 1 {
+		t.Errorf("Expected 4 events, 1 dropped and 1 duplicate, got %d %d %d", consumer.consumed, consumer.assembler.dropped, consumer.assembler.duplicates)
+	}
+
+	// starting from the end, there is nothing to read
+	events = nil
+	consumer.position = streamPosition{iteratorType: kinesis.ShardIteratorTypeLatest}
+	consumer.assembler = newChunkAssembler(time.Minute)
+	if err := consumer.run(nil); err != nil || len(events) != 0 {
+		t.Errorf("Expected no events from LATEST, got %v %v", events, err)
+	}
+}
+
+func TestStreamConsumerVersions(t *testing.T) {
+	event := httpEventToString(HTTPEvent{PairID: "legacy", HTTPMethod: "GET", Endpoint: "/a"})
+	legacy := [][]byte{}
+	for i, data := range []string{event[:10], event[10:]} {
+		record, err := json.Marshal(map[string]interface{}{"chunkNumber": i, "numberOfChunks": 2, "uuid": "uuid-1", "data": data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy = append(legacy, record)
+	}
+	records := append(legacy,
+		[]byte(`{"version":3,"chunkNumber":0,"numberOfChunks":1,"uuid":"uuid-2","data":"from the future"}`),
+		[]byte(`{"version":2,"chunkNumber":0,"numberOfChunks":1,"uuid":"uuid-3","data":"{}","contentType":"text/plain"}`))
+	records = append(records, chunkEvent(t, HTTPEvent{PairID: "newer", SchemaVersion: eventSchemaVersion + 1}, "uuid-4", 1000)...)
+
+	events := []string{}
+	consumer := &streamConsumer{
+		client:    &fakeStream{shards: []string{"shard-0"}, records: map[string][][]byte{"shard-0": records}},
+		stream:    "test",
+		position:  streamPosition{iteratorType: kinesis.ShardIteratorTypeTrimHorizon},
+		assembler: newChunkAssembler(time.Minute),
+		handle:    func(e HTTPEvent) { events = append(events, e.PairID) },
+	}
+	if err := consumer.run(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(events, []string{"legacy", "newer"}) {
+		t.Errorf("Expected unversioned chunks and newer events to be read, got %v", events)
+	}
+}
+
+func TestStreamConsumerClosedShard(t *testing.T) {
+	parent := HTTPEvent{PairID: "parent", HTTPMethod: "GET", Endpoint: "/a"}
+	child := HTTPEvent{PairID: "child", HTTPMethod: "GET", Endpoint: "/b"}
+	stream := &fakeStream{
+		shards:   []string{"parent"},
+		records:  map[string][][]byte{"parent": chunkEvent(t, parent, "uuid-1", 1000), "child": chunkEvent(t, child, "uuid-2", 1000)},
+		closed:   map[string]bool{"parent": true},
+		children: []string{"child"},
+	}
+	events := []string{}
+	consumer := &streamConsumer{
+		client:    stream,
+		stream:    "test",
+		position:  streamPosition{iteratorType: kinesis.ShardIteratorTypeTrimHorizon},
+		assembler: newChunkAssembler(time.Minute),
+		handle:    func(e HTTPEvent) { events = append(events, e.PairID) },
+	}
+	if err := consumer.run(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(events, []string{"parent", "child"}) {
+		t.Errorf("Expected the child shard to be read once the parent closed, got %v", events)
+	}
+	if !reflect.DeepEqual(stream.positions, []string{kinesis.ShardIteratorTypeTrimHorizon, kinesis.ShardIteratorTypeTrimHorizon}) {
+		t.Errorf("Expected the child shard to be read from its start, got %v", stream.positions)
+	}
+
+	readers, err := consumer.newShards(map[string]bool{"parent": true}, consumer.position)
+	if err != nil || len(readers) != 1 || readers[0].id != "child" {
+		t.Errorf("Expected only unseen shards, got %+v %v", readers, err)
+	}
+}
+
+func TestStreamConsumerErrors(t *testing.T) {
+	consumer := &streamConsumer{
+		client:    &mockKinesisClient{},
+		stream:    "simulate_empty_response",
+		assembler: newChunkAssembler(time.Minute),
+	}
+	if err := consumer.run(nil); err == nil {
+		t.Error("Expected an error listing shards, but got <nil>")
+	}
+	consumer.client = &fakeStream{shards: []string{"missing"}, records: map[string][][]byte{}}
+	consumer.stream = "test"
+	consumer.position = streamPosition{iteratorType: kinesis.ShardIteratorTypeTrimHorizon}
+	if err := consumer.run(nil); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected an error reading the shard, got %v", err)
+	}
+}
+
+func TestStreamConsumerFollow(t *testing.T) {
+	stream := &fakeStream{shards: []string{"shard-0"}, records: map[string][][]byte{}}
+	stop := make(chan os.Signal, 1)
+	consumer := &streamConsumer{
+		client:       stream,
+		stream:       "test",
+		position:     streamPosition{iteratorType: kinesis.ShardIteratorTypeTrimHorizon},
+		pollInterval: time.Millisecond,
+		follow:       true,
+		assembler:    newChunkAssembler(time.Minute),
+	}
+	consumer.handle = func(e HTTPEvent) { stop <- os.Interrupt }
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		stream.records["shard-0"] = chunkEvent(t, HTTPEvent{PairID: "late"}, "uuid-1", 1000)
+	}()
+	done := make(chan error)
+	go func() { done <- consumer.run(stop) }()
+	select {
+	case err := <-done:
+		if err != nil || consumer.consumed != 1 {
+			t.Errorf("Expected the late event to be read before stopping, got %d %v", consumer.consumed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the consumer to stop once interrupted")
+	}
+}
+
+func TestRunConsume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	originalClient := consumeClient
+	defer func() { consumeClient = originalClient }()
+	var stream *fakeStream
+	consumeClient = func(streamName, streamRole string) kinesisiface.KinesisAPI {
+		stream = newFakeStream(t)
+		return stream
+	}
+
+	archive := filepath.Join(dir, "consumed.jsonl")
+	var exitCodeTests = []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-s", kinesaliteStreamName, "--output", "archive", "--archive", archive, "--from", "2020-06-01T12:00:00Z"}, 0},
+		{[]string{"-s", "my-stream", "-r", "arn:aws:iam::123456789012:role/x", "--output", "archive", "--archive", filepath.Join(dir, "missing", "x.jsonl")}, 1},
+		{[]string{"-s", "my-stream"}, 2},
+		{[]string{"-s", kinesaliteStreamName, "--from", "yesterday"}, 2},
+		{[]string{"-s", kinesaliteStreamName, "--output", "printer"}, 2},
+		{[]string{"-s", kinesaliteStreamName, "--decrypt-kms-key", "alias/x", "--decrypt-key-file", "x.key"}, 2},
+		{[]string{"-s", kinesaliteStreamName, "extra"}, 2},
+		{[]string{}, 2},
+	}
+	for _, tt := range exitCodeTests {
+		if code := runConsume(tt.args); code != tt.code {
+			t.Errorf("runConsume(%v): expected exit code %d, got %d", tt.args, tt.code, code)
+		}
+	}
+
+	events, err := readRecordings([]string{archive})
+	if err != nil || len(events) != 4 {
+		t.Errorf("Expected 4 events in the archive, got %d %v", len(events), err)
+	}
+	if !reflect.DeepEqual(stream.positions, []string{kinesis.ShardIteratorTypeAtTimestamp, kinesis.ShardIteratorTypeAtTimestamp}) {
+		t.Errorf("Expected to read from the timestamp, got %v", stream.positions)
+	}
+}
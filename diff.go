@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of difference between a recorded and a live response
+const (
+	diffStatus = "status"
+	diffHeader = "header"
+	diffBody   = "body"
+)
+
+// difference is a single mismatch between a recorded and a live response
+type difference struct {
+	Kind string `json:"kind"`
+	// header name or JSONPath of the mismatch (empty for the status)
+	Path     string `json:"path,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (d difference) String() string {
+	return d.Message
+}
+
+// diffRules configure which parts of a response are expected to change between runs
+type diffRules struct {
+	// JSONPaths (ex. "$.meta.requestId", "$.items[*].updatedAt", "$..timestamp") skipped in bodies
+	IgnorePaths []string `yaml:"ignore_paths"`
+	// Headers skipped on top of the ones that always change (Date, ETag, ...)
+	IgnoreHeaders []string `yaml:"ignore_headers"`
+	// Regex replacements applied to header values and body strings before comparing
+	Normalizers []normalizerRule `yaml:"normalizers"`
+	// JSONPaths of arrays whose items may come back in any order
+	UnorderedArrays []string `yaml:"unordered_arrays"`
+}
+
+// normalizerRule is either a regex + replacement, or the name of a preset
+type normalizerRule struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+	Preset      string `yaml:"preset"`
+}
+
+// Commonly volatile values that can be normalized by name
+var normalizerPresets = map[string]normalizerRule{
+	"uuid":      {Pattern: `(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`, Replacement: "<uuid>"},
+	"timestamp": {Pattern: `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`, Replacement: "<timestamp>"},
+	"epoch":     {Pattern: `\b1\d{9}(\d{3})?\b`, Replacement: "<epoch>"},
+}
+
+type valueNormalizer struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// diffEngine compares recorded and live responses according to a set of diffRules
+type diffEngine struct {
+	ignorePaths     []jsonPathPattern
+	ignoreHeaders   map[string]bool
+	normalizers     []valueNormalizer
+	unorderedArrays []jsonPathPattern
+}
+
+// Compares everything except the headers that always change
+var defaultDiffEngine = &diffEngine{ignoreHeaders: map[string]bool{}}
+
+func newDiffEngine(rules diffRules) (*diffEngine, error) {
+	d := &diffEngine{ignoreHeaders: map[string]bool{}}
+	for _, p := range rules.IgnorePaths {
+		pattern, err := parseJSONPath(p)
+		if err != nil {
+			return nil, err
+		}
+		d.ignorePaths = append(d.ignorePaths, pattern)
+	}
+	for _, p := range rules.UnorderedArrays {
+		pattern, err := parseJSONPath(p)
+		if err != nil {
+			return nil, err
+		}
+		d.unorderedArrays = append(d.unorderedArrays, pattern)
+	}
+	for _, h := range rules.IgnoreHeaders {
+		d.ignoreHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, n := range rules.Normalizers {
+		if n.Preset != "" {
+			preset, ok := normalizerPresets[n.Preset]
+			if !ok {
+				return nil, fmt.Errorf("Unknown normalizer preset %q, expected one of [uuid, timestamp, epoch]", n.Preset)
+			}
+			n = preset
+		}
+		pattern, err := regexp.Compile(n.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid normalizer pattern %q: %w", n.Pattern, err)
+		}
+		d.normalizers = append(d.normalizers, valueNormalizer{pattern, n.Replacement})
+	}
+	return d, nil
+}
+
+// diffOptions are the command line flags shared by everything that compares responses
+type diffOptions struct {
+	rulesFile string
+	rules     diffRules
+	normalize []string
+	allArrays bool
+}
+
+func registerDiffFlags(fs *flag.FlagSet) *diffOptions {
+	o := &diffOptions{}
+	fs.StringVar(&o.rulesFile, "diff-rules", "", "YAML file of rules for comparing responses (ignore_paths, ignore_headers, normalizers, unordered_arrays)")
+	fs.StringSliceVar(&o.rules.IgnorePaths, "ignore-path", nil, "JSONPath to skip when comparing bodies, ex. $..updatedAt (repeatable)")
+	fs.StringSliceVar(&o.rules.IgnoreHeaders, "ignore-header", nil, "Header to skip when comparing responses (repeatable)")
+	fs.StringSliceVar(&o.normalize, "normalize", nil, "Normalize values before comparing: a preset [uuid, timestamp, epoch] or REGEX=REPLACEMENT (repeatable)")
+	fs.StringSliceVar(&o.rules.UnorderedArrays, "unordered-array", nil, "JSONPath of an array whose items may be in any order (repeatable)")
+	fs.BoolVar(&o.allArrays, "unordered-arrays", false, "Ignore the order of items in every array")
+	return o
+}
+
+// engine merges the rules file (if any) with the rules given as flags
+func (o *diffOptions) engine() (*diffEngine, error) {
+	rules := o.rules
+	if o.rulesFile != "" {
+		fileRules, err := loadDiffRules(o.rulesFile)
+		if err != nil {
+			return nil, err
+		}
+		rules.IgnorePaths = append(rules.IgnorePaths, fileRules.IgnorePaths...)
+		rules.IgnoreHeaders = append(rules.IgnoreHeaders, fileRules.IgnoreHeaders...)
+		rules.Normalizers = append(rules.Normalizers, fileRules.Normalizers...)
+		rules.UnorderedArrays = append(rules.UnorderedArrays, fileRules.UnorderedArrays...)
+	}
+	for _, n := range o.normalize {
+		if _, ok := normalizerPresets[n]; ok {
+			rules.Normalizers = append(rules.Normalizers, normalizerRule{Preset: n})
+			continue
+		}
+		parts := strings.SplitN(n, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid normalizer %q, expected a preset or REGEX=REPLACEMENT", n)
+		}
+		rules.Normalizers = append(rules.Normalizers, normalizerRule{Pattern: parts[0], Replacement: parts[1]})
+	}
+	if o.allArrays {
+		// $..* only matches below the root, so a top-level array needs $ too
+		rules.UnorderedArrays = append(rules.UnorderedArrays, "$", "$..*")
+	}
+	return newDiffEngine(rules)
+}
+
+func loadDiffRules(path string) (diffRules, error) {
+	rules := diffRules{}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	if err := yaml.Unmarshal(dat, &rules); err != nil {
+		return rules, fmt.Errorf("Could not parse diff rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func (d *diffEngine) normalize(s string) string {
+	for _, n := range d.normalizers {
+		s = n.pattern.ReplaceAllString(s, n.replacement)
+	}
+	return s
+}
+
+// diffEvents compares a recorded event against a live one and returns
+// the differences in status, headers and body
+func (d *diffEngine) diffEvents(expected, actual HTTPEvent) []difference {
+	diffs := []difference{}
+	if expected.ResponseCode != actual.ResponseCode {
+		diffs = append(diffs, difference{
+			Kind:     diffStatus,
+			Expected: expected.ResponseCode,
+			Actual:   actual.ResponseCode,
+			Message:  fmt.Sprintf("status: expected %s, got %s", expected.ResponseCode, actual.ResponseCode),
+		})
+	}
+	diffs = append(diffs, d.diffHeaders(expected.RespHeaders, actual.RespHeaders)...)
+	diffs = append(diffs, d.diffBodies(expected.RespBody, actual.RespBody)...)
+	return diffs
+}
+
+// diffHeaders checks that every recorded (non-ignored) header
+// is present in the live response with the same value
+func (d *diffEngine) diffHeaders(expected, actual []Header) []difference {
+	diffs := []difference{}
+	for _, h := range stableHeaders(expected) {
+		name := http.CanonicalHeaderKey(h.Name)
+		if d.ignoreHeaders[name] {
+			continue
+		}
+		value, ok := lookupHeader(actual, name)
+		if !ok {
+			diffs = append(diffs, difference{
+				Kind:     diffHeader,
+				Path:     name,
+				Expected: h.Value,
+				Message:  fmt.Sprintf("header %s: expected %q, but it was missing", name, h.Value),
+			})
+		} else if d.normalize(value) != d.normalize(h.Value) {
+			diffs = append(diffs, difference{
+				Kind:     diffHeader,
+				Path:     name,
+				Expected: h.Value,
+				Actual:   value,
+				Message:  fmt.Sprintf("header %s: expected %q, got %q", name, h.Value, value),
+			})
+		}
+	}
+	return diffs
+}
+
+// diffBodies compares JSON bodies structurally and anything else as (normalized) text
+func (d *diffEngine) diffBodies(expected, actual string) []difference {
+	var e, a interface{}
+	if json.Unmarshal([]byte(expected), &e) != nil || json.Unmarshal([]byte(actual), &a) != nil {
+		if d.normalize(expected) != d.normalize(actual) {
+			return []difference{{
+				Kind:     diffBody,
+				Expected: expected,
+				Actual:   actual,
+				Message:  fmt.Sprintf("body: expected %q, got %q", expected, actual),
+			}}
+		}
+		return []difference{}
+	}
+	return d.diffJSON(jsonPath{}, e, a)
+}
+
+func (d *diffEngine) matchesAny(patterns []jsonPathPattern, path jsonPath) bool {
+	for _, p := range patterns {
+		if p.matches(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func bodyDifference(path jsonPath, expected, actual interface{}, format string, args ...interface{}) difference {
+	diff := difference{Kind: diffBody, Path: path.String(), Message: path.String() + ": " + fmt.Sprintf(format, args...)}
+	if expected != nil {
+		diff.Expected = jsonLiteral(expected)
+	}
+	if actual != nil {
+		diff.Actual = jsonLiteral(actual)
+	}
+	return diff
+}
+
+func (d *diffEngine) diffJSON(path jsonPath, expected, actual interface{}) []difference {
+	diffs := []difference{}
+	if d.matchesAny(d.ignorePaths, path) {
+		return diffs
+	}
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			return append(diffs, bodyDifference(path, expected, actual, "expected an object, got %s", jsonTypeName(actual)))
+		}
+		keys := make([]string, 0, len(e)+len(a))
+		for k := range e {
+			keys = append(keys, k)
+		}
+		for k := range a {
+			if _, ok := e[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			childPath := path.key(k)
+			if d.matchesAny(d.ignorePaths, childPath) {
+				continue
+			}
+			eVal, eOk := e[k]
+			aVal, aOk := a[k]
+			switch {
+			case !aOk:
+				diffs = append(diffs, bodyDifference(childPath, eVal, nil, "expected %s, but it was missing", jsonLiteral(eVal)))
+			case !eOk:
+				diffs = append(diffs, bodyDifference(childPath, nil, aVal, "unexpected value %s", jsonLiteral(aVal)))
+			default:
+				diffs = append(diffs, d.diffJSON(childPath, eVal, aVal)...)
+			}
+		}
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			return append(diffs, bodyDifference(path, expected, actual, "expected an array, got %s", jsonTypeName(actual)))
+		}
+		if d.matchesAny(d.unorderedArrays, path) {
+			return append(diffs, d.diffUnordered(path, e, a)...)
+		}
+		if len(e) != len(a) {
+			diffs = append(diffs, bodyDifference(path, nil, nil, "expected %d items, got %d", len(e), len(a)))
+		}
+		for i := 0; i < min(len(e), len(a)); i++ {
+			diffs = append(diffs, d.diffJSON(path.index(i), e[i], a[i])...)
+		}
+	case string:
+		if s, ok := actual.(string); !ok || d.normalize(e) != d.normalize(s) {
+			diffs = append(diffs, bodyDifference(path, expected, actual, "expected %s, got %s", jsonLiteral(expected), jsonLiteral(actual)))
+		}
+	default:
+		if jsonLiteral(expected) != jsonLiteral(actual) {
+			diffs = append(diffs, bodyDifference(path, expected, actual, "expected %s, got %s", jsonLiteral(expected), jsonLiteral(actual)))
+		}
+	}
+	return diffs
+}
+
+// diffUnordered pairs up each expected item with any equal (under the
+// same rules) live item, and reports whatever is left on either side
+func (d *diffEngine) diffUnordered(path jsonPath, expected, actual []interface{}) []difference {
+	diffs := []difference{}
+	used := make([]bool, len(actual))
+	for i, e := range expected {
+		found := false
+		for j, a := range actual {
+			if !used[j] && len(d.diffJSON(path.index(i), e, a)) == 0 {
+				used[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			diffs = append(diffs, bodyDifference(path.index(i), e, nil, "expected item %s, but no matching item was found", jsonLiteral(e)))
+		}
+	}
+	for j, a := range actual {
+		if !used[j] {
+			diffs = append(diffs, bodyDifference(path.index(j), nil, a, "unexpected item %s", jsonLiteral(a)))
+		}
+	}
+	return diffs
+}
+
+func jsonLiteral(v interface{}) string {
+	// re-marshalling a decoded JSON value cannot fail
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// - - - - - - - - - - - - -
+//         JSONPATH
+// - - - - - - - - - - - - -
+
+// jsonPath is the concrete location of a value in a JSON document
+type jsonPath []jsonPathSegment
+
+type jsonPathSegment struct {
+	key   string
+	index int
+	// false for object keys
+	isIndex bool
+}
+
+func (p jsonPath) key(k string) jsonPath {
+	return append(p[:len(p):len(p)], jsonPathSegment{key: k})
+}
+
+func (p jsonPath) index(i int) jsonPath {
+	return append(p[:len(p):len(p)], jsonPathSegment{index: i, isIndex: true})
+}
+
+func (p jsonPath) String() string {
+	s := "$"
+	for _, segment := range p {
+		if segment.isIndex {
+			s = fmt.Sprintf("%s[%d]", s, segment.index)
+		} else {
+			s = jsonPathChild(s, segment.key)
+		}
+	}
+	return s
+}
+
+// jsonPathPattern is a parsed JSONPath expression supporting the subset
+// useful for ignore rules: .key, ['key'], [n], .*, [*] and ..key
+type jsonPathPattern []jsonPathToken
+
+type jsonPathToken struct {
+	kind  int
+	key   string
+	index int
+}
+
+const (
+	tokenKey = iota
+	tokenIndex
+	tokenWildcard
+	tokenRecursive
+)
+
+func parseJSONPath(expr string) (jsonPathPattern, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("Invalid JSONPath %q: must start with $", expr)
+	}
+	pattern := jsonPathPattern{}
+	rest := expr[1:]
+	for len(rest) > 0 {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			pattern = append(pattern, jsonPathToken{kind: tokenRecursive})
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				continue
+			}
+			token, n, err := parseJSONPathName(rest, expr)
+			if err != nil {
+				return nil, err
+			}
+			pattern = append(pattern, token)
+			rest = rest[n:]
+		case strings.HasPrefix(rest, "."):
+			token, n, err := parseJSONPathName(rest[1:], expr)
+			if err != nil {
+				return nil, err
+			}
+			pattern = append(pattern, token)
+			rest = rest[n+1:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("Invalid JSONPath %q: unclosed [", expr)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if inner == "*" {
+				pattern = append(pattern, jsonPathToken{kind: tokenWildcard})
+			} else if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				key := strings.ReplaceAll(inner[1:len(inner)-1], `\'`, `'`)
+				pattern = append(pattern, jsonPathToken{kind: tokenKey, key: key})
+			} else if i, err := strconv.Atoi(inner); err == nil {
+				pattern = append(pattern, jsonPathToken{kind: tokenIndex, index: i})
+			} else {
+				return nil, fmt.Errorf("Invalid JSONPath %q: unsupported selector [%s]", expr, inner)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid JSONPath %q: unexpected %q", expr, rest)
+		}
+	}
+	return pattern, nil
+}
+
+// parseJSONPathName reads a dot-notation name (or *) and returns how many bytes it used
+func parseJSONPathName(s, expr string) (jsonPathToken, int, error) {
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		end = len(s)
+	}
+	name := s[:end]
+	if name == "" {
+		return jsonPathToken{}, 0, fmt.Errorf("Invalid JSONPath %q: empty name", expr)
+	}
+	if name == "*" {
+		return jsonPathToken{kind: tokenWildcard}, end, nil
+	}
+	return jsonPathToken{kind: tokenKey, key: name}, end, nil
+}
+
+func (p jsonPathPattern) matches(path jsonPath) bool {
+	if len(p) == 0 {
+		return len(path) == 0
+	}
+	token := p[0]
+	if token.kind == tokenRecursive {
+		for i := 0; i <= len(path); i++ {
+			if p[1:].matches(path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	segment := path[0]
+	switch token.kind {
+	case tokenKey:
+		if segment.isIndex || segment.key != token.key {
+			return false
+		}
+	case tokenIndex:
+		if !segment.isIndex || segment.index != token.index {
+			return false
+		}
+	}
+	return p[1:].matches(path[1:])
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func messages(diffs []difference) []string {
+	m := []string{}
+	for _, d := range diffs {
+		m = append(m, d.String())
+	}
+	return m
+}
+
+func TestDiffEvents(t *testing.T) {
+	expected := HTTPEvent{
+		ResponseCode: "200",
+		RespHeaders: []Header{
+			{Name: "Content-Type", Value: "application/json"},
+			{Name: "X-Version", Value: "1"},
+			{Name: "Date", Value: "Tue, 18 Feb 2020 20:42:12 GMT"},
+		},
+		RespBody: `{"id": 1, "items": [1, 2], "nested": {"a": "b"}, "removed": true}`,
+	}
+	actual := HTTPEvent{
+		ResponseCode: "201",
+		RespHeaders: []Header{
+			{Name: "content-type", Value: "application/json"},
+			{Name: "Date", Value: "Wed, 19 Feb 2020 20:42:12 GMT"},
+		},
+		RespBody: `{"id": "1", "items": [1], "nested": {"a": "c"}, "added": null}`,
+	}
+	diffs := messages(defaultDiffEngine.diffEvents(expected, actual))
+	expectedDiffs := []string{
+		`status: expected 200, got 201`,
+		`header X-Version: expected "1", but it was missing`,
+		`$.added: unexpected value null`,
+		`$.id: expected 1, got "1"`,
+		`$.items: expected 2 items, got 1`,
+		`$.nested.a: expected "b", got "c"`,
+		`$.removed: expected true, but it was missing`,
+	}
+	if !reflect.DeepEqual(diffs, expectedDiffs) {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expectedDiffs, diffs)
+	}
+
+	if diffs := defaultDiffEngine.diffEvents(expected, expected); len(diffs) != 0 {
+		t.Errorf("Expected identical events to have no differences, got %v", diffs)
+	}
+}
+
+func TestDiffBodies(t *testing.T) {
+	var diffBodiesTests = []struct {
+		name     string
+		expected string
+		actual   string
+		diffs    []string
+	}{
+		{"equal text", "hello", "hello", []string{}},
+		{"different text", "hello", "goodbye", []string{`body: expected "hello", got "goodbye"`}},
+		{"JSON vs text", `{"a": 1}`, "oops", []string{`body: expected "{\"a\": 1}", got "oops"`}},
+		{"reformatted JSON", `{"a": [1, {"b": 2}]}`, "{\n  \"a\": [1, {\"b\": 2}]\n}", []string{}},
+		{"type change", `{"a": {"b": 1}}`, `{"a": [1]}`, []string{"$.a: expected an object, got array"}},
+		{"array to scalar", `[1]`, `{}`, []string{"$: expected an array, got object"}},
+	}
+	for _, tt := range diffBodiesTests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := messages(defaultDiffEngine.diffBodies(tt.expected, tt.actual))
+			if !reflect.DeepEqual(diffs, tt.diffs) {
+				t.Errorf("Expected %v, got %v", tt.diffs, diffs)
+			}
+		})
+	}
+}
+
+func TestDiffEngineRules(t *testing.T) {
+	engine, err := newDiffEngine(diffRules{
+		IgnorePaths:     []string{"$.meta", "$..updatedAt", "$.items[*].etag", "$['odd key']"},
+		IgnoreHeaders:   []string{"x-request-id"},
+		Normalizers:     []normalizerRule{{Preset: "uuid"}, {Pattern: `v\d+`, Replacement: "v#"}},
+		UnorderedArrays: []string{"$.tags"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := HTTPEvent{
+		ResponseCode: "200",
+		RespHeaders: []Header{
+			{Name: "X-Request-Id", Value: "abc"},
+			{Name: "X-Version", Value: "v1"},
+		},
+		RespBody: `{
+			"id": "8a5c7a1e-1b8f-4f2c-9a4e-0d2c5e6f7a8b",
+			"meta": {"took": 12},
+			"odd key": 1,
+			"items": [{"etag": "1", "updatedAt": 1, "name": "a"}],
+			"tags": ["x", "y", "y"]
+		}`,
+	}
+	actual := HTTPEvent{
+		ResponseCode: "200",
+		RespHeaders: []Header{
+			{Name: "X-Request-Id", Value: "def"},
+			{Name: "X-Version", Value: "v2"},
+		},
+		RespBody: `{
+			"id": "0f1e2d3c-4b5a-4969-8877-665544332211",
+			"meta": {"took": 40},
+			"odd key": 2,
+			"items": [{"etag": "2", "updatedAt": 2, "name": "a"}],
+			"tags": ["y", "x", "y"]
+		}`,
+	}
+	if diffs := engine.diffEvents(expected, actual); len(diffs) != 0 {
+		t.Errorf("Expected the rules to hide every difference, got %v", messages(diffs))
+	}
+
+	actual.RespBody = `{"id": "not-a-uuid", "items": [{"name": "b"}], "tags": ["y", "z"]}`
+	expectedDiffs := []string{
+		`$.id: expected "8a5c7a1e-1b8f-4f2c-9a4e-0d2c5e6f7a8b", got "not-a-uuid"`,
+		`$.items[0].name: expected "a", got "b"`,
+		`$.tags[0]: expected item "x", but no matching item was found`,
+		`$.tags[2]: expected item "y", but no matching item was found`,
+		`$.tags[1]: unexpected item "z"`,
+	}
+	if diffs := messages(engine.diffEvents(expected, actual)); !reflect.DeepEqual(diffs, expectedDiffs) {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expectedDiffs, diffs)
+	}
+}
+
+func TestDifferenceFields(t *testing.T) {
+	diffs := defaultDiffEngine.diffBodies(`{"a": {"b": [1]}}`, `{"a": {"b": [2]}}`)
+	expected := []difference{{Kind: diffBody, Path: "$.a.b[0]", Expected: "1", Actual: "2", Message: "$.a.b[0]: expected 1, got 2"}}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, diffs)
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	path := jsonPath{}.key("a").index(2).key("b c")
+	if path.String() != "$.a[2]['b c']" {
+		t.Errorf("Expected $.a[2]['b c'], got %s", path.String())
+	}
+	var parseTests = []struct {
+		pattern string
+		matches bool
+	}{
+		{"$.a[2]['b c']", true},
+		{`$.a[2]["b c"]`, true},
+		{"$.a[*]['b c']", true},
+		{"$.a.*.*", true},
+		{"$..['b c']", true},
+		{"$..[2]['b c']", true},
+		{"$..a..*", true},
+		{"$.a[1]['b c']", false},
+		{"$.a", false},
+		{"$..b", false},
+		{"$", false},
+	}
+	for _, tt := range parseTests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			pattern, err := parseJSONPath(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pattern.matches(path) != tt.matches {
+				t.Errorf("Expected match=%v", tt.matches)
+			}
+		})
+	}
+	for _, invalid := range []string{"a.b", "$.", "$.a[", "$[x]", "$a"} {
+		if _, err := parseJSONPath(invalid); err == nil {
+			t.Errorf("Expected an error for %q, but got <nil>", invalid)
+		}
+	}
+}
+
+func TestDiffOptionsEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rulesFile := filepath.Join(dir, "rules.yaml")
+	rules := `ignore_paths: ["$.meta"]
+ignore_headers: [X-Trace]
+normalizers:
+  - preset: timestamp
+  - pattern: 'req-\d+'
+    replacement: req
+unordered_arrays: ["$.tags"]
+`
+	if err := ioutil.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &diffOptions{rulesFile: rulesFile, normalize: []string{"uuid", "x+=x"}, allArrays: true}
+	engine, err := opts.engine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(engine.ignorePaths) != 1 || !engine.ignoreHeaders["X-Trace"] || len(engine.normalizers) != 4 || len(engine.unorderedArrays) != 3 {
+		t.Errorf("Expected the file and flag rules to be merged, got %+v", engine)
+	}
+	if diffs := engine.diffBodies(`"req-1 at 2020-02-18T20:42:12Z"`, `"req-2 at 2020-02-19T01:00:00.123+01:00"`); len(diffs) != 0 {
+		t.Errorf("Expected normalized values to match, got %v", messages(diffs))
+	}
+	if diffs := engine.diffBodies(`[1, {"tags": ["a", "b"]}]`, `[{"tags": ["b", "a"]}, 1]`); len(diffs) != 0 {
+		t.Errorf("Expected every array to be unordered, top-level included, got %v", messages(diffs))
+	}
+
+	var badOptions = []*diffOptions{
+		{rulesFile: filepath.Join(dir, "missing.yaml")},
+		{normalize: []string{"no-equals-sign"}},
+		{normalize: []string{"(=x"}},
+		{rules: diffRules{Normalizers: []normalizerRule{{Preset: "unknown"}}}},
+		{rules: diffRules{UnorderedArrays: []string{"tags"}}},
+	}
+	for _, o := range badOptions {
+		if _, err := o.engine(); err == nil {
+			t.Errorf("Expected an error for %+v, but got <nil>", o)
+		}
+	}
+	if err := ioutil.WriteFile(rulesFile, []byte("ignore_paths: {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&diffOptions{rulesFile: rulesFile}).engine(); err == nil {
+		t.Error("Expected an error for invalid YAML, but got <nil>")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/intuit/replay-zero/envelope"
+)
+
+// Data keys are reused for a batch of events, so KMS isn't called for every event
+const (
+	dataKeyEvents   = 1000
+	dataKeyLifetime = 5 * time.Minute
+)
+
+// kmsClient builds a KMS client, using the stream role's credentials when set.
+// Tests can replace it.
+var kmsClient = func(role string) kmsiface.KMSAPI {
+	userSession := session.Must(session.NewSession(&aws.Config{
+		CredentialsChainVerboseErrors: aws.Bool(verboseCredentialErrors),
+		Region:                        aws.String(getRegion()),
+	}))
+	config := &aws.Config{Region: aws.String(getRegion())}
+	if role != "" {
+		config.Credentials = stscreds.NewCredentials(userSession, role)
+	}
+	return kms.New(userSession, config)
+}
+
+// newKeyProvider picks where the keys to encrypt or decrypt events come
+// from, returning nil when there are none
+func newKeyProvider(kmsKeyID, keyFile, role string) (envelope.KeyProvider, error) {
+	switch {
+	case kmsKeyID != "" && keyFile != "":
+		return nil, fmt.Errorf("Set either a KMS key or a key file, not both")
+	case keyFile != "":
+		keys, err := envelope.LoadKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return keys, nil
+	case kmsKeyID != "":
+		return envelope.NewKMSKeys(kmsClient(role), kmsKeyID), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/intuit/replay-zero/envelope"
+)
+
+// writeKeyFile writes a static key to a temp dir, removed by the returned func
+func writeKeyFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "replay-zero.key")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	if err := ioutil.WriteFile(path, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestNewKeyProvider(t *testing.T) {
+	keyFile, cleanup := writeKeyFile(t)
+	defer cleanup()
+	originalClient := kmsClient
+	defer func() { kmsClient = originalClient }()
+	var role string
+	kmsClient = func(r string) kmsiface.KMSAPI {
+		role = r
+		return nil
+	}
+
+	if keys, err := newKeyProvider("", "", ""); keys != nil || err != nil {
+		t.Errorf("Expected no key provider without flags, got %v %v", keys, err)
+	}
+	if keys, err := newKeyProvider("", keyFile, ""); err != nil {
+		t.Errorf("Expected a key provider from the key file, got %v", err)
+	} else if _, ok := keys.(*envelope.StaticKeys); !ok {
+		t.Errorf("Expected static keys, got %T", keys)
+	}
+	if keys, err := newKeyProvider("alias/replay-zero", "", "arn:aws:iam::123456789012:role/x"); err != nil {
+		t.Errorf("Expected a KMS key provider, got %v", err)
+	} else if _, ok := keys.(*envelope.KMSKeys); !ok || role != "arn:aws:iam::123456789012:role/x" {
+		t.Errorf("Expected KMS keys with the stream role, got %T (role=%s)", keys, role)
+	}
+	if _, err := newKeyProvider("alias/replay-zero", keyFile, ""); err == nil {
+		t.Error("Expected an error setting both a KMS key and a key file, but got <nil>")
+	}
+	if _, err := newKeyProvider("", filepath.Join(filepath.Dir(keyFile), "missing.key"), ""); err == nil {
+		t.Error("Expected an error for a missing key file, but got <nil>")
+	}
+}
@@ -0,0 +1,47 @@
+package envelope
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	event := strings.Repeat(`{"id":1234,"name":"Widget","tags":["blue","large"],"price":9.99},`, 2000)
+	for _, method := range []string{CompressionGzip, CompressionZstd} {
+		chunks := mustSplit(t, event, "abc", 1000, Options{Compression: method})
+		if chunks[0].Compression != method || chunks[0].Encoding != EncodingBase64 {
+			t.Errorf("%s: expected compressed base64 chunks, got %+v", method, chunks[0])
+		}
+		if uncompressed := mustSplit(t, event, "abc", 1000, Options{}); len(chunks)*5 > len(uncompressed) {
+			t.Errorf("%s: expected at least 5x fewer chunks, got %d rather than %d", method, len(chunks), len(uncompressed))
+		}
+		joined, err := Join(chunks, nil)
+		if err != nil || string(joined) != event {
+			t.Errorf("%s: expected the event back, got %d bytes %v", method, len(joined), err)
+		}
+	}
+
+	if _, err := Split([]byte(event), "abc", 1000, Options{Compression: "lz4"}); err == nil {
+		t.Error("Expected an error for an unknown compression, but got <nil>")
+	}
+	// matches its hash, but was compressed with something else
+	mislabeled := mustSplit(t, event, "abc", 1000, Options{Compression: CompressionGzip})
+	for i := range mislabeled {
+		mislabeled[i].Compression = CompressionZstd
+	}
+	if _, err := Join(mislabeled, nil); err == nil || errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected a decompression error, got %v", err)
+	}
+}
+
+func TestValidCompression(t *testing.T) {
+	for _, method := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		if err := ValidCompression(method); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", method, err)
+		}
+	}
+	if err := ValidCompression("brotli"); err == nil {
+		t.Error("Expected an error for an unknown compression, but got <nil>")
+	}
+}
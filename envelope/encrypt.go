@@ -0,0 +1,186 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EncryptionAESGCM marks events sealed with AES-256-GCM under a data key
+const EncryptionAESGCM = "aes-256-gcm"
+
+// AES-256
+const dataKeySize = 32
+
+// ErrNoKey is returned when joining an encrypted event without a KeyProvider
+var ErrNoKey = errors.New("Event is encrypted, but there's no key to decrypt it with")
+
+// KeyProvider hands out data keys to encrypt events with, wrapped by a master
+// key that doesn't leave the provider (ex. a KMS key), and unwraps them again
+// to decrypt events.
+type KeyProvider interface {
+	// DataKey returns a new data key, in plaintext and wrapped
+	DataKey() (plaintext, wrapped []byte, err error)
+	// Unwrap returns the plaintext of a wrapped data key
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// StaticKeys wraps data keys with a fixed AES-256 key, for development and tests
+type StaticKeys struct {
+	aead cipher.AEAD
+}
+
+// NewStaticKeys wraps data keys with key, which must be 32 bytes
+func NewStaticKeys(key []byte) (*StaticKeys, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("Static key must be %d bytes, got %d", dataKeySize, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticKeys{aead: aead}, nil
+}
+
+// LoadKeyFile reads a static key from a file holding 32 bytes as base64,
+// ex. made with `head -c 32 /dev/urandom | base64`
+func LoadKeyFile(path string) (*StaticKeys, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(dat)))
+	if err != nil {
+		return nil, fmt.Errorf("Key file %s isn't base64: %w", path, err)
+	}
+	return NewStaticKeys(key)
+}
+
+// DataKey returns a new random data key, sealed with the static key
+func (s *StaticKeys) DataKey() ([]byte, []byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := seal(s.aead, key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, wrapped, nil
+}
+
+// Unwrap opens a data key sealed with the static key
+func (s *StaticKeys) Unwrap(wrapped []byte) ([]byte, error) {
+	key, err := open(s.aead, wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not unwrap data key, it was made with another key: %w", err)
+	}
+	return key, nil
+}
+
+// DataKeys reuses a data key for a batch of events, so the KeyProvider
+// (ex. KMS) isn't called for every event. A new key is made after maxUses
+// events or once the key is older than maxAge.
+type DataKeys struct {
+	provider KeyProvider
+	maxUses  int
+	maxAge   time.Duration
+
+	mu      sync.Mutex
+	key     []byte
+	wrapped []byte
+	uses    int
+	created time.Time
+}
+
+// NewDataKeys gets data keys from provider, each used for up to maxUses events and maxAge
+func NewDataKeys(provider KeyProvider, maxUses int, maxAge time.Duration) *DataKeys {
+	return &DataKeys{provider: provider, maxUses: maxUses, maxAge: maxAge}
+}
+
+// next returns the data key to encrypt the next event with
+func (d *DataKeys) next() ([]byte, []byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.key == nil || d.uses >= d.maxUses || time.Since(d.created) > d.maxAge {
+		key, wrapped, err := d.provider.DataKey()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not get a data key: %w", err)
+		}
+		d.key, d.wrapped, d.uses, d.created = key, wrapped, 0, time.Now()
+	}
+	d.uses++
+	return d.key, d.wrapped, nil
+}
+
+// encrypt seals payload with the next data key, bound to the event's UUID so
+// it can't be passed off as another event
+func encrypt(payload []byte, id string, keys *DataKeys) ([]byte, []byte, error) {
+	key, wrapped, err := keys.next()
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := seal(aead, payload, []byte(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealed, wrapped, nil
+}
+
+func decrypt(sealed []byte, first Chunk, keys KeyProvider) ([]byte, error) {
+	if first.Encryption != EncryptionAESGCM {
+		return nil, fmt.Errorf("Unknown encryption %q for event %s", first.Encryption, first.UUID)
+	}
+	if keys == nil {
+		return nil, ErrNoKey
+	}
+	key, err := keys.Unwrap(first.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := open(aead, sealed, []byte(first.UUID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decrypt event %s", ErrCorrupt, first.UUID)
+	}
+	return payload, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext, prefixed with a random nonce
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Sealed data is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
@@ -0,0 +1,153 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeys(t *testing.T) *StaticKeys {
+	keys, err := NewStaticKeys(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestEncryption(t *testing.T) {
+	keys := newTestKeys(t)
+	event := strings.Repeat(`{"card":"4111 1111 1111 1111"},`, 100)
+	for _, compression := range []string{CompressionNone, CompressionGzip} {
+		chunks := mustSplit(t, event, "abc", 100, Options{Compression: compression, Keys: NewDataKeys(keys, 10, time.Minute)})
+		for _, c := range chunks {
+			if c.Encryption != EncryptionAESGCM || len(c.WrappedKey) == 0 || c.Encoding != EncodingBase64 {
+				t.Fatalf("Expected an encrypted chunk, got %+v", c)
+			}
+			if data, _ := c.Bytes(); bytes.Contains(data, []byte("4111")) {
+				t.Errorf("Expected the chunk data to be unreadable, got %q", data)
+			}
+		}
+		joined, err := Join(chunks, keys)
+		if err != nil || string(joined) != event {
+			t.Errorf("%q: expected the event back, got %d bytes %v", compression, len(joined), err)
+		}
+		if _, err := Join(chunks, nil); !errors.Is(err, ErrNoKey) {
+			t.Errorf("Expected ErrNoKey without a key provider, got %v", err)
+		}
+	}
+
+	chunks := mustSplit(t, event, "abc", 100, Options{Keys: NewDataKeys(keys, 10, time.Minute)})
+	otherKeys, err := NewStaticKeys(bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Join(chunks, otherKeys); err == nil {
+		t.Error("Expected an error decrypting with another key, but got <nil>")
+	}
+
+	// the same ciphertext under another event's UUID, with matching hashes
+	moved := mustSplit(t, "x", "def", 100, Options{})[0]
+	whole := mustSplit(t, event, "abc", 1<<20, Options{Keys: NewDataKeys(keys, 10, time.Minute)})[0]
+	whole.UUID = moved.UUID
+	if _, err := Join([]Chunk{whole}, keys); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for an event moved to another UUID, got %v", err)
+	}
+
+	unknown := whole
+	unknown.UUID, unknown.Encryption = "abc", "rot13"
+	if _, err := Join([]Chunk{unknown}, keys); err == nil {
+		t.Error("Expected an error for an unknown encryption, but got <nil>")
+	}
+}
+
+// countingKeys counts the data keys made
+type countingKeys struct {
+	*StaticKeys
+	made int
+}
+
+func (c *countingKeys) DataKey() ([]byte, []byte, error) {
+	c.made++
+	return c.StaticKeys.DataKey()
+}
+
+func TestDataKeys(t *testing.T) {
+	provider := &countingKeys{StaticKeys: newTestKeys(t)}
+	keys := NewDataKeys(provider, 3, time.Minute)
+	wrappedKeys := map[string]bool{}
+	for i := 0; i < 7; i++ {
+		_, wrapped, err := keys.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrappedKeys[string(wrapped)] = true
+	}
+	if provider.made != 3 || len(wrappedKeys) != 3 {
+		t.Errorf("Expected a new key every 3 events, got %d keys", provider.made)
+	}
+
+	keys = NewDataKeys(provider, 100, time.Millisecond)
+	keys.next()
+	time.Sleep(5 * time.Millisecond)
+	keys.next()
+	if provider.made != 5 {
+		t.Errorf("Expected a new key once the old one expired, got %d keys", provider.made)
+	}
+}
+
+func TestStaticKeys(t *testing.T) {
+	if _, err := NewStaticKeys([]byte("too short")); err == nil {
+		t.Error("Expected an error for a short key, but got <nil>")
+	}
+	keys := newTestKeys(t)
+	key, wrapped, err := keys.DataKey()
+	if err != nil || len(key) != 32 || bytes.Contains(wrapped, key) {
+		t.Fatalf("Expected a wrapped 32 byte key, got %d bytes %v", len(key), err)
+	}
+	if unwrapped, err := keys.Unwrap(wrapped); err != nil || !bytes.Equal(unwrapped, key) {
+		t.Errorf("Expected the data key back, got %v", err)
+	}
+	if _, err := keys.Unwrap(wrapped[:5]); err == nil {
+		t.Error("Expected an error for a truncated key, but got <nil>")
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	valid := write("valid.key", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))+"\n")
+	keys, err := LoadKeyFile(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wrapped, err := newTestKeys(t).DataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Unwrap(wrapped); err != nil {
+		t.Errorf("Expected the key from the file, got %v", err)
+	}
+
+	for _, path := range []string{write("short.key", "c2hvcnQ="), write("binary.key", "\x00\x01"), filepath.Join(dir, "missing.key")} {
+		if _, err := LoadKeyFile(path); err == nil {
+			t.Errorf("Expected an error loading %s, but got <nil>", path)
+		}
+	}
+}
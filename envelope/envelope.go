@@ -0,0 +1,317 @@
+// Package envelope splits recorded events into chunks small enough for a
+// stream record, and puts them back together on the other end.
+//
+// Version 1 chunks only carry their position and the event's UUID. Version 2
+// adds a SHA-256 of each chunk and of the whole event, so corrupted or mixed
+// up chunks are caught, along with the content type, compression and
+// encryption of the event. Decode reads both versions.
+package envelope
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Version is the envelope version written by Split
+const Version = 2
+
+// Chunks without a version field predate versioning
+const legacyVersion = 1
+
+// ContentTypeEvent marks chunks of a recorded HTTP request/response pair
+const ContentTypeEvent = "application/vnd.replay-zero.event+json"
+
+// EncodingBase64 marks chunks whose data is base64, rather than the event's text as-is
+const EncodingBase64 = "base64"
+
+// How events can be compressed before being split
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	// ErrUnsupportedVersion is returned for chunks written by a newer envelope version
+	ErrUnsupportedVersion = errors.New("Unsupported envelope version")
+	// ErrCorrupt is returned when a chunk or event doesn't match its hash or length
+	ErrCorrupt = errors.New("Corrupt event chunk")
+)
+
+// Chunk is one piece of an event, as sent in a stream record
+type Chunk struct {
+	// 0 when decoding a chunk sent before versioning, see Decode
+	Version     int    `json:"version,omitempty"`
+	ChunkNumber int    `json:"chunkNumber"`
+	NumChunks   int    `json:"numberOfChunks"`
+	UUID        string `json:"uuid"`
+	Data        string `json:"data"`
+	// The Kinesis partition key the chunk was sent with
+	PartitionKey string `json:"partitionKey,omitempty"`
+
+	// Version 2 fields
+	ContentType string `json:"contentType,omitempty"`
+	// How the event was compressed before being split, empty if it wasn't
+	Compression string `json:"compression,omitempty"`
+	// Empty when Data is text, see EncodingBase64
+	Encoding string `json:"encoding,omitempty"`
+	// How the event was encrypted (after compressing it), empty if it wasn't
+	Encryption string `json:"encryption,omitempty"`
+	// The data key the event was encrypted with, wrapped by the KeyProvider
+	WrappedKey []byte `json:"wrappedKey,omitempty"`
+	// Hex SHA-256 of this chunk's (decoded) data
+	ChunkHash string `json:"chunkSha256,omitempty"`
+	// Hex SHA-256 and length in bytes of the whole event, as it was split
+	EventHash   string `json:"eventSha256,omitempty"`
+	EventLength int    `json:"eventLength,omitempty"`
+}
+
+// Options describe the event being split
+type Options struct {
+	ContentType string
+	// One of the Compression constants. Compressed chunks are sent as base64.
+	Compression string
+	// Encrypts events when set. Encrypted chunks are sent as base64.
+	Keys *DataKeys
+}
+
+// Split compresses and encrypts payload if asked to, then cuts it into
+// chunks whose data takes up at most size bytes once JSON encoded. Text is
+// split between characters and sent as-is, anything else is sent as base64.
+func Split(payload []byte, id string, size int, opts Options) ([]Chunk, error) {
+	p, err := prepare(payload, id, opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.split(size), nil
+}
+
+// SplitRecords is Split for records of at most recordSize bytes: each chunk,
+// JSON encoded, fits in a record along with reserve more bytes (ex. for the
+// partition key). The room left for the data depends on the envelope fields
+// of the event, like the size of its wrapped data key.
+func SplitRecords(payload []byte, id string, recordSize, reserve int, opts Options) ([]Chunk, error) {
+	p, err := prepare(payload, id, opts)
+	if err != nil {
+		return nil, err
+	}
+	overhead := p.overhead()
+	if recordSize-reserve-overhead < 1 {
+		return nil, fmt.Errorf("Records of %d bytes leave no room for data after %d bytes of envelope and %d reserved", recordSize, overhead, reserve)
+	}
+	return p.split(recordSize - reserve - overhead), nil
+}
+
+// prepared is an event compressed and encrypted as asked, ready to be cut into chunks
+type prepared struct {
+	payload []byte
+	id      string
+	opts    Options
+	// envelope fields that depend on the compression and encryption
+	encoding   string
+	encryption string
+	wrapped    []byte
+}
+
+func prepare(payload []byte, id string, opts Options) (prepared, error) {
+	payload, err := compress(payload, opts.Compression)
+	if err != nil {
+		return prepared{}, err
+	}
+	p := prepared{id: id, opts: opts}
+	if opts.Keys != nil {
+		if payload, p.wrapped, err = encrypt(payload, id, opts.Keys); err != nil {
+			return prepared{}, err
+		}
+		p.encryption = EncryptionAESGCM
+	}
+	if opts.Compression != "" || p.encryption != "" || !utf8.Valid(payload) {
+		p.encoding = EncodingBase64
+	}
+	p.payload = payload
+	return p, nil
+}
+
+func (p prepared) split(size int) []Chunk {
+	var pieces [][]byte
+	if p.encoding == EncodingBase64 {
+		pieces = splitBytes(p.payload, size)
+	} else {
+		pieces = splitText(p.payload, size)
+	}
+	eventHash := hash(p.payload)
+	chunks := make([]Chunk, 0, len(pieces))
+	for i, piece := range pieces {
+		data := string(piece)
+		if p.encoding == EncodingBase64 {
+			data = base64.StdEncoding.EncodeToString(piece)
+		}
+		chunk := p.chunk(i, len(pieces))
+		chunk.Data = data
+		chunk.ChunkHash = hash(piece)
+		chunk.EventHash = eventHash
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// chunk returns the envelope of a chunk, without its data or hashes
+func (p prepared) chunk(number, count int) Chunk {
+	return Chunk{
+		Version:     Version,
+		ChunkNumber: number,
+		NumChunks:   count,
+		UUID:        p.id,
+		ContentType: p.opts.ContentType,
+		Compression: p.opts.Compression,
+		Encoding:    p.encoding,
+		Encryption:  p.encryption,
+		WrappedKey:  p.wrapped,
+		EventLength: len(p.payload),
+	}
+}
+
+// overhead is the most a chunk's JSON takes up besides its data. There can't
+// be more chunks than bytes, which bounds the length of the chunk numbers.
+func (p prepared) overhead() int {
+	most := len(p.payload) + 1
+	chunk := p.chunk(most, most)
+	chunk.ChunkHash = hash(nil)
+	chunk.EventHash = hash(nil)
+	// a Chunk always encodes
+	encoded, _ := json.Marshal(chunk)
+	return len(encoded)
+}
+
+// splitText splits valid UTF-8 between characters, counting the escapes JSON adds
+func splitText(payload []byte, size int) [][]byte {
+	pieces := [][]byte{}
+	start, length := 0, 0
+	for i, r := range string(payload) {
+		n := jsonLength(r)
+		if length+n > size && i > start {
+			pieces = append(pieces, payload[start:i])
+			start, length = i, 0
+		}
+		length += n
+	}
+	return append(pieces, payload[start:])
+}
+
+// jsonLength is how many bytes r takes up in a JSON string (as encoding/json writes it)
+func jsonLength(r rune) int {
+	switch {
+	case r == '"' || r == '\\' || r == '\n' || r == '\r' || r == '\t':
+		return 2
+	case r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029':
+		return 6
+	}
+	return utf8.RuneLen(r)
+}
+
+// splitBytes splits payload so each piece is at most size bytes once base64 encoded
+func splitBytes(payload []byte, size int) [][]byte {
+	n := size / 4 * 3
+	if n < 3 {
+		n = 3
+	}
+	pieces := [][]byte{}
+	for start := 0; start < len(payload) || start == 0; start += n {
+		end := start + n
+		if end > len(payload) {
+			end = len(payload)
+		}
+		pieces = append(pieces, payload[start:end])
+	}
+	return pieces
+}
+
+// Decode reads a chunk of any supported version. Check it with Verify.
+func Decode(data []byte) (Chunk, error) {
+	c := Chunk{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("Not an event chunk: %w", err)
+	}
+	if c.Version == 0 {
+		c.Version = legacyVersion
+	}
+	if c.Version > Version {
+		return c, fmt.Errorf("%w %d (up to %d)", ErrUnsupportedVersion, c.Version, Version)
+	}
+	return c, nil
+}
+
+// Verify checks the chunk's position and, from version 2, its hash
+func (c Chunk) Verify() error {
+	if c.UUID == "" || c.NumChunks < 1 || c.ChunkNumber < 0 || c.ChunkNumber >= c.NumChunks {
+		return fmt.Errorf("Invalid chunk %d of %d (uuid=%q)", c.ChunkNumber, c.NumChunks, c.UUID)
+	}
+	data, err := c.Bytes()
+	if err != nil {
+		return err
+	}
+	if c.Version >= 2 && hash(data) != c.ChunkHash {
+		return fmt.Errorf("%w: chunk %d of event %s doesn't match its hash", ErrCorrupt, c.ChunkNumber, c.UUID)
+	}
+	return nil
+}
+
+// Bytes returns the chunk's data, decoding base64
+func (c Chunk) Bytes() ([]byte, error) {
+	switch c.Encoding {
+	case "":
+		return []byte(c.Data), nil
+	case EncodingBase64:
+		data, err := base64.StdEncoding.DecodeString(c.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: chunk %d of event %s: %v", ErrCorrupt, c.ChunkNumber, c.UUID, err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("Unknown encoding %q for chunk %d of event %s", c.Encoding, c.ChunkNumber, c.UUID)
+}
+
+// Join puts an event back together from all of its chunks, in order, then
+// decrypts (with keys, which can be nil for unencrypted events) and
+// decompresses it. From version 2, the event has to match the length and hash
+// it was sent with.
+func Join(chunks []Chunk, keys KeyProvider) ([]byte, error) {
+	if len(chunks) == 0 {
+		return nil, errors.New("No chunks to join")
+	}
+	first := chunks[0]
+	payload := []byte{}
+	for i, c := range chunks {
+		if c.UUID != first.UUID || c.NumChunks != len(chunks) || c.ChunkNumber != i {
+			return nil, fmt.Errorf("Chunk %d of %d (uuid=%s) is out of place at %d of %d (uuid=%s)",
+				c.ChunkNumber, c.NumChunks, c.UUID, i, len(chunks), first.UUID)
+		}
+		data, err := c.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, data...)
+	}
+	if first.Version >= 2 && (len(payload) != first.EventLength || hash(payload) != first.EventHash) {
+		return nil, fmt.Errorf("%w: event %s doesn't match its length and hash", ErrCorrupt, first.UUID)
+	}
+	if first.Encryption != "" {
+		var err error
+		if payload, err = decrypt(payload, first, keys); err != nil {
+			return nil, err
+		}
+	}
+	event, err := decompress(payload, first.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decompress event %s: %w", first.UUID, err)
+	}
+	return event, nil
+}
+
+func hash(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
@@ -0,0 +1,210 @@
+package envelope
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustSplit(t *testing.T, payload, id string, size int, opts Options) []Chunk {
+	chunks, err := Split([]byte(payload), id, size, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+// dataOf returns the data of each chunk
+func dataOf(chunks []Chunk) []string {
+	data := []string{}
+	for _, c := range chunks {
+		data = append(data, c.Data)
+	}
+	return data
+}
+
+func TestSplit(t *testing.T) {
+	var splitTests = []struct {
+		name     string
+		payload  string
+		size     int
+		opts     Options
+		expected []string
+	}{
+		{"text", "apple", 2, Options{}, []string{"ap", "pl", "e"}},
+		{"fits", "apple", 10, Options{}, []string{"apple"}},
+		{"empty", "", 10, Options{}, []string{""}},
+		// the quotes take 2 bytes each once escaped
+		{"escapes", `{"a":1}`, 4, Options{}, []string{`{"a`, `":1`, `}`}},
+		// never splits inside a character
+		{"unicode", "héé", 3, Options{}, []string{"hé", "é"}},
+		{"binary", "\xff\xfe\xfd\xfc", 4, Options{}, []string{"//79", "/A=="}},
+	}
+	for _, tt := range splitTests {
+		chunks := mustSplit(t, tt.payload, "id", tt.size, tt.opts)
+		if data := dataOf(chunks); !reflect.DeepEqual(data, tt.expected) {
+			t.Errorf("%s: expected chunks %q, got %q", tt.name, tt.expected, data)
+		}
+		for i, c := range chunks {
+			if c.Version != Version || c.ChunkNumber != i || c.NumChunks != len(chunks) || c.UUID != "id" || c.EventLength != len(tt.payload) {
+				t.Errorf("%s: unexpected envelope %+v", tt.name, c)
+			}
+			if err := c.Verify(); err != nil {
+				t.Errorf("%s: expected chunk %d to verify, got %v", tt.name, i, err)
+			}
+		}
+		joined, err := Join(chunks, nil)
+		if err != nil || string(joined) != tt.payload {
+			t.Errorf("%s: expected to join back into %q, got %q %v", tt.name, tt.payload, joined, err)
+		}
+	}
+}
+
+func TestSplitSize(t *testing.T) {
+	payload := strings.Repeat("{\"name\":\"<tag> & \\\"quote\\\"\n\u2028\",\"emoji\":\"🎉\"}", 50)
+	for _, opts := range []Options{{}, {Compression: CompressionGzip}} {
+		for _, c := range mustSplit(t, payload, "id", 100, opts) {
+			encoded, err := json.Marshal(c.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encoded)-2 > 100 {
+				t.Errorf("Expected chunk data to encode to at most 100 bytes, got %d", len(encoded)-2)
+			}
+		}
+	}
+}
+
+// bigWrappedKeys wraps data keys into something as long as a KMS ciphertext blob
+type bigWrappedKeys struct {
+	*StaticKeys
+}
+
+func (b *bigWrappedKeys) DataKey() ([]byte, []byte, error) {
+	key, wrapped, err := b.StaticKeys.DataKey()
+	return key, append(wrapped, make([]byte, 200)...), err
+}
+
+func (b *bigWrappedKeys) Unwrap(wrapped []byte) ([]byte, error) {
+	return b.StaticKeys.Unwrap(wrapped[:len(wrapped)-200])
+}
+
+func TestSplitRecords(t *testing.T) {
+	keys := &bigWrappedKeys{newTestKeys(t)}
+	payload := strings.Repeat("{\"name\":\"<tag> & \\\"quote\\\"\n\u2028\",\"emoji\":\"🎉\"}", 200)
+	for _, opts := range []Options{{ContentType: "text/plain"}, {Compression: CompressionGzip}, {Keys: NewDataKeys(keys, 10, time.Hour)}} {
+		chunks, err := SplitRecords([]byte(payload), "8a3c3d4e-7f2b-4c1d-9e6a-5b4c3d2e1f0a", 1000, 100, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		largest := 0
+		for _, c := range chunks {
+			encoded, err := json.Marshal(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encoded) > largest {
+				largest = len(encoded)
+			}
+		}
+		// only the last chunk can be smaller than the rest
+		if largest > 900 || (len(chunks) > 2 && largest < 890) {
+			t.Errorf("Expected full chunks of up to 900 bytes, got %d bytes", largest)
+		}
+		if joined, err := Join(chunks, keys); err != nil || string(joined) != payload {
+			t.Errorf("Expected the chunks to join back together, got %v", err)
+		}
+	}
+
+	if _, err := SplitRecords([]byte(payload), "id", 300, 100, Options{Keys: NewDataKeys(keys, 10, time.Hour)}); err == nil {
+		t.Error("Expected an error for records too small for the envelope, but got <nil>")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	legacy, err := Decode([]byte(`{"chunkNumber":1,"numberOfChunks":2,"uuid":"abc","data":"tail"}`))
+	expected := Chunk{Version: 1, ChunkNumber: 1, NumChunks: 2, UUID: "abc", Data: "tail"}
+	if err != nil || !reflect.DeepEqual(legacy, expected) {
+		t.Errorf("Expected a version 1 chunk %+v, got %+v %v", expected, legacy, err)
+	}
+	if err := legacy.Verify(); err != nil {
+		t.Errorf("Expected a version 1 chunk to verify without hashes, got %v", err)
+	}
+
+	current := mustSplit(t, "event", "abc", 100, Options{ContentType: ContentTypeEvent})[0]
+	encoded, err := json.Marshal(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := Decode(encoded); err != nil || !reflect.DeepEqual(decoded, current) {
+		t.Errorf("Expected %+v, got %+v %v", current, decoded, err)
+	}
+
+	if _, err := Decode([]byte(`{"version":3,"uuid":"abc"}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion for a newer version, got %v", err)
+	}
+	if _, err := Decode([]byte("not a chunk")); err == nil {
+		t.Error("Expected an error for a record that isn't a chunk, but got <nil>")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	valid := mustSplit(t, "event", "abc", 100, Options{})[0]
+	tampered := valid
+	tampered.Data = "evil!"
+	badBase64 := mustSplit(t, "event", "abc", 100, Options{Compression: CompressionGzip})[0]
+	badBase64.Data = "%%%"
+	unknownEncoding := valid
+	unknownEncoding.Encoding = "rot13"
+
+	var verifyTests = []struct {
+		name    string
+		chunk   Chunk
+		corrupt bool
+	}{
+		{"no uuid", Chunk{NumChunks: 1}, false},
+		{"no chunks", Chunk{UUID: "abc"}, false},
+		{"past the end", Chunk{UUID: "abc", ChunkNumber: 1, NumChunks: 1}, false},
+		{"negative", Chunk{UUID: "abc", ChunkNumber: -1, NumChunks: 1}, false},
+		{"tampered", tampered, true},
+		{"bad base64", badBase64, true},
+		{"unknown encoding", unknownEncoding, false},
+	}
+	for _, tt := range verifyTests {
+		err := tt.chunk.Verify()
+		if err == nil || errors.Is(err, ErrCorrupt) != tt.corrupt {
+			t.Errorf("%s: expected an error (corrupt=%v), got %v", tt.name, tt.corrupt, err)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	chunks := mustSplit(t, "apple", "abc", 2, Options{})
+	if _, err := Join(nil, nil); err == nil {
+		t.Error("Expected an error joining no chunks, but got <nil>")
+	}
+	if _, err := Join(chunks[:2], nil); err == nil {
+		t.Error("Expected an error for a missing chunk, but got <nil>")
+	}
+	if _, err := Join([]Chunk{chunks[1], chunks[0], chunks[2]}, nil); err == nil {
+		t.Error("Expected an error for chunks out of order, but got <nil>")
+	}
+	other := mustSplit(t, "apple", "def", 2, Options{})
+	if _, err := Join([]Chunk{chunks[0], other[1], chunks[2]}, nil); err == nil {
+		t.Error("Expected an error for a chunk of another event, but got <nil>")
+	}
+
+	// each chunk is fine on its own, but they're from different versions of the event
+	changed := mustSplit(t, "appla", "abc", 2, Options{})
+	if _, err := Join([]Chunk{chunks[0], chunks[1], changed[2]}, nil); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for an event that doesn't match its hash, got %v", err)
+	}
+
+	legacy := []Chunk{{Version: 1, NumChunks: 2, UUID: "abc", Data: "app"}, {Version: 1, ChunkNumber: 1, NumChunks: 2, UUID: "abc", Data: "le"}}
+	if joined, err := Join(legacy, nil); err != nil || string(joined) != "apple" {
+		t.Errorf("Expected version 1 chunks to join without hashes, got %q %v", joined, err)
+	}
+}
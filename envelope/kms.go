@@ -0,0 +1,62 @@
+package envelope
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// Unwrapped keys kept by KMSKeys, most events of a batch share their key
+const maxCachedKeys = 1000
+
+// KMSKeys gets data keys from AWS KMS, wrapped by a KMS key
+type KMSKeys struct {
+	client kmsiface.KMSAPI
+	// ID, ARN or alias of the KMS key, checked when unwrapping keys
+	keyID string
+
+	mu        sync.Mutex
+	unwrapped map[string][]byte
+}
+
+// NewKMSKeys makes data keys with the KMS key keyID. Data keys can be
+// unwrapped without it, by whichever KMS key wrapped them.
+func NewKMSKeys(client kmsiface.KMSAPI, keyID string) *KMSKeys {
+	return &KMSKeys{client: client, keyID: keyID, unwrapped: map[string][]byte{}}
+}
+
+// DataKey calls kms:GenerateDataKey
+func (k *KMSKeys) DataKey() ([]byte, []byte, error) {
+	output, err := k.client.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(k.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return output.Plaintext, output.CiphertextBlob, nil
+}
+
+// Unwrap calls kms:Decrypt, once per data key
+func (k *KMSKeys) Unwrap(wrapped []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.unwrapped[string(wrapped)]; ok {
+		return key, nil
+	}
+	input := &kms.DecryptInput{CiphertextBlob: wrapped}
+	if k.keyID != "" {
+		input.KeyId = aws.String(k.keyID)
+	}
+	output, err := k.client.Decrypt(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(k.unwrapped) >= maxCachedKeys {
+		k.unwrapped = map[string][]byte{}
+	}
+	k.unwrapped[string(wrapped)] = output.Plaintext
+	return output.Plaintext, nil
+}
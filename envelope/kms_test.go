@@ -0,0 +1,71 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// fakeKMS wraps data keys with a static key, like a KMS key would
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	master    *StaticKeys
+	generated int
+	decrypted int
+}
+
+func (f *fakeKMS) GenerateDataKey(inp *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	if aws.StringValue(inp.KeyId) != "alias/replay-zero" || aws.StringValue(inp.KeySpec) != kms.DataKeySpecAes256 {
+		return nil, errors.New("NotFoundException")
+	}
+	f.generated++
+	key, wrapped, err := f.master.DataKey()
+	return &kms.GenerateDataKeyOutput{Plaintext: key, CiphertextBlob: wrapped}, err
+}
+
+func (f *fakeKMS) Decrypt(inp *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if inp.KeyId != nil && aws.StringValue(inp.KeyId) != "alias/replay-zero" {
+		return nil, errors.New("IncorrectKeyException")
+	}
+	f.decrypted++
+	key, err := f.master.Unwrap(inp.CiphertextBlob)
+	return &kms.DecryptOutput{Plaintext: key}, err
+}
+
+func TestKMSKeys(t *testing.T) {
+	client := &fakeKMS{master: newTestKeys(t)}
+	keys := NewKMSKeys(client, "alias/replay-zero")
+	dataKeys := NewDataKeys(keys, 10, time.Minute)
+
+	events := [][]Chunk{}
+	for _, event := range []string{"first", "second", "third"} {
+		events = append(events, mustSplit(t, event, event, 100, Options{Keys: dataKeys}))
+	}
+	for i, event := range []string{"first", "second", "third"} {
+		if joined, err := Join(events[i], keys); err != nil || string(joined) != event {
+			t.Errorf("Expected %q back, got %q %v", event, joined, err)
+		}
+	}
+	if client.generated != 1 || client.decrypted != 1 {
+		t.Errorf("Expected a single data key for the batch, got %d generated and %d decrypted", client.generated, client.decrypted)
+	}
+
+	if joined, err := Join(events[0], NewKMSKeys(client, "")); err != nil || string(joined) != "first" {
+		t.Errorf("Expected to decrypt without the key ID, got %q %v", joined, err)
+	}
+	wrongKey := NewKMSKeys(client, "alias/missing")
+	if _, _, err := wrongKey.DataKey(); err == nil {
+		t.Error("Expected an error for a missing KMS key, but got <nil>")
+	}
+	if _, err := Join(events[0], wrongKey); err == nil {
+		t.Error("Expected an error decrypting with the wrong KMS key, but got <nil>")
+	}
+	if _, err := keys.Unwrap(bytes.Repeat([]byte{1}, 60)); err == nil {
+		t.Error("Expected an error for a key KMS can't decrypt, but got <nil>")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kinds of fault the proxy can inject
+const (
+	faultLatency  = "latency"  // forward after a delay
+	faultStatus   = "status"   // answer with an error status instead of forwarding
+	faultReset    = "reset"    // reset the client connection instead of forwarding
+	faultTruncate = "truncate" // forward, but cut the response body short
+	faultTrickle  = "trickle"  // forward, but send the response body a few bytes at a time
+)
+
+// Fault describes a fault injected by the proxy (--faults) into a recorded exchange
+type Fault struct {
+	Rule   string `json:"rule,omitempty"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// faultRule matches requests and describes the fault to inject into them
+type faultRule struct {
+	Name string `yaml:"name"`
+	// Request matching, every field is optional
+	Method string `yaml:"method"`
+	// Glob (ex. /api/orders/*) matched against the request path
+	Path string `yaml:"path"`
+	// Header values to match, where "*" matches any value as long as the header is present
+	Headers map[string]string `yaml:"headers"`
+	// Share of matching requests to inject the fault into (default 1, every request, 0 turns the rule off)
+	Probability *float64 `yaml:"probability"`
+
+	Fault string `yaml:"fault"`
+	// Delay before forwarding, for every kind of fault
+	Latency time.Duration `yaml:"latency"`
+	// Status and body of the response (status faults)
+	Status int    `yaml:"status"`
+	Body   string `yaml:"body"`
+	// Bytes of the body sent before the connection is dropped (truncate faults, default half)
+	TruncateAt *int `yaml:"truncate_at"`
+	// Bytes sent at a time, and how long to wait in between (trickle faults, default 1 byte every 100ms)
+	ChunkSize int           `yaml:"chunk_size"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+// faultInjector picks the fault (if any) to inject into each proxied request
+type faultInjector struct {
+	rules []faultRule
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// Set when running with --faults, nil otherwise
+var proxyFaults *faultInjector
+
+func loadFaultRules(filePath string) (*faultInjector, error) {
+	dat, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	config := struct {
+		Rules []faultRule `yaml:"rules"`
+	}{}
+	if err := yaml.Unmarshal(dat, &config); err != nil {
+		return nil, fmt.Errorf("Could not parse fault rules %s: %w", filePath, err)
+	}
+	return newFaultInjector(config.Rules)
+}
+
+func newFaultInjector(rules []faultRule) (*faultInjector, error) {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("Fault rule %d: %w", i+1, err)
+		}
+	}
+	return &faultInjector{rules: rules, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+}
+
+func (r *faultRule) validate() error {
+	if _, err := path.Match(r.Path, "/"); err != nil {
+		return fmt.Errorf("invalid path pattern %q: %w", r.Path, err)
+	}
+	if r.Probability != nil && (*r.Probability < 0 || *r.Probability > 1) {
+		return fmt.Errorf("probability must be between 0 and 1, got %v", *r.Probability)
+	}
+	switch r.Fault {
+	case faultLatency:
+		if r.Latency <= 0 {
+			return fmt.Errorf("latency faults need a latency, ex. latency: 2s")
+		}
+	case faultStatus:
+		if r.Status < 100 || r.Status > 999 {
+			return fmt.Errorf("status faults need a status between 100 and 999, got %d", r.Status)
+		}
+	case faultTruncate:
+		if r.TruncateAt != nil && *r.TruncateAt < 0 {
+			return fmt.Errorf("truncate_at can't be negative")
+		}
+	case faultTrickle:
+		if r.ChunkSize < 0 || r.Interval < 0 {
+			return fmt.Errorf("chunk_size and interval can't be negative")
+		}
+	case faultReset:
+	default:
+		return fmt.Errorf("unknown fault %q, expected one of [latency, status, reset, truncate, trickle]", r.Fault)
+	}
+	return nil
+}
+
+// match returns the first rule matching a request, or nil for no fault
+func (f *faultInjector) match(r *http.Request) *faultRule {
+	for i := range f.rules {
+		rule := &f.rules[i]
+		if rule.matches(r) && f.roll(rule.Probability) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (f *faultInjector) roll(probability *float64) bool {
+	if probability == nil || *probability == 1 {
+		return true
+	}
+	if *probability == 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64() < *probability
+}
+
+func (r *faultRule) matches(request *http.Request) bool {
+	if r.Method != "" && !strings.EqualFold(r.Method, request.Method) {
+		return false
+	}
+	if r.Path != "" {
+		// validated when loading the rules
+		if ok, _ := path.Match(r.Path, request.URL.Path); !ok {
+			return false
+		}
+	}
+	for name, value := range r.Headers {
+		actual, ok := request.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "*" && strings.Join(actual, ",") != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// aborts reports whether the request is answered without forwarding it
+func (r *faultRule) aborts() bool {
+	return r.Fault == faultStatus || r.Fault == faultReset
+}
+
+func (r *faultRule) delay() {
+	if r.Latency > 0 {
+		time.Sleep(r.Latency)
+	}
+}
+
+// response stands in for the upstream response when the request isn't forwarded
+func (r *faultRule) response() (*http.Response, []byte) {
+	if r.Fault == faultReset {
+		// nothing ever reaches the client, which is recorded as status 0
+		return &http.Response{Header: http.Header{}}, nil
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	return &http.Response{StatusCode: r.Status, Header: header}, []byte(r.Body)
+}
+
+// write sends the (possibly faulty) response to the client and returns the
+// body the client actually got
+func (r *faultRule) write(w http.ResponseWriter, response *http.Response, body []byte) []byte {
+	switch r.Fault {
+	case faultReset:
+		if err := resetConnection(w); err != nil {
+			log.Printf("[ERROR] Could not reset the client connection: %v\n", err)
+		}
+		return nil
+	case faultTruncate:
+		keep := len(body) / 2
+		if r.TruncateAt != nil && *r.TruncateAt < len(body) {
+			keep = *r.TruncateAt
+		}
+		copyResponseHeaders(w, response)
+		// announce the full length, so the client can tell the body was cut short
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(response.StatusCode)
+		writeBody(w, body[:keep])
+		return body[:keep]
+	case faultTrickle:
+		chunkSize, interval := r.ChunkSize, r.Interval
+		if chunkSize == 0 {
+			chunkSize = 1
+		}
+		if interval == 0 {
+			interval = 100 * time.Millisecond
+		}
+		copyResponseHeaders(w, response)
+		w.WriteHeader(response.StatusCode)
+		flusher, _ := w.(http.Flusher)
+		for start := 0; start < len(body); start += chunkSize {
+			if start > 0 {
+				time.Sleep(interval)
+			}
+			if !writeBody(w, body[start:min(start+chunkSize, len(body))]) {
+				break
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return body
+	}
+	copyResponseHeaders(w, response)
+	w.WriteHeader(response.StatusCode)
+	writeBody(w, body)
+	return body
+}
+
+// describe is what gets recorded on the HTTPEvent
+func (r *faultRule) describe() *Fault {
+	fault := &Fault{Rule: r.Name, Kind: r.Fault}
+	details := []string{}
+	switch r.Fault {
+	case faultStatus:
+		details = append(details, fmt.Sprintf("status %d", r.Status))
+	case faultTruncate:
+		if r.TruncateAt != nil {
+			details = append(details, fmt.Sprintf("truncated at %d bytes", *r.TruncateAt))
+		} else {
+			details = append(details, "truncated at half the body")
+		}
+	case faultTrickle:
+		chunkSize, interval := r.ChunkSize, r.Interval
+		if chunkSize == 0 {
+			chunkSize = 1
+		}
+		if interval == 0 {
+			interval = 100 * time.Millisecond
+		}
+		details = append(details, fmt.Sprintf("%d bytes every %s", chunkSize, interval))
+	}
+	if r.Latency > 0 {
+		details = append(details, fmt.Sprintf("delayed %s", r.Latency))
+	}
+	fault.Detail = strings.Join(details, ", ")
+	return fault
+}
+
+func copyResponseHeaders(w http.ResponseWriter, response *http.Response) {
+	for k, v := range response.Header {
+		w.Header().Set(k, strings.Join(v, ","))
+	}
+}
+
+func writeBody(w http.ResponseWriter, body []byte) bool {
+	if _, err := w.Write(body); err != nil {
+		log.Printf("[ERROR] Could not write response body: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// resetConnection drops the client connection with a TCP RST rather than a clean close
+func resetConnection(w http.ResponseWriter) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("connection can't be hijacked")
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		// discard unsent data and send RST on close
+		_ = tcp.SetLinger(0)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects every event passed to it, from any goroutine
+type syncCapturingHandler struct {
+	mu     sync.Mutex
+	events []HTTPEvent
+}
+
+func (h *syncCapturingHandler) handleEvent(e HTTPEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+}
+func (h *syncCapturingHandler) flushBuffer() {}
+
+// last waits for the proxy to finish handling a request, which
+// can be after the client got the response, and returns its event
+func (h *syncCapturingHandler) last() HTTPEvent {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		if len(h.events) > 0 {
+			defer h.mu.Unlock()
+			return h.events[len(h.events)-1]
+		}
+		h.mu.Unlock()
+	}
+	return HTTPEvent{}
+}
+
+// Starts the proxy in front of an upstream serving body, and returns a client that goes through the proxy
+func newFaultyProxy(t *testing.T, rules []faultRule, body string) (*http.Client, string, *syncCapturingHandler, *int, func()) {
+	injector, err := newFaultInjector(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyFaults = injector
+	upstreamCalls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		_, _ = w.Write([]byte(body))
+	}))
+	h := &syncCapturingHandler{}
+	proxy := httptest.NewServer(http.HandlerFunc(createServerHandler(h)))
+	proxyURL, _ := url.Parse(proxy.URL)
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	return c, upstream.URL, h, &upstreamCalls, func() {
+		proxyFaults = nil
+		proxy.Close()
+		upstream.Close()
+	}
+}
+
+func TestLoadFaultRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rulesFile := filepath.Join(dir, "faults.yaml")
+	rules := `rules:
+  - name: slow orders
+    path: /api/orders/*
+    fault: latency
+    latency: 1500ms
+  - method: post
+    headers: {X-Chaos: "*"}
+    fault: status
+    status: 503
+    body: try again later
+    probability: 0.25
+  - fault: truncate
+    truncate_at: 0
+`
+	if err := ioutil.WriteFile(rulesFile, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := loadFaultRules(rulesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero, quarter := 0, 0.25
+	expected := []faultRule{
+		{Name: "slow orders", Path: "/api/orders/*", Fault: faultLatency, Latency: 1500 * time.Millisecond},
+		{Method: "post", Headers: map[string]string{"X-Chaos": "*"}, Fault: faultStatus, Status: 503, Body: "try again later", Probability: &quarter},
+		{Fault: faultTruncate, TruncateAt: &zero},
+	}
+	if !reflect.DeepEqual(f.rules, expected) {
+		t.Errorf("Expected:\n%+v\ngot:\n%+v", expected, f.rules)
+	}
+
+	if _, err := loadFaultRules(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("Expected an error for a missing file, but got <nil>")
+	}
+	if err := ioutil.WriteFile(rulesFile, []byte("rules: {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFaultRules(rulesFile); err == nil {
+		t.Error("Expected an error for invalid YAML, but got <nil>")
+	}
+}
+
+func TestFaultRuleValidation(t *testing.T) {
+	negative, tooLikely := -1, 1.5
+	var invalidRules = []faultRule{
+		{Fault: "explode"},
+		{Fault: faultLatency},
+		{Fault: faultStatus, Status: 42},
+		{Fault: faultTruncate, TruncateAt: &negative},
+		{Fault: faultTrickle, ChunkSize: -1},
+		{Fault: faultReset, Path: "/["},
+		{Fault: faultReset, Probability: &tooLikely},
+	}
+	for _, rule := range invalidRules {
+		if _, err := newFaultInjector([]faultRule{rule}); err == nil {
+			t.Errorf("Expected an error for %+v, but got <nil>", rule)
+		}
+	}
+}
+
+func TestFaultRuleMatching(t *testing.T) {
+	f, err := newFaultInjector([]faultRule{
+		{Name: "header", Headers: map[string]string{"x-chaos": "on"}, Fault: faultReset},
+		{Name: "path", Method: "GET", Path: "/api/*/items", Fault: faultReset},
+		{Name: "any header value", Headers: map[string]string{"X-Any": "*"}, Fault: faultReset},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, target string, headers ...string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		return r
+	}
+	var matchTests = []struct {
+		request *http.Request
+		rule    string
+	}{
+		{request("POST", "/anything", "X-Chaos", "on"), "header"},
+		{request("POST", "/anything", "X-Chaos", "off"), ""},
+		{request("GET", "/api/v1/items"), "path"},
+		{request("get", "/api/v1/items"), "path"},
+		{request("POST", "/api/v1/items"), ""},
+		{request("GET", "/api/v1/items/1"), ""},
+		{request("PUT", "/", "X-Any", ""), "any header value"},
+		{request("PUT", "/"), ""},
+	}
+	for _, tt := range matchTests {
+		name := ""
+		if rule := f.match(tt.request); rule != nil {
+			name = rule.Name
+		}
+		if name != tt.rule {
+			t.Errorf("%s %s %v: expected rule %q, got %q", tt.request.Method, tt.request.URL.Path, tt.request.Header, tt.rule, name)
+		}
+	}
+
+	var probabilityTests = []struct {
+		probability *float64
+		min, max    int
+	}{
+		{nil, 1000, 1000},
+		{func(p float64) *float64 { return &p }(1), 1000, 1000},
+		{func(p float64) *float64 { return &p }(0.3), 200, 400},
+		{func(p float64) *float64 { return &p }(0), 0, 0},
+	}
+	for _, tt := range probabilityTests {
+		f, _ = newFaultInjector([]faultRule{{Fault: faultReset, Probability: tt.probability}})
+		f.rand = rand.New(rand.NewSource(1))
+		matched := 0
+		for i := 0; i < 1000; i++ {
+			if f.match(request("GET", "/")) != nil {
+				matched++
+			}
+		}
+		if matched < tt.min || matched > tt.max {
+			t.Errorf("Expected %d to %d of 1000 requests to match, got %d", tt.min, tt.max, matched)
+		}
+	}
+}
+
+func TestFaultDescribe(t *testing.T) {
+	ten := 10
+	var describeTests = []struct {
+		rule   faultRule
+		detail string
+	}{
+		{faultRule{Fault: faultLatency, Latency: time.Second}, "delayed 1s"},
+		{faultRule{Fault: faultStatus, Status: 503, Latency: time.Second}, "status 503, delayed 1s"},
+		{faultRule{Fault: faultReset}, ""},
+		{faultRule{Fault: faultTruncate}, "truncated at half the body"},
+		{faultRule{Fault: faultTruncate, TruncateAt: &ten}, "truncated at 10 bytes"},
+		{faultRule{Fault: faultTrickle}, "1 bytes every 100ms"},
+		{faultRule{Fault: faultTrickle, ChunkSize: 5, Interval: time.Second}, "5 bytes every 1s"},
+	}
+	for _, tt := range describeTests {
+		tt.rule.Name = "rule"
+		expected := &Fault{Rule: "rule", Kind: tt.rule.Fault, Detail: tt.detail}
+		if fault := tt.rule.describe(); !reflect.DeepEqual(fault, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, fault)
+		}
+	}
+}
+
+func TestProxyFaults(t *testing.T) {
+	t.Run("status", func(t *testing.T) {
+		c, upstream, h, calls, cleanup := newFaultyProxy(t, []faultRule{{Name: "down", Fault: faultStatus, Status: 503, Body: "try again"}}, "ok")
+		defer cleanup()
+		response, err := c.Get(upstream + "/api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != 503 || string(body) != "try again" || *calls != 0 {
+			t.Errorf("Expected an injected 503 without calling upstream, got %d %q (%d calls)", response.StatusCode, body, *calls)
+		}
+		event := h.last()
+		if event.ResponseCode != "503" || event.RespBody != "try again" || event.Fault == nil || event.Fault.Rule != "down" {
+			t.Errorf("Expected the injected response to be recorded, got %+v", event)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		c, upstream, h, calls, cleanup := newFaultyProxy(t, []faultRule{{Fault: faultReset}}, "ok")
+		defer cleanup()
+		if _, err := c.Get(upstream + "/api"); err == nil {
+			t.Error("Expected the connection to be reset, but got <nil>")
+		}
+		event := h.last()
+		if *calls != 0 || event.ResponseCode != "0" || event.Fault == nil || event.Fault.Kind != faultReset {
+			t.Errorf("Expected a reset to be recorded without calling upstream, got %+v (%d calls)", event, *calls)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		c, upstream, h, calls, cleanup := newFaultyProxy(t, []faultRule{{Fault: faultTruncate}}, "0123456789")
+		defer cleanup()
+		response, err := c.Get(upstream + "/api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err == nil || string(body) != "01234" || *calls != 1 {
+			t.Errorf("Expected half the body and an error, got %q %v (%d calls)", body, err, *calls)
+		}
+		if event := h.last(); event.RespBody != "01234" || event.Fault == nil {
+			t.Errorf("Expected the truncated body to be recorded, got %+v", event)
+		}
+	})
+
+	t.Run("trickle and latency", func(t *testing.T) {
+		rules := []faultRule{{Fault: faultTrickle, ChunkSize: 2, Interval: 10 * time.Millisecond, Latency: 20 * time.Millisecond}}
+		c, upstream, h, _, cleanup := newFaultyProxy(t, rules, "0123456789")
+		defer cleanup()
+		start := time.Now()
+		response, err := c.Get(upstream + "/api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || string(body) != "0123456789" {
+			t.Errorf("Expected the whole body, got %q %v", body, err)
+		}
+		if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+			t.Errorf("Expected at least 20ms latency + 4 x 10ms between chunks, took %s", elapsed)
+		}
+		if event := h.last(); event.RespBody != "0123456789" || event.Fault == nil || event.Fault.Kind != faultTrickle {
+			t.Errorf("Expected the whole body to be recorded, got %+v", event)
+		}
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		c, upstream, h, _, cleanup := newFaultyProxy(t, []faultRule{{Method: "DELETE", Fault: faultReset}}, "ok")
+		defer cleanup()
+		response, err := c.Get(upstream + "/api?x=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if event := h.last(); event.Fault != nil || event.ResponseCode != "200" {
+			t.Errorf("Expected a normal event, got %+v", event)
+		}
+	})
+}
+
+func TestResetConnectionNotHijackable(t *testing.T) {
+	if err := resetConnection(httptest.NewRecorder()); err == nil {
+		t.Error("Expected an error for a connection that can't be hijacked, but got <nil>")
+	}
+	w := httptest.NewRecorder()
+	if body := (&faultRule{Fault: faultReset}).write(w, &http.Response{}, []byte("x")); body != nil {
+		t.Errorf("Expected nothing to reach the client, got %q", body)
+	}
+	if strings.TrimSpace(w.Body.String()) != "" {
+		t.Errorf("Expected no response, got %q", w.Body.String())
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/Masterminds/goutils v1.1.0 // indirect
 	github.com/Masterminds/semver v1.5.0 // indirect
 	github.com/Masterminds/sprig v2.22.0+incompatible
+	github.com/Shopify/sarama v1.27.2
 	github.com/aws/aws-sdk-go v1.29.25
 	github.com/go-test/deep v1.0.5
 	github.com/gobuffalo/here v0.6.2 // indirect
@@ -13,10 +14,13 @@ require (
 	github.com/huandu/xstrings v1.3.2 // indirect
 	github.com/imdario/mergo v0.3.11 // indirect
 	github.com/jmespath/go-jmespath v0.3.0 // indirect
+	github.com/klauspost/compress v1.11.4
 	github.com/kylelemons/godebug v1.1.0
 	github.com/markbates/pkger v0.17.1
 	github.com/mitchellh/copystructure v1.0.0 // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
 	github.com/spf13/pflag v1.0.5
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
 	github.com/ztrue/shutdown v0.1.1
+	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
 )
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/intuit/replay-zero/envelope"
+	"github.com/xdg/scram"
+	"gopkg.in/yaml.v3"
+)
+
+// Which replicas have to store a message before it counts as sent
+const (
+	kafkaAcksAll    = "all"    // every in-sync replica
+	kafkaAcksLeader = "leader" // only the partition leader
+	kafkaAcksNone   = "none"   // nobody, fire and forget
+)
+
+// How the Kafka sink authenticates with SASL
+const (
+	saslPlain       = "PLAIN"
+	saslSCRAMSHA256 = "SCRAM-SHA-256"
+	saslSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// scram only has SHA-1 and SHA-256 built in
+var scramSHA512 scram.HashGeneratorFcn = sha512.New
+
+// Room left in each message for Kafka's own record fields (sarama counts up to 36 bytes)
+const kafkaRecordOverhead = 64
+
+// Smallest max_message_bytes leaving room for data next to the envelope and the key
+const minKafkaMessageBytes = 8192
+
+// How long flushing waits for the producer to deliver the messages it holds
+const kafkaCloseTimeout = 30 * time.Second
+
+// kafkaConfig configures a kafka sink (see sinks.go)
+type kafkaConfig struct {
+	Brokers []string `yaml:"brokers"`
+	Topic   string   `yaml:"topic"`
+	// Kafka version of the brokers, ex. 2.1.0
+	Version  string `yaml:"version"`
+	ClientID string `yaml:"client_id"`
+	// The message key of each chunk, same strategies as --partition-key
+	PartitionKey   string `yaml:"partition_key"`
+	Compression    string `yaml:"compression"`
+	EncryptKMSKey  string `yaml:"encrypt_kms_key"`
+	EncryptKeyFile string `yaml:"encrypt_key_file"`
+	// Role to assume for KMS, if any
+	KMSRoleArn string `yaml:"kms_role_arn"`
+	Acks       string `yaml:"acks"`
+	// Retries can't duplicate or reorder messages, needs acks: all and Kafka 0.11+
+	Idempotent bool `yaml:"idempotent"`
+	Retries    int  `yaml:"retries"`
+	// Messages are batched until either is reached
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	FlushMessages int           `yaml:"flush_messages"`
+	// Largest message the topic takes, events are split into chunks to fit
+	MaxMessageBytes int       `yaml:"max_message_bytes"`
+	TLS             kafkaTLS  `yaml:"tls"`
+	SASL            kafkaSASL `yaml:"sasl"`
+}
+
+type kafkaTLS struct {
+	Enabled bool `yaml:"enabled"`
+	// PEM files, all optional
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type kafkaSASL struct {
+	// One of [PLAIN, SCRAM-SHA-256, SCRAM-SHA-512], empty to not use SASL
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	// Environment variable to read the password from, to keep it out of the sinks file
+	PasswordEnv string `yaml:"password_env"`
+}
+
+// kafkaDefaults are the defaults of a kafka sink
+var kafkaDefaults = kafkaConfig{
+	Version:         "2.1.0",
+	ClientID:        "replay-zero",
+	PartitionKey:    partitionUUID,
+	Compression:     "none",
+	Acks:            kafkaAcksAll,
+	Idempotent:      true,
+	Retries:         5,
+	FlushInterval:   time.Second,
+	FlushMessages:   500,
+	MaxMessageBytes: 1000000,
+}
+
+// kafkaProducer connects to the brokers. Tests can replace it.
+var kafkaProducer = func(brokers []string, config *sarama.Config) (sarama.AsyncProducer, error) {
+	return sarama.NewAsyncProducer(brokers, config)
+}
+
+func init() {
+	registerSink("kafka", newKafkaSink)
+}
+
+// newKafkaSink sends events to a Kafka topic, in the same envelope as Kinesis records
+func newKafkaSink(options *yaml.Node) (eventHandler, error) {
+	config := kafkaDefaults
+	if err := decodeSinkOptions(options, &config); err != nil {
+		return nil, err
+	}
+	return newKafkaHandler(config)
+}
+
+// saramaConfig validates config and turns it into the producer's settings
+func (c kafkaConfig) saramaConfig() (*sarama.Config, error) {
+	version, err := sarama.ParseKafkaVersion(c.Version)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxMessageBytes < minKafkaMessageBytes {
+		return nil, fmt.Errorf("max_message_bytes must be at least %d, got %d", minKafkaMessageBytes, c.MaxMessageBytes)
+	}
+	config := sarama.NewConfig()
+	config.Version = version
+	config.ClientID = c.ClientID
+	config.Producer.Return.Successes = true
+	config.Producer.Retry.Max = c.Retries
+	config.Producer.Flush.Frequency = c.FlushInterval
+	config.Producer.Flush.Messages = c.FlushMessages
+	config.Producer.MaxMessageBytes = c.MaxMessageBytes
+	switch c.Acks {
+	case kafkaAcksAll:
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	case kafkaAcksLeader:
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case kafkaAcksNone:
+		config.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, fmt.Errorf("Unknown acks %q, expected one of [all, leader, none]", c.Acks)
+	}
+	if c.Idempotent {
+		if c.Acks != kafkaAcksAll {
+			return nil, fmt.Errorf("An idempotent producer needs acks: all, got %s", c.Acks)
+		}
+		config.Producer.Idempotent = true
+		// more requests in flight could reorder retried messages
+		config.Net.MaxOpenRequests = 1
+	}
+	if c.TLS.Enabled {
+		config.Net.TLS.Enable = true
+		if config.Net.TLS.Config, err = c.TLS.config(); err != nil {
+			return nil, err
+		}
+	}
+	if c.SASL.Mechanism != "" {
+		if err := c.SASL.configure(config); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid Kafka settings: %w", err)
+	}
+	return config, nil
+}
+
+func (t kafkaTLS) config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func (s kafkaSASL) configure(config *sarama.Config) error {
+	password := s.Password
+	if s.PasswordEnv != "" {
+		password = os.Getenv(s.PasswordEnv)
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.User = s.Username
+	config.Net.SASL.Password = password
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(s.Mechanism)
+	switch s.Mechanism {
+	case saslPlain:
+	case saslSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: scram.SHA256} }
+	case saslSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: scramSHA512} }
+	default:
+		return fmt.Errorf("Unknown SASL mechanism %q, expected one of [PLAIN, SCRAM-SHA-256, SCRAM-SHA-512]", s.Mechanism)
+	}
+	return nil
+}
+
+// scramClient runs a SCRAM conversation for sarama
+type scramClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
+
+// kafkaHandler sends recorded events to a Kafka topic, split into envelope chunks
+type kafkaHandler struct {
+	topic       string
+	producer    sarama.AsyncProducer
+	partition   partitionStrategy
+	compression string
+	keys        *envelope.DataKeys
+	// bytes each message has for a chunk and its key
+	recordSize int
+
+	// guards against sending to the producer once it's closed
+	mu     sync.RWMutex
+	closed bool
+	// closed once the producer reported on every message
+	done chan struct{}
+
+	sent   int64
+	failed int64
+}
+
+// newKafkaHandler validates config, then connects to the brokers
+func newKafkaHandler(config kafkaConfig) (*kafkaHandler, error) {
+	if len(config.Brokers) == 0 || config.Topic == "" {
+		return nil, fmt.Errorf("Kafka brokers and topic required")
+	}
+	partition, err := parsePartitionStrategy(config.PartitionKey)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := parseCompression(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newKeyProvider(config.EncryptKMSKey, config.EncryptKeyFile, config.KMSRoleArn)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		if partition, err = partition.hidden(keys); err != nil {
+			return nil, err
+		}
+	}
+	saramaConfig, err := config.saramaConfig()
+	if err != nil {
+		return nil, err
+	}
+	producer, err := kafkaProducer(config.Brokers, saramaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to Kafka brokers %v: %w", config.Brokers, err)
+	}
+	h := &kafkaHandler{
+		topic:       config.Topic,
+		producer:    producer,
+		partition:   partition,
+		compression: compression,
+		recordSize:  config.MaxMessageBytes - kafkaRecordOverhead,
+		done:        make(chan struct{}),
+	}
+	if keys != nil {
+		log.Println("Encrypting events before sending them")
+		h.keys = envelope.NewDataKeys(keys, dataKeyEvents, dataKeyLifetime)
+	}
+	go h.readResults()
+	return h, nil
+}
+
+func (h *kafkaHandler) handleEvent(event HTTPEvent) {
+	go telemetry.logUsage(telemetryUsageOnline)
+	event.SchemaVersion = eventSchemaVersion
+	messages, err := splitEventRecords(httpEventToString(event), h.recordSize, envelope.Options{Compression: h.compression, Keys: h.keys})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		logWarn(fmt.Sprintf("Kafka producer is closed, dropped event %s %s", event.HTTPMethod, event.Endpoint))
+		return
+	}
+	for _, m := range messages {
+		key := h.partition.key(event, m.UUID)
+		// the message key is all consumers need, and it'd be in the clear next to an encrypted event
+		if h.keys == nil {
+			m.PartitionKey = key
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		// blocks while the producer's buffer is full
+		h.producer.Input() <- &sarama.ProducerMessage{
+			Topic:    h.topic,
+			Key:      sarama.StringEncoder(key),
+			Value:    sarama.ByteEncoder(data),
+			Metadata: m.UUID,
+		}
+	}
+}
+
+// readResults counts the messages the producer delivered or gave up on
+func (h *kafkaHandler) readResults() {
+	defer close(h.done)
+	successes, errors := h.producer.Successes(), h.producer.Errors()
+	for successes != nil || errors != nil {
+		select {
+		case _, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			atomic.AddInt64(&h.sent, 1)
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			atomic.AddInt64(&h.failed, 1)
+			log.Printf("[ERROR] Could not send a chunk of event %v to Kafka: %v\n", err.Msg.Metadata, err.Err)
+		}
+	}
+}
+
+// Kafka: sends the messages waiting for a batch, then closes the producer
+func (h *kafkaHandler) flushBuffer() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	h.mu.Unlock()
+
+	h.producer.AsyncClose()
+	select {
+	case <-h.done:
+	case <-time.After(kafkaCloseTimeout):
+		log.Println("[ERROR] Gave up waiting for Kafka to acknowledge the last messages")
+	}
+	log.Printf("Kafka: sent=%d failed=%d messages to %s\n", atomic.LoadInt64(&h.sent), atomic.LoadInt64(&h.failed), h.topic)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/intuit/replay-zero/envelope"
+	"gopkg.in/yaml.v3"
+)
+
+// - - - - - - - - - - - - -
+//        UTILITIES
+// - - - - - - - - - - - - -
+
+func newTestKafkaHandler(t *testing.T, config kafkaConfig) (*kafkaHandler, *mocks.AsyncProducer) {
+	var producer *mocks.AsyncProducer
+	kafkaProducer = func(brokers []string, c *sarama.Config) (sarama.AsyncProducer, error) {
+		producer = mocks.NewAsyncProducer(t, c)
+		return producer, nil
+	}
+	h, err := newKafkaHandler(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, producer
+}
+
+func testKafkaConfig() kafkaConfig {
+	config := kafkaDefaults
+	config.Brokers = []string{"localhost:9092"}
+	config.Topic = "events"
+	return config
+}
+
+// collectChunks checks every message sent to the producer, keeping their chunks
+func collectChunks(t *testing.T, producer *mocks.AsyncProducer, n int, chunks *[]envelope.Chunk) {
+	for i := 0; i < n; i++ {
+		producer.ExpectInputWithCheckerFunctionAndSucceed(func(value []byte) error {
+			chunk, err := envelope.Decode(value)
+			if err != nil {
+				return err
+			}
+			*chunks = append(*chunks, chunk)
+			return chunk.Verify()
+		})
+	}
+}
+
+// - - - - - - - - - - - - -
+//          TESTS
+// - - - - - - - - - - - - -
+
+func TestKafkaHandler(t *testing.T) {
+	defer func(original func([]string, *sarama.Config) (sarama.AsyncProducer, error)) { kafkaProducer = original }(kafkaProducer)
+	config := testKafkaConfig()
+	config.PartitionKey = partitionEndpoint
+	config.MaxMessageBytes = minKafkaMessageBytes
+	h, producer := newTestKafkaHandler(t, config)
+
+	event := generateSampleEvent()
+	event.ReqBody = strings.Repeat("a", minKafkaMessageBytes*3/2)
+	event.SchemaVersion = eventSchemaVersion
+	expected, err := splitEventRecords(httpEventToString(event), minKafkaMessageBytes-kafkaRecordOverhead, envelope.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []envelope.Chunk{}
+	collectChunks(t, producer, len(expected), &chunks)
+	h.handleEvent(event)
+	h.flushBuffer()
+	h.handleEvent(event)
+
+	if len(expected) < 2 || h.sent != int64(len(expected)) || h.failed != 0 || len(chunks) != len(expected) {
+		t.Fatalf("Expected the event to be sent in %d messages, got sent=%d failed=%d", len(expected), h.sent, h.failed)
+	}
+	if chunks[0].PartitionKey != "POST /test/api" || chunks[0].ContentType != envelope.ContentTypeEvent {
+		t.Errorf("Expected chunks keyed by endpoint, got %+v", chunks[0])
+	}
+	joined, err := envelope.Join(chunks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := HTTPEvent{}
+	if err := json.Unmarshal(joined, &received); err != nil || received.ReqBody != event.ReqBody || received.SchemaVersion != eventSchemaVersion {
+		t.Errorf("Expected the event to join back together, got %+v %v", received, err)
+	}
+}
+
+func TestKafkaHandlerEncrypted(t *testing.T) {
+	defer func(original func([]string, *sarama.Config) (sarama.AsyncProducer, error)) { kafkaProducer = original }(kafkaProducer)
+	config := testKafkaConfig()
+	config.Compression = envelope.CompressionGzip
+	config.PartitionKey = "header:User-Agent"
+	keyFile, cleanup := writeKeyFile(t)
+	defer cleanup()
+	config.EncryptKeyFile = keyFile
+	h, producer := newTestKafkaHandler(t, config)
+
+	chunks := []envelope.Chunk{}
+	collectChunks(t, producer, 1, &chunks)
+	h.handleEvent(generateSampleEvent())
+	h.flushBuffer()
+
+	keys, err := envelope.LoadKeyFile(config.EncryptKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].Encryption != envelope.EncryptionAESGCM || chunks[0].Compression != envelope.CompressionGzip {
+		t.Fatalf("Expected a compressed and encrypted chunk, got %+v", chunks)
+	}
+	if chunks[0].PartitionKey != "" || h.partition.secret == "" {
+		t.Errorf("Expected the header value to be hidden from the message, got %+v", chunks[0])
+	}
+	if _, err := envelope.Join(chunks, keys); err != nil {
+		t.Errorf("Expected the event to decrypt, got %v", err)
+	}
+}
+
+func TestKafkaHandlerErrors(t *testing.T) {
+	defer func(original func([]string, *sarama.Config) (sarama.AsyncProducer, error)) { kafkaProducer = original }(kafkaProducer)
+	h, producer := newTestKafkaHandler(t, testKafkaConfig())
+	producer.ExpectInputAndFail(errors.New("broker is down"))
+	producer.ExpectInputAndSucceed()
+	h.handleEvent(generateSampleEvent())
+	h.handleEvent(generateSampleEvent())
+	h.flushBuffer()
+	if h.sent != 1 || h.failed != 1 {
+		t.Errorf("Expected sent=1 failed=1, got sent=%d failed=%d", h.sent, h.failed)
+	}
+}
+
+func TestKafkaSaramaConfig(t *testing.T) {
+	config, err := testKafkaConfig().saramaConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Producer.Idempotent || config.Producer.RequiredAcks != sarama.WaitForAll || config.Net.MaxOpenRequests != 1 || !config.Producer.Return.Successes {
+		t.Errorf("Expected an idempotent producer waiting for all replicas, got %+v", config.Producer)
+	}
+
+	withSASL := testKafkaConfig()
+	withSASL.TLS = kafkaTLS{Enabled: true, InsecureSkipVerify: true}
+	withSASL.SASL = kafkaSASL{Mechanism: saslSCRAMSHA512, Username: "recorder", PasswordEnv: "REPLAY_ZERO_TEST_KAFKA_PASSWORD"}
+	os.Setenv("REPLAY_ZERO_TEST_KAFKA_PASSWORD", "secret")
+	defer os.Unsetenv("REPLAY_ZERO_TEST_KAFKA_PASSWORD")
+	config, err = withSASL.saramaConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Net.TLS.Enable || !config.Net.TLS.Config.InsecureSkipVerify || config.Net.SASL.Password != "secret" || config.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 {
+		t.Errorf("Expected TLS and SCRAM settings, got %+v", config.Net)
+	}
+	if scram := config.Net.SASL.SCRAMClientGeneratorFunc(); scram.Begin("recorder", "secret", "") != nil {
+		t.Error("Expected a SCRAM client to start a conversation")
+	}
+
+	var invalidTests = []struct {
+		name   string
+		change func(*kafkaConfig)
+	}{
+		{"version", func(c *kafkaConfig) { c.Version = "latest" }},
+		{"old version", func(c *kafkaConfig) { c.Version = "0.10.2.0" }},
+		{"acks", func(c *kafkaConfig) { c.Acks = "most" }},
+		{"idempotent acks", func(c *kafkaConfig) { c.Acks = kafkaAcksLeader }},
+		{"message size", func(c *kafkaConfig) { c.MaxMessageBytes = minKafkaMessageBytes - 1 }},
+		{"sasl", func(c *kafkaConfig) { c.SASL.Mechanism = "GSSAPI" }},
+		{"ca file", func(c *kafkaConfig) { c.TLS = kafkaTLS{Enabled: true, CAFile: "missing.pem"} }},
+		{"key pair", func(c *kafkaConfig) { c.TLS = kafkaTLS{Enabled: true, CertFile: "missing.pem"} }},
+	}
+	for _, tt := range invalidTests {
+		config := testKafkaConfig()
+		tt.change(&config)
+		if _, err := config.saramaConfig(); err == nil {
+			t.Errorf("%s: expected an error, but got <nil>", tt.name)
+		}
+	}
+	leader := testKafkaConfig()
+	leader.Acks, leader.Idempotent = kafkaAcksLeader, false
+	if config, err := leader.saramaConfig(); err != nil || config.Producer.RequiredAcks != sarama.WaitForLocal {
+		t.Errorf("Expected a producer waiting for the leader, got %v", err)
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	defer func(original func([]string, *sarama.Config) (sarama.AsyncProducer, error)) { kafkaProducer = original }(kafkaProducer)
+	kafkaProducer = func(brokers []string, config *sarama.Config) (sarama.AsyncProducer, error) {
+		if len(brokers) != 2 || config.ClientID != "recorder" {
+			t.Errorf("Expected 2 brokers and client ID recorder, got %v %s", brokers, config.ClientID)
+		}
+		return mocks.NewAsyncProducer(t, config), nil
+	}
+	sinks := []sinkConfig{{Type: "kafka"}}
+	options := "brokers: [kafka-1:9092, kafka-2:9092]\ntopic: events\nclient_id: recorder\nflush_interval: 50ms\n"
+	if err := yaml.Unmarshal([]byte(options), &sinks[0].Options); err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFanOut(sinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.flushBuffer()
+
+	if _, err := newFanOut([]sinkConfig{{Type: "kafka"}}); err == nil || !strings.Contains(err.Error(), "brokers and topic") {
+		t.Errorf("Expected an error for a kafka sink without brokers, got %v", err)
+	}
+	kafkaProducer = func([]string, *sarama.Config) (sarama.AsyncProducer, error) {
+		return nil, sarama.ErrOutOfBrokers
+	}
+	if _, err := newFanOut(sinks); err == nil || !strings.Contains(err.Error(), "Could not connect") {
+		t.Errorf("Expected an error for unreachable brokers, got %v", err)
+	}
+}
@@ -16,12 +16,12 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/intuit/replay-zero/envelope"
 	uuid "github.com/nu7hatch/gouuid"
 )
 
 const (
 	defaultRegion        = "us-west-2"
-	chunkSize            = 1048576 - 200
 	kinesaliteStreamName = "replay-zero-dev"
 	kinesaliteEndpoint   = "https://localhost:4567"
 )
@@ -117,15 +117,6 @@ func buildKinesaliteClient(streamName string) *kinesisWrapper {
 	}
 }
 
-func chunkData(data string, size int) []string {
-	chunks := []string{}
-	for c := 0; c < len(data); c += size {
-		nextChunk := data[c:min(c+size, len(data))]
-		chunks = append(chunks, nextChunk)
-	}
-	return chunks
-}
-
 func min(i1, i2 int) int {
 	if i1 < i2 {
 		return i1
@@ -133,32 +124,33 @@ func min(i1, i2 int) int {
 	return i2
 }
 
-func buildMessages(line string) []EventChunk {
-	chunks := chunkData(line, chunkSize)
-	numChunks := len(chunks)
-	messages := []EventChunk{}
+func buildMessages(line string, opts envelope.Options) ([]EventChunk, error) {
+	return splitEventRecords(line, maxRecordBytes, opts)
+}
+
+// splitEventRecords splits an event into chunks that each fit in a record of
+// recordSize bytes, along with any partition key
+func splitEventRecords(line string, recordSize int, opts envelope.Options) ([]EventChunk, error) {
+	opts.ContentType = envelope.ContentTypeEvent
+	return envelope.SplitRecords([]byte(line), eventCorrelationID(line), recordSize, partitionKeyReserve, opts)
+}
+
+// eventCorrelationID returns the ID shared by all the chunks of an event
+func eventCorrelationID(line string) string {
 	// Multiple chunks need a sort of "group ID"
 	eventUUID, err := uuid.NewV4()
-	var correlation string
 	if err != nil {
 		msg := fmt.Sprintf("UUID generation failed: %s\nFalling back to SHA1 of input string for chunk correlation", err)
 		logDebug(msg)
-		correlation = fmt.Sprintf("%x", sha256.Sum256([]byte(line)))
-	} else {
-		correlation = eventUUID.String()
-	}
-	for chunkID, chunk := range chunks {
-		nextMessage := EventChunk{
-			ChunkNumber: chunkID,
-			NumChunks:   numChunks,
-			UUID:        correlation,
-			Data:        chunk,
-		}
-		messages = append(messages, nextMessage)
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(line)))
 	}
-	return messages
+	return eventUUID.String()
 }
 
+// sendToStream puts a single record, for telemetry messages (see telemetry.go).
+// --partition-key doesn't apply: the strategies pick keys from recorded events,
+// while telemetry messages go to their own stream, with no order to keep
+// between them, so each gets its own key to spread them over the shards.
 func (c *kinesisWrapper) sendToStream(message interface{}, stream string) error {
 	dataBytes, err := json.Marshal(message)
 	if err != nil {
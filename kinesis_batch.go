@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// PutRecords limits, see https://docs.aws.amazon.com/kinesis/latest/APIReference/API_PutRecords.html
+const (
+	maxBatchRecords = 500
+	maxBatchBytes   = 5 * 1024 * 1024
+	// data + partition key of a single record
+	maxRecordBytes = 1024 * 1024
+	// attempts at putting the records that keep failing before giving up on them
+	maxPutAttempts = 4
+)
+
+// Prefixes records aggregated in the Kinesis Producer Library (KPL) format, see
+// https://github.com/awslabs/amazon-kinesis-producer/blob/master/aggregation-format.md
+var kplMagic = []byte{0xf3, 0x89, 0x9a, 0xc2}
+
+// streamRecord is a single record as produced, before any aggregation
+type streamRecord struct {
+	partitionKey string
+	data         []byte
+}
+
+func (r streamRecord) size() int {
+	return len(r.partitionKey) + len(r.data)
+}
+
+// recordBatcher buffers records and sends them with PutRecords, either
+// when a batch is full or every flush interval
+type recordBatcher struct {
+	client kinesisiface.KinesisAPI
+	stream string
+	logger func(string, ...interface{})
+	// pack records into KPL aggregated records before sending them
+	aggregate bool
+	// wait before the first retry, doubled for every retry after it
+	backoff time.Duration
+	// optional, records how long PutRecords calls take
+	stats *streamStats
+
+	mu           sync.Mutex
+	pending      []streamRecord
+	pendingBytes int
+	// held while sending so a flush waits for the batches already on their way
+	sending sync.Mutex
+}
+
+func newRecordBatcher(wrapper *kinesisWrapper, stream string, flushInterval time.Duration, aggregate bool) *recordBatcher {
+	b := &recordBatcher{
+		client:    wrapper.client,
+		stream:    stream,
+		logger:    wrapper.logger,
+		aggregate: aggregate,
+		backoff:   100 * time.Millisecond,
+	}
+	if flushInterval > 0 {
+		go func() {
+			for range time.Tick(flushInterval) {
+				logErr(b.flush())
+			}
+		}()
+	}
+	return b
+}
+
+// add queues a message for the stream, sending the pending batch first if the message doesn't fit in it
+func (b *recordBatcher) add(message interface{}, partitionKey string) error {
+	dataBytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	record := streamRecord{partitionKey: partitionKey, data: dataBytes}
+	if record.size() > maxRecordBytes {
+		return fmt.Errorf("Record of %d bytes is over the Kinesis limit of %d bytes", record.size(), maxRecordBytes)
+	}
+
+	b.mu.Lock()
+	full := b.pendingBytes+record.size() > maxBatchBytes || (!b.aggregate && len(b.pending) == maxBatchRecords)
+	var batch []streamRecord
+	if full {
+		batch = b.take()
+	}
+	b.pending = append(b.pending, record)
+	b.pendingBytes += record.size()
+	b.mu.Unlock()
+
+	if full {
+		return b.send(batch)
+	}
+	return nil
+}
+
+// flush sends everything pending
+func (b *recordBatcher) flush() error {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	return b.send(batch)
+}
+
+// take empties the pending batch (b.mu must be held)
+func (b *recordBatcher) take() []streamRecord {
+	batch := b.pending
+	b.pending = nil
+	b.pendingBytes = 0
+	return batch
+}
+
+func (b *recordBatcher) send(records []streamRecord) error {
+	b.sending.Lock()
+	defer b.sending.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+	if b.aggregate {
+		records = aggregateRecords(records)
+	}
+	var entries []*kinesis.PutRecordsRequestEntry
+	batchBytes := 0
+	failed := 0
+	var lastErr error
+	sendEntries := func() {
+		if err := b.put(entries); err != nil {
+			failed += len(entries)
+			lastErr = err
+		}
+		entries = nil
+		batchBytes = 0
+	}
+	for _, r := range records {
+		if len(entries) == maxBatchRecords || batchBytes+r.size() > maxBatchBytes {
+			sendEntries()
+		}
+		entries = append(entries, &kinesis.PutRecordsRequestEntry{
+			Data:         r.data,
+			PartitionKey: aws.String(r.partitionKey),
+		})
+		batchBytes += r.size()
+	}
+	sendEntries()
+	if lastErr != nil {
+		return fmt.Errorf("Dropped %d of %d records for stream=%s: %w", failed, len(records), b.stream, lastErr)
+	}
+	return nil
+}
+
+// put sends a single PutRecords request, retrying only the entries that failed
+func (b *recordBatcher) put(entries []*kinesis.PutRecordsRequestEntry) error {
+	total := len(entries)
+	start := time.Now()
+	defer func() { b.stats.recordSend(time.Since(start)) }()
+	for attempt := 1; ; attempt++ {
+		output, err := b.client.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(b.stream),
+			Records:    entries,
+		})
+		if err == nil {
+			var failed []*kinesis.PutRecordsRequestEntry
+			for i, result := range output.Records {
+				if result.ErrorCode != nil {
+					failed = append(failed, entries[i])
+					err = fmt.Errorf("%s: %s", *result.ErrorCode, aws.StringValue(result.ErrorMessage))
+				}
+			}
+			if len(failed) == 0 {
+				b.logger("Successfully put %d records to stream=%s\n", total, b.stream)
+				return nil
+			}
+			b.logger("%d of %d records failed for stream=%s (attempt %d): %v\n", len(failed), len(entries), b.stream, attempt, err)
+			entries = failed
+		}
+		if attempt == maxPutAttempts {
+			return fmt.Errorf("%d records still failing after %d attempts: %w", len(entries), attempt, err)
+		}
+		time.Sleep(b.backoff << uint(attempt-1))
+	}
+}
+
+// - - - - - - - - - - - - -
+//      KPL AGGREGATION
+// - - - - - - - - - - - - -
+
+// aggregateRecords packs records into as few KPL aggregated records as fit
+// under the Kinesis record size limit. An aggregated record goes to the shard
+// of its partition key, so only records sharing a key are packed together,
+// which keeps them in order on their own shard. Records that end up alone are
+// sent as they are, which KPL consumers read like any other record.
+func aggregateRecords(records []streamRecord) []streamRecord {
+	keys := []string{}
+	byKey := map[string][]streamRecord{}
+	for _, r := range records {
+		if _, ok := byKey[r.partitionKey]; !ok {
+			keys = append(keys, r.partitionKey)
+		}
+		byKey[r.partitionKey] = append(byKey[r.partitionKey], r)
+	}
+
+	aggregated := []streamRecord{}
+	var group aggregation
+	closeGroup := func() {
+		if len(group.records) == 1 {
+			aggregated = append(aggregated, group.records[0])
+		} else if len(group.records) > 1 {
+			aggregated = append(aggregated, group.encode())
+		}
+		group = aggregation{}
+	}
+	for _, key := range keys {
+		for _, r := range byKey[key] {
+			if len(group.records) > 0 && group.sizeWith(r) > maxRecordBytes {
+				closeGroup()
+			}
+			group.add(r)
+		}
+		closeGroup()
+	}
+	return aggregated
+}
+
+// aggregation builds an AggregatedRecord protobuf message:
+//
+//	message AggregatedRecord {
+//	  repeated string partition_key_table = 1;
+//	  repeated string explicit_hash_key_table = 2;
+//	  repeated Record records = 3;
+//	}
+//	message Record {
+//	  required uint64 partition_key_index = 1;
+//	  optional uint64 explicit_hash_key_index = 2;
+//	  required bytes data = 3;
+//	  repeated Tag tags = 4;
+//	}
+type aggregation struct {
+	records []streamRecord
+	keys    []string
+	keyIdx  map[string]int
+	// size of the encoded protobuf message
+	messageBytes int
+}
+
+// sizeWith is the size of the aggregated record (partition key included) once r is added
+func (a *aggregation) sizeWith(r streamRecord) int {
+	size := a.messageBytes + protoFieldSize(a.recordSize(r))
+	if _, ok := a.keyIdx[r.partitionKey]; !ok {
+		size += protoFieldSize(len(r.partitionKey))
+	}
+	return len(kplMagic) + size + md5.Size + len(a.partitionKey(r))
+}
+
+func (a *aggregation) add(r streamRecord) {
+	if a.keyIdx == nil {
+		a.keyIdx = map[string]int{}
+	}
+	if _, ok := a.keyIdx[r.partitionKey]; !ok {
+		a.keyIdx[r.partitionKey] = len(a.keys)
+		a.keys = append(a.keys, r.partitionKey)
+		a.messageBytes += protoFieldSize(len(r.partitionKey))
+	}
+	a.messageBytes += protoFieldSize(a.recordSize(r))
+	a.records = append(a.records, r)
+}
+
+// recordSize is the size of the encoded Record message for r
+func (a *aggregation) recordSize(r streamRecord) int {
+	index, ok := a.keyIdx[r.partitionKey]
+	if !ok {
+		index = len(a.keys)
+	}
+	return 1 + uvarintSize(uint64(index)) + protoFieldSize(len(r.data))
+}
+
+// partitionKey is the one the aggregated record is sent with (the first record's)
+func (a *aggregation) partitionKey(r streamRecord) string {
+	if len(a.records) > 0 {
+		return a.records[0].partitionKey
+	}
+	return r.partitionKey
+}
+
+func (a *aggregation) encode() streamRecord {
+	message := []byte{}
+	for _, key := range a.keys {
+		message = appendProtoBytes(message, 1, []byte(key))
+	}
+	for _, r := range a.records {
+		record := appendProtoVarint(nil, 1, uint64(a.keyIdx[r.partitionKey]))
+		record = appendProtoBytes(record, 3, r.data)
+		message = appendProtoBytes(message, 3, record)
+	}
+	checksum := md5.Sum(message)
+	data := append(append(append([]byte{}, kplMagic...), message...), checksum[:]...)
+	return streamRecord{partitionKey: a.records[0].partitionKey, data: data}
+}
+
+// deaggregateRecord splits a KPL aggregated record back into the records it was
+// built from. Records that weren't aggregated come back as they are.
+func deaggregateRecord(r streamRecord) ([]streamRecord, error) {
+	if len(r.data) < len(kplMagic)+md5.Size || !bytes.HasPrefix(r.data, kplMagic) {
+		return []streamRecord{r}, nil
+	}
+	message := r.data[len(kplMagic) : len(r.data)-md5.Size]
+	if checksum := md5.Sum(message); !bytes.Equal(checksum[:], r.data[len(r.data)-md5.Size:]) {
+		// not every record starting with the magic bytes is an aggregated one
+		return []streamRecord{r}, nil
+	}
+
+	keys := []string{}
+	type indexedRecord struct {
+		keyIndex uint64
+		data     []byte
+	}
+	indexed := []indexedRecord{}
+	err := readProtoFields(message, func(field int, value []byte, _ uint64) error {
+		switch field {
+		case 1:
+			keys = append(keys, string(value))
+		case 3:
+			record := indexedRecord{}
+			err := readProtoFields(value, func(field int, value []byte, number uint64) error {
+				switch field {
+				case 1:
+					record.keyIndex = number
+				case 3:
+					record.data = value
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			indexed = append(indexed, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid aggregated record: %w", err)
+	}
+
+	records := []streamRecord{}
+	for _, record := range indexed {
+		if record.keyIndex >= uint64(len(keys)) {
+			return nil, fmt.Errorf("Invalid aggregated record: partition key index %d out of %d keys", record.keyIndex, len(keys))
+		}
+		records = append(records, streamRecord{partitionKey: keys[record.keyIndex], data: record.data})
+	}
+	return records, nil
+}
+
+// - - - - - - - - - - - - -
+//         PROTOBUF
+// - - - - - - - - - - - - -
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+func uvarintSize(v uint64) int {
+	size := 1
+	for ; v >= 0x80; v >>= 7 {
+		size++
+	}
+	return size
+}
+
+// protoFieldSize is the encoded size of a length-delimited field (1 byte tag)
+func protoFieldSize(length int) int {
+	return 1 + uvarintSize(uint64(length)) + length
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	return appendUvarint(appendUvarint(b, uint64(field<<3|protoVarint)), v)
+}
+
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	b = appendUvarint(b, uint64(field<<3|protoBytes))
+	return append(appendUvarint(b, uint64(len(value))), value...)
+}
+
+// readProtoFields calls fn for every field of a message, with the value of
+// length-delimited fields or the number of varint ones (others are skipped)
+func readProtoFields(message []byte, fn func(field int, value []byte, number uint64) error) error {
+	for len(message) > 0 {
+		tag, n := binary.Uvarint(message)
+		if n <= 0 {
+			return fmt.Errorf("invalid field tag")
+		}
+		message = message[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case protoVarint:
+			number, n := binary.Uvarint(message)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint in field %d", field)
+			}
+			message = message[n:]
+			if err := fn(field, nil, number); err != nil {
+				return err
+			}
+		case protoBytes:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || length > uint64(len(message)-n) {
+				return fmt.Errorf("invalid length in field %d", field)
+			}
+			value := message[n : n+int(length)]
+			message = message[n+int(length):]
+			if err := fn(field, value, 0); err != nil {
+				return err
+			}
+		case protoFixed64:
+			if len(message) < 8 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			message = message[8:]
+		case protoFixed32:
+			if len(message) < 4 {
+				return fmt.Errorf("truncated field %d", field)
+			}
+			message = message[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", tag&7, field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Counts PutRecords calls made from any goroutine (ex. the flush ticker)
+type syncKinesisClient struct {
+	mu sync.Mutex
+	mockKinesisClient
+}
+
+func (m *syncKinesisClient) PutRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mockKinesisClient.PutRecords(inp)
+}
+
+func (m *syncKinesisClient) calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.timesCalled
+}
+
+func newTestBatcher(client *mockKinesisClient, stream string, aggregate bool) *recordBatcher {
+	b := newRecordBatcher(&kinesisWrapper{client: client, logger: nopLog}, stream, 0, aggregate)
+	b.backoff = 0
+	return b
+}
+
+func TestBatcherFlushesOnRecordCount(t *testing.T) {
+	mockKinesis := &mockKinesisClient{}
+	b := newTestBatcher(mockKinesis, "test", false)
+	for i := 0; i <= maxBatchRecords; i++ {
+		if err := b.add(EventChunk{Data: "x"}, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mockKinesis.timesCalled != 1 || len(mockKinesis.putRecords[0]) != maxBatchRecords {
+		t.Fatalf("Expected a full batch of %d records to be sent, got %d calls", maxBatchRecords, mockKinesis.timesCalled)
+	}
+	if err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if mockKinesis.timesCalled != 2 || len(mockKinesis.putRecords[1]) != 1 || *mockKinesis.putRecords[1][0].PartitionKey != "key-500" {
+		t.Errorf("Expected the last record to be sent on flush, got %d calls", mockKinesis.timesCalled)
+	}
+	if err := b.flush(); err != nil || mockKinesis.timesCalled != 2 {
+		t.Errorf("Expected flushing nothing to be a no-op, got %d calls %v", mockKinesis.timesCalled, err)
+	}
+}
+
+func TestBatcherFlushesOnSize(t *testing.T) {
+	mockKinesis := &mockKinesisClient{}
+	b := newTestBatcher(mockKinesis, "test", false)
+	data := strings.Repeat("x", 1000000)
+	for i := 0; i < 6; i++ {
+		if err := b.add(data, "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mockKinesis.timesCalled != 1 || len(mockKinesis.putRecords[0]) != 5 {
+		t.Errorf("Expected the batch to be sent before going over 5MB, got %d calls", mockKinesis.timesCalled)
+	}
+
+	if err := b.add(strings.Repeat("x", maxRecordBytes), "key"); err == nil {
+		t.Error("Expected an error for a record over 1MB, but got <nil>")
+	}
+	if err := b.add(make(chan int), "key"); err == nil {
+		t.Error("Expected a marshal error, but got <nil>")
+	}
+}
+
+func TestBatcherFlushesOnTime(t *testing.T) {
+	mockKinesis := &syncKinesisClient{}
+	b := newRecordBatcher(&kinesisWrapper{client: mockKinesis, logger: nopLog}, "test", 10*time.Millisecond, false)
+	if err := b.add("data", "key"); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); mockKinesis.calls() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if mockKinesis.calls() != 1 {
+		t.Errorf("Expected the record to be sent by the flush interval, got %d calls", mockKinesis.calls())
+	}
+}
+
+func TestBatcherRetriesFailedRecords(t *testing.T) {
+	mockKinesis := &mockKinesisClient{failRecords: 2}
+	b := newTestBatcher(mockKinesis, "test", false)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := b.add("data", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if mockKinesis.timesCalled != 2 {
+		t.Fatalf("Expected a retry, got %d calls", mockKinesis.timesCalled)
+	}
+	retried := []string{}
+	for _, entry := range mockKinesis.putRecords[1] {
+		retried = append(retried, *entry.PartitionKey)
+	}
+	if strings.Join(retried, ",") != "a,b" {
+		t.Errorf("Expected only the failed records to be retried, got %v", retried)
+	}
+
+	mockKinesis = &mockKinesisClient{failRecords: 100}
+	b = newTestBatcher(mockKinesis, "test", false)
+	_ = b.add("data", "a")
+	if err := b.flush(); err == nil || !strings.Contains(err.Error(), "ProvisionedThroughputExceededException") {
+		t.Errorf("Expected the last error once retries ran out, got %v", err)
+	}
+	if mockKinesis.timesCalled != maxPutAttempts {
+		t.Errorf("Expected %d attempts, got %d", maxPutAttempts, mockKinesis.timesCalled)
+	}
+
+	mockKinesis = &mockKinesisClient{}
+	b = newTestBatcher(mockKinesis, "simulate_error", false)
+	_ = b.add("data", "a")
+	if err := b.flush(); err == nil || mockKinesis.timesCalled != maxPutAttempts {
+		t.Errorf("Expected a service error after %d attempts, got %v (%d calls)", maxPutAttempts, err, mockKinesis.timesCalled)
+	}
+}
+
+func TestBatcherAggregates(t *testing.T) {
+	mockKinesis := &mockKinesisClient{}
+	b := newTestBatcher(mockKinesis, "test", true)
+	for i := 0; i < maxBatchRecords+10; i++ {
+		if err := b.add("data", fmt.Sprintf("key-%d", i%3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if mockKinesis.timesCalled != 1 || len(mockKinesis.putRecords[0]) != 3 {
+		t.Fatalf("Expected an aggregated record per partition key, got %d calls", mockKinesis.timesCalled)
+	}
+	total := 0
+	for i, entry := range mockKinesis.putRecords[0] {
+		records, err := deaggregateRecord(streamRecord{partitionKey: *entry.PartitionKey, data: entry.Data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *entry.PartitionKey != fmt.Sprintf("key-%d", i) || records[0].partitionKey != *entry.PartitionKey || string(records[0].data) != `"data"` {
+			t.Errorf("Expected records aggregated under their own key %s, got %+v", *entry.PartitionKey, records[0])
+		}
+		total += len(records)
+	}
+	if total != maxBatchRecords+10 {
+		t.Errorf("Expected every record back, got %d", total)
+	}
+}
+
+func TestAggregateRecords(t *testing.T) {
+	// hand encoded AggregatedRecord{partition_key_table: ["a"], records: [{0, "x"}, {0, "y"}]}
+	message := []byte{0x0a, 0x01, 'a', 0x1a, 0x05, 0x08, 0x00, 0x1a, 0x01, 'x', 0x1a, 0x05, 0x08, 0x00, 0x1a, 0x01, 'y'}
+	checksum := md5.Sum(message)
+	expected := append(append(append([]byte{}, kplMagic...), message...), checksum[:]...)
+	aggregated := aggregateRecords([]streamRecord{{"a", []byte("x")}, {"a", []byte("y")}})
+	if len(aggregated) != 1 || aggregated[0].partitionKey != "a" || !bytes.Equal(aggregated[0].data, expected) {
+		t.Errorf("Expected the KPL format:\n%x\ngot:\n%+v", expected, aggregated)
+	}
+
+	// records keep their order within each key, and only share a record with their own key
+	keyed := aggregateRecords([]streamRecord{{"a", []byte("1")}, {"b", []byte("2")}, {"a", []byte("3")}, {"b", []byte("4")}})
+	if len(keyed) != 2 || keyed[0].partitionKey != "a" || keyed[1].partitionKey != "b" {
+		t.Fatalf("Expected an aggregated record per partition key, got %+v", keyed)
+	}
+	for _, r := range keyed {
+		records, err := deaggregateRecord(r)
+		if err != nil || len(records) != 2 {
+			t.Fatalf("Expected 2 records under key %s, got %+v %v", r.partitionKey, records, err)
+		}
+		for _, record := range records {
+			if record.partitionKey != r.partitionKey {
+				t.Errorf("Expected only records keyed %s, got %s", r.partitionKey, record.partitionKey)
+			}
+		}
+		if string(records[0].data)+string(records[1].data) != map[string]string{"a": "13", "b": "24"}[r.partitionKey] {
+			t.Errorf("Expected the records of key %s in order, got %+v", r.partitionKey, records)
+		}
+	}
+
+	single := aggregateRecords([]streamRecord{{"a", []byte("x")}})
+	if len(single) != 1 || string(single[0].data) != "x" {
+		t.Errorf("Expected a lone record to be sent as is, got %+v", single)
+	}
+
+	big := bytes.Repeat([]byte("x"), 600*1024)
+	split := aggregateRecords([]streamRecord{{"a", big}, {"a", big}, {"a", []byte("x")}})
+	if len(split) != 2 || !bytes.Equal(split[0].data, big) || !bytes.HasPrefix(split[1].data, kplMagic) {
+		t.Errorf("Expected records to be split under the 1MB limit, got %d records", len(split))
+	}
+	for _, r := range split {
+		if r.size() > maxRecordBytes {
+			t.Errorf("Expected records under %d bytes, got %d", maxRecordBytes, r.size())
+		}
+	}
+}
+
+func TestAggregationSize(t *testing.T) {
+	var a aggregation
+	for i, r := range []streamRecord{
+		{"first", []byte("x")},
+		{"second", bytes.Repeat([]byte("y"), 200)},
+		{"first", bytes.Repeat([]byte("z"), 20000)},
+	} {
+		expected := a.sizeWith(r)
+		a.add(r)
+		encoded := a.encode()
+		if actual := encoded.size(); actual != expected {
+			t.Errorf("record %d: expected a size of %d, got %d", i, expected, actual)
+		}
+	}
+}
+
+func TestDeaggregateRecord(t *testing.T) {
+	plain := streamRecord{"a", []byte(`{"data": "x"}`)}
+	if records, err := deaggregateRecord(plain); err != nil || len(records) != 1 || !bytes.Equal(records[0].data, plain.data) {
+		t.Errorf("Expected a plain record back as is, got %+v %v", records, err)
+	}
+
+	// other producers (ex. the KPL) can aggregate records with different keys
+	var a aggregation
+	a.add(streamRecord{"a", []byte("x")})
+	a.add(streamRecord{"b", []byte("y")})
+	aggregated := a.encode()
+	records, err := deaggregateRecord(aggregated)
+	if err != nil || len(records) != 2 || records[1].partitionKey != "b" || string(records[1].data) != "y" {
+		t.Errorf("Expected both records with their keys, got %+v %v", records, err)
+	}
+
+	corrupted := streamRecord{"a", append([]byte{}, aggregated.data...)}
+	corrupted.data[len(kplMagic)+2] ^= 0xff
+	if records, err := deaggregateRecord(corrupted); err != nil || len(records) != 1 {
+		t.Errorf("Expected a record failing the checksum to be read as is, got %+v %v", records, err)
+	}
+
+	// valid checksum around an invalid message
+	message := []byte{0x1a, 0x05, 0x08}
+	checksum := md5.Sum(message)
+	invalid := append(append(append([]byte{}, kplMagic...), message...), checksum[:]...)
+	if _, err := deaggregateRecord(streamRecord{"a", invalid}); err == nil {
+		t.Error("Expected an error for an invalid message, but got <nil>")
+	}
+	message = []byte{0x1a, 0x02, 0x08, 0x05}
+	checksum = md5.Sum(message)
+	invalid = append(append(append([]byte{}, kplMagic...), message...), checksum[:]...)
+	if _, err := deaggregateRecord(streamRecord{"a", invalid}); err == nil {
+		t.Error("Expected an error for a partition key index out of range, but got <nil>")
+	}
+}
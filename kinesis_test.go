@@ -3,26 +3,10 @@ package main
 import (
 	"log"
 	"os"
-	"reflect"
 	"testing"
-)
-
-func TestChunk(t *testing.T) {
-	testText := "apple"
-	expectedChunks := []string{"ap", "pl", "e"}
-
-	actualChunks := chunkData(testText, 2)
-
-	if len(actualChunks) != len(expectedChunks) {
-		t.Errorf("Expected %d chunks, but got %d", len(expectedChunks), len(actualChunks))
-	}
 
-	for ind := range actualChunks {
-		if actualChunks[ind] != expectedChunks[ind] {
-			t.Errorf("index=%d:\nExpected chunk=%s, but got chunk=%s", ind, expectedChunks[ind], actualChunks[ind])
-		}
-	}
-}
+	"github.com/intuit/replay-zero/envelope"
+)
 
 func TestGetRegionOverride(t *testing.T) {
 	err := os.Setenv("AWS_REGION", "")
@@ -66,21 +50,17 @@ func TestStreamHasSSEError(t *testing.T) {
 }
 
 func TestBuildMessages(t *testing.T) {
-	expected := EventChunk{
-		ChunkNumber: 0,
-		NumChunks:   1,
-		UUID:        "",
-		Data:        "foobar",
-	}
-	messages := buildMessages("foobar")
-	if len(messages) != 1 {
+	messages, err := buildMessages("foobar", envelope.Options{})
+	if err != nil || len(messages) != 1 {
 		log.Fatalf("Expected 1 message, got %d", len(messages))
 	}
 	first := messages[0]
-	expected.UUID = first.UUID
-	if !reflect.DeepEqual(first, expected) {
+	if first.Data != "foobar" || first.NumChunks != 1 || first.UUID == "" || first.ContentType != envelope.ContentTypeEvent {
 		log.Fatalf("Kinesis message is not the expected, got %v", first)
 	}
+	if err := first.Verify(); err != nil {
+		t.Errorf("Expected the message to match its hash, got %v", err)
+	}
 }
 
 func TestSendToStreamMarshalError(t *testing.T) {
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Learn modes: how volatile response fields are detected
+const (
+	learnTwice  = "twice"  // forward safe (GET, HEAD, OPTIONS) requests a second time and compare the responses
+	learnRepeat = "repeat" // compare the responses to identical requests seen during the session
+)
+
+// Kinds of volatile values, each one mapping to a Karate fuzzy matcher
+const (
+	volatileUUID    = "uuid"
+	volatileString  = "string"
+	volatileNumber  = "number"
+	volatileBoolean = "boolean"
+	volatileAny     = "any"
+)
+
+var uuidPattern = regexp.MustCompile(`^(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// learner remembers the responses to each distinct request, and marks the
+// response fields that change between otherwise identical requests as volatile
+type learner struct {
+	mode string
+
+	mu sync.Mutex
+	// last response and everything learned so far, per distinct request
+	previous map[string]HTTPEvent
+}
+
+// Set when running with --learn, nil otherwise
+var proxyLearner *learner
+
+func newLearner(mode string) *learner {
+	return &learner{mode: mode, previous: map[string]HTTPEvent{}}
+}
+
+func validateLearnMode(mode string) error {
+	switch mode {
+	case "", learnTwice, learnRepeat:
+		return nil
+	}
+	return fmt.Errorf("Unknown learn mode %q, expected one of [twice, repeat]", mode)
+}
+
+func learnKey(event HTTPEvent) string {
+	return fmt.Sprintf("%s %s?%s\n%s", event.HTTPMethod, event.Endpoint, event.Query, event.ReqBody)
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// learn marks the volatile fields of a freshly recorded event. In twice mode
+// safe requests are re-sent to target (scheme://host) for a second response.
+func (l *learner) learn(event *HTTPEvent, target string) {
+	if l.mode == learnTwice && isSafeMethod(event.HTTPMethod) {
+		result := replayEvent(*event, target, client, defaultDiffEngine)
+		if result.Err != nil {
+			log.Printf("[ERROR] Could not re-send request to learn volatile fields: %v\n", result.Err)
+		} else {
+			markVolatile(event, result.Actual)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := learnKey(*event)
+	if previous, ok := l.previous[key]; ok {
+		markVolatile(event, previous)
+		mergeVolatile(event, previous)
+	}
+	l.previous[key] = *event
+	if len(event.VolatileFields) > 0 || len(event.VolatileHeaders) > 0 {
+		logDebug("Learned volatile fields for %s %s: %v %v", event.HTTPMethod, event.Endpoint, event.VolatileFields, event.VolatileHeaders)
+	}
+}
+
+// markVolatile compares two responses to the same request and adds every
+// header and body value that differs to the event's volatile fields
+func markVolatile(event *HTTPEvent, other HTTPEvent) {
+	// every header counts here, including the ones replay always skips (Date, ETag, ...)
+	for _, h := range event.RespHeaders {
+		if value, ok := lookupHeader(other.RespHeaders, h.Name); !ok || value != h.Value {
+			addVolatileHeader(event, http.CanonicalHeaderKey(h.Name))
+		}
+	}
+	for _, d := range defaultDiffEngine.diffBodies(event.RespBody, other.RespBody) {
+		path := d.Path
+		if path == "" {
+			// not JSON, so the whole body changed
+			path = "$"
+		}
+		addVolatileField(event, path, volatileKind(d.Expected, d.Actual))
+	}
+}
+
+// mergeVolatile carries over whatever was learned from earlier responses
+func mergeVolatile(event *HTTPEvent, previous HTTPEvent) {
+	for path, kind := range previous.VolatileFields {
+		addVolatileField(event, path, kind)
+	}
+	for _, name := range previous.VolatileHeaders {
+		addVolatileHeader(event, name)
+	}
+}
+
+func addVolatileField(event *HTTPEvent, path, kind string) {
+	if event.VolatileFields == nil {
+		event.VolatileFields = map[string]string{}
+	}
+	if existing, ok := event.VolatileFields[path]; ok && existing != kind {
+		kind = volatileAny
+	}
+	event.VolatileFields[path] = kind
+}
+
+func addVolatileHeader(event *HTTPEvent, name string) {
+	for _, existing := range event.VolatileHeaders {
+		if existing == name {
+			return
+		}
+	}
+	event.VolatileHeaders = append(event.VolatileHeaders, name)
+	sort.Strings(event.VolatileHeaders)
+}
+
+// volatileKind picks the most specific kind that fits both
+// values (JSON literals, or "" when one side was missing)
+func volatileKind(expected, actual string) string {
+	var e, a interface{}
+	if json.Unmarshal([]byte(expected), &e) != nil || json.Unmarshal([]byte(actual), &a) != nil {
+		return volatileAny
+	}
+	switch ev := e.(type) {
+	case string:
+		av, ok := a.(string)
+		if !ok {
+			return volatileAny
+		}
+		if uuidPattern.MatchString(ev) && uuidPattern.MatchString(av) {
+			return volatileUUID
+		}
+		return volatileString
+	case float64:
+		if _, ok := a.(float64); ok {
+			return volatileNumber
+		}
+	case bool:
+		if _, ok := a.(bool); ok {
+			return volatileBoolean
+		}
+	}
+	return volatileAny
+}
+
+// karateMarker is the Karate fuzzy matcher for a kind of volatile value
+func karateMarker(kind string) string {
+	switch kind {
+	case volatileUUID, volatileString, volatileNumber, volatileBoolean:
+		return "#" + kind
+	}
+	return "#ignore"
+}
+
+// karateBody returns the recorded response body with each volatile
+// field replaced by the matching Karate fuzzy matcher. Bodies without
+// volatile fields are returned untouched.
+func karateBody(event HTTPEvent) string {
+	if len(event.VolatileFields) == 0 {
+		return event.RespBody
+	}
+	if kind, ok := event.VolatileFields["$"]; ok {
+		return karateMarker(kind)
+	}
+	var body interface{}
+	if err := json.Unmarshal([]byte(event.RespBody), &body); err != nil {
+		return event.RespBody
+	}
+	body = replaceVolatile(jsonPath{}, body, event.VolatileFields)
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	// keep <, > and & as recorded
+	encoder.SetEscapeHTML(false)
+	// re-encoding a decoded JSON value cannot fail
+	_ = encoder.Encode(body)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func replaceVolatile(path jsonPath, value interface{}, fields map[string]string) interface{} {
+	if kind, ok := fields[path.String()]; ok {
+		return karateMarker(kind)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = replaceVolatile(path.key(k), child, fields)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = replaceVolatile(path.index(i), child, fields)
+		}
+	}
+	return value
+}
+
+// isVolatileHeader reports whether a response header changed between identical requests
+func isVolatileHeader(event HTTPEvent, name string) bool {
+	for _, h := range event.VolatileHeaders {
+		if http.CanonicalHeaderKey(h) == http.CanonicalHeaderKey(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/intuit/replay-zero/templates"
+)
+
+// Responds with a new id, counter and Date on every call
+func newVolatileServer() (*httptest.Server, *int) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-Id", fmt.Sprintf("req-%d", calls))
+		fmt.Fprintf(w, `{"id": "00000000-0000-4000-8000-%012d", "count": %d, "name": "fixed", "at": "t%d"}`, calls, calls, calls)
+	}))
+	return server, &calls
+}
+
+func TestValidateLearnMode(t *testing.T) {
+	for _, mode := range []string{"", learnTwice, learnRepeat} {
+		if err := validateLearnMode(mode); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", mode, err)
+		}
+	}
+	if err := validateLearnMode("always"); err == nil {
+		t.Error("Expected an error for an unknown mode, but got <nil>")
+	}
+}
+
+func TestVolatileKind(t *testing.T) {
+	var kindTests = []struct {
+		expected string
+		actual   string
+		kind     string
+	}{
+		{`"8a5c7a1e-1b8f-4f2c-9a4e-0d2c5e6f7a8b"`, `"0f1e2d3c-4b5a-4969-8877-665544332211"`, volatileUUID},
+		{`"8a5c7a1e-1b8f-4f2c-9a4e-0d2c5e6f7a8b"`, `"not-a-uuid"`, volatileString},
+		{`"a"`, `1`, volatileAny},
+		{`1`, `2.5`, volatileNumber},
+		{`1`, `"1"`, volatileAny},
+		{`true`, `false`, volatileBoolean},
+		{`true`, `null`, volatileAny},
+		{`[1]`, `[2]`, volatileAny},
+		{`1`, ``, volatileAny},
+	}
+	for _, tt := range kindTests {
+		if kind := volatileKind(tt.expected, tt.actual); kind != tt.kind {
+			t.Errorf("Expected %s vs %s to be %s, got %s", tt.expected, tt.actual, tt.kind, kind)
+		}
+	}
+}
+
+func TestLearnerRepeat(t *testing.T) {
+	l := newLearner(learnRepeat)
+	first := HTTPEvent{
+		HTTPMethod:  "GET",
+		Endpoint:    "/api",
+		RespHeaders: []Header{{Name: "date", Value: "Tue"}, {Name: "X-Fixed", Value: "1"}},
+		RespBody:    `{"id": 1, "items": [{"at": "a"}], "name": "x"}`,
+	}
+	second := first
+	second.RespHeaders = []Header{{Name: "Date", Value: "Wed"}, {Name: "X-Fixed", Value: "1"}}
+	second.RespBody = `{"id": 2, "items": [{"at": "b"}], "name": "x"}`
+	third := first
+	third.RespBody = `{"id": 3, "items": [{"at": "a"}], "name": "y"}`
+	other := first
+	other.Endpoint = "/other"
+
+	l.learn(&first, "")
+	if first.VolatileFields != nil || first.VolatileHeaders != nil {
+		t.Errorf("Expected nothing to be learned from a single response, got %v %v", first.VolatileFields, first.VolatileHeaders)
+	}
+	l.learn(&second, "")
+	expectedFields := map[string]string{"$.id": volatileNumber, "$.items[0].at": volatileString}
+	if !reflect.DeepEqual(second.VolatileFields, expectedFields) {
+		t.Errorf("Expected %v, got %v", expectedFields, second.VolatileFields)
+	}
+	if !reflect.DeepEqual(second.VolatileHeaders, []string{"Date"}) {
+		t.Errorf("Expected [Date], got %v", second.VolatileHeaders)
+	}
+	// learned fields carry over even when they happen to match this time
+	l.learn(&third, "")
+	expectedFields["$.name"] = volatileString
+	if !reflect.DeepEqual(third.VolatileFields, expectedFields) {
+		t.Errorf("Expected %v, got %v", expectedFields, third.VolatileFields)
+	}
+	if !reflect.DeepEqual(third.VolatileHeaders, []string{"Date"}) {
+		t.Errorf("Expected [Date], got %v", third.VolatileHeaders)
+	}
+	l.learn(&other, "")
+	if other.VolatileFields != nil {
+		t.Errorf("Expected a different request to learn nothing, got %v", other.VolatileFields)
+	}
+}
+
+func TestLearnerTwice(t *testing.T) {
+	server, calls := newVolatileServer()
+	defer server.Close()
+
+	l := newLearner(learnTwice)
+	request := httptest.NewRequest("GET", server.URL+"/api", nil)
+	response, err := http.Get(server.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	event, err := convertRequestResponse(request, response, "", string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.learn(&event, server.URL)
+	if *calls != 2 {
+		t.Errorf("Expected the request to be sent twice, got %d calls", *calls)
+	}
+	expectedFields := map[string]string{"$.id": volatileUUID, "$.count": volatileNumber, "$.at": volatileString}
+	if !reflect.DeepEqual(event.VolatileFields, expectedFields) {
+		t.Errorf("Expected %v, got %v", expectedFields, event.VolatileFields)
+	}
+	if !isVolatileHeader(event, "x-request-id") || isVolatileHeader(event, "Content-Type") {
+		t.Errorf("Expected only X-Request-Id (and Date) to be volatile, got %v", event.VolatileHeaders)
+	}
+
+	post := HTTPEvent{HTTPMethod: "POST", Endpoint: "/api"}
+	l.learn(&post, server.URL)
+	if *calls != 2 {
+		t.Errorf("Expected unsafe requests not to be re-sent, got %d calls", *calls)
+	}
+
+	server.Close()
+	failed := HTTPEvent{HTTPMethod: "GET", Endpoint: "/gone"}
+	l.learn(&failed, server.URL)
+	if failed.VolatileFields != nil {
+		t.Errorf("Expected nothing to be learned when re-sending fails, got %v", failed.VolatileFields)
+	}
+}
+
+func TestServerHandlerLearnMode(t *testing.T) {
+	server, calls := newVolatileServer()
+	defer server.Close()
+	proxyLearner = newLearner(learnTwice)
+	defer func() { proxyLearner = nil }()
+
+	h := &capturingHandler{}
+	w := httptest.NewRecorder()
+	createServerHandler(h)(w, httptest.NewRequest("GET", server.URL+"/api", strings.NewReader("")))
+	if *calls != 2 {
+		t.Errorf("Expected the request to be forwarded twice, got %d calls", *calls)
+	}
+	if !strings.Contains(w.Body.String(), `"count": 1`) {
+		t.Errorf("Expected the client to get the first response, got %s", w.Body.String())
+	}
+	if len(h.events) != 1 || len(h.events[0].VolatileFields) != 3 {
+		t.Errorf("Expected one event with 3 volatile fields, got %v", h.events)
+	}
+}
+
+func TestKarateBody(t *testing.T) {
+	var karateBodyTests = []struct {
+		name     string
+		body     string
+		fields   map[string]string
+		expected string
+	}{
+		{"no volatile fields", `{"a": 1,  "b": "<x>"}`, nil, `{"a": 1,  "b": "<x>"}`},
+		{"nested fields", `{"id": "x", "items": [{"n": 1, "ok": true}, {"n": 2}], "b": "<x>", "tags": [1], "odd key": null}`,
+			map[string]string{"$.id": volatileUUID, "$.items[0].n": volatileNumber, "$.items[0].ok": volatileBoolean, "$.tags": volatileAny, "$['odd key']": volatileString},
+			`{"b":"<x>","id":"#uuid","items":[{"n":"#number","ok":"#boolean"},{"n":2}],"odd key":"#string","tags":"#ignore"}`},
+		{"whole body", "plain text", map[string]string{"$": volatileAny}, "#ignore"},
+		{"not JSON", "plain text", map[string]string{"$.a": volatileAny}, "plain text"},
+	}
+	for _, tt := range karateBodyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := karateBody(HTTPEvent{RespBody: tt.body, VolatileFields: tt.fields})
+			if body != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestKarateTemplateFuzzyMatchers(t *testing.T) {
+	event := sampleEvent
+	event.RespHeaders = []Header{{Name: "Date", Value: "Tue"}, {Name: "X-Fixed", Value: "1"}}
+	event.RespBody = `{"id": "x", "name": "fixed"}`
+	event.VolatileFields = map[string]string{"$.id": volatileUUID}
+	event.VolatileHeaders = []string{"Date"}
+	var buff bytes.Buffer
+	handler := &offlineHandler{
+		format:          outputFormat{template: templates.KarateBase},
+		buffer:          []HTTPEvent{event},
+		writerFactory:   func(h *offlineHandler) io.Writer { return &buff },
+		templateFuncMap: getTemplateFuncMap(),
+	}
+	if err := handler.runTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"And match header Date == '#string'",
+		"And match header X-Fixed == '1'",
+		`{"id":"#uuid","name":"fixed"}`,
+	} {
+		if !strings.Contains(buff.String(), expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, buff.String())
+		}
+	}
+}
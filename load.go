@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// loadOptions configure a timed replay of recorded traffic
+type loadOptions struct {
+	target string
+	// 2 replays twice as fast as recorded, 0.5 half as fast
+	speed       float64
+	concurrency int
+	// keep looping over the recording for this long (0 replays it once)
+	duration time.Duration
+}
+
+// loadStats summarize a load run
+type loadStats struct {
+	latencies []time.Duration
+	// requests that failed to send or got a 5XX response
+	errors   int
+	statuses map[string]int
+	elapsed  time.Duration
+}
+
+// runLoad implements `replay-zero load`, returning the process exit code
+func runLoad(args []string) int {
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of replay-zero load:\n  replay-zero load [flags] recording.jsonl...\n")
+		fs.PrintDefaults()
+	}
+	opts := loadOptions{}
+	fs.StringVar(&opts.target, "target", "http://localhost:8080", "Base URL to send the recorded requests to")
+	speed := fs.String("speed", "1x", "Replay speed relative to the recorded timing, ex. [5x] or [0.5x]")
+	fs.IntVar(&opts.concurrency, "concurrency", 10, "Maximum number of requests in flight")
+	fs.DurationVar(&opts.duration, "duration", 0, "Keep looping over the recording for this long, ex. [10m] (default: replay it once)")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout for each request")
+	fs.BoolVar(&flags.debug, "debug", false, "Set logging to also print debug messages")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	var err error
+	if opts.speed, err = parseSpeed(*speed); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if opts.concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "Concurrency must be at least 1")
+		return 2
+	}
+
+	events, err := readRecordings(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(events) == 0 {
+		fmt.Fprintln(os.Stderr, "No events to replay")
+		return 1
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// the default of 2 idle connections per host would mean a new connection for most requests
+	transport.MaxIdleConnsPerHost = opts.concurrency
+	client := &http.Client{Timeout: *timeout, Transport: transport}
+	stats := runLoadTest(events, opts, client)
+	printLoadReport(os.Stdout, stats)
+	if stats.errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// parseSpeed accepts a multiplier with or without a trailing "x"
+func parseSpeed(s string) (float64, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(s), "x"), 64)
+	if err != nil || speed <= 0 || math.IsInf(speed, 0) {
+		return 0, fmt.Errorf("Invalid speed %q, expected a positive multiplier like 5x or 0.5x", s)
+	}
+	return speed, nil
+}
+
+// loadSchedule orders the events by when they were recorded, and returns
+// when (relative to the start of the run) each one should be sent
+func loadSchedule(events []HTTPEvent, speed float64) ([]HTTPEvent, []time.Duration) {
+	// events recorded without a timestamp are sent right after the event before them
+	timestamps := make([]int64, len(events))
+	var previous int64
+	for i, event := range events {
+		if event.Timestamp != 0 {
+			previous = event.Timestamp
+		}
+		timestamps[i] = previous
+	}
+	order := make([]int, len(events))
+	for i := range order {
+		order[i] = i
+	}
+	// events are written out when their response comes back, so
+	// concurrent requests can be slightly out of order in a recording
+	sort.SliceStable(order, func(i, j int) bool { return timestamps[order[i]] < timestamps[order[j]] })
+
+	sorted := make([]HTTPEvent, len(events))
+	offsets := make([]time.Duration, len(events))
+	var first int64
+	for i, index := range order {
+		sorted[i] = events[index]
+		if first == 0 {
+			first = timestamps[index]
+		}
+		if first != 0 {
+			offsets[i] = time.Duration(float64(time.Duration(timestamps[index]-first)*time.Millisecond) / speed)
+		}
+	}
+	return sorted, offsets
+}
+
+// Time between the starts of two loops over a recording without a time span
+// (ex. a single event, or no timestamps), so it isn't sent as a flood
+const zeroSpanLoopLength = time.Second
+
+// runLoadTest sends the events on their (scaled) recorded schedule with up
+// to opts.concurrency requests in flight, looping until opts.duration is up
+func runLoadTest(events []HTTPEvent, opts loadOptions, c *http.Client) loadStats {
+	events, offsets := loadSchedule(events, opts.speed)
+	// leave the same gap between loops as the average gap between events
+	loopLength := offsets[len(offsets)-1]
+	if len(offsets) > 1 {
+		loopLength += loopLength / time.Duration(len(offsets)-1)
+	}
+	if loopLength == 0 {
+		loopLength = zeroSpanLoopLength
+	}
+
+	stats := loadStats{statuses: map[string]int{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan HTTPEvent)
+	for i := 0; i < opts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for event := range queue {
+				actual, latency, err := sendEvent(event, opts.target, c)
+				mu.Lock()
+				stats.latencies = append(stats.latencies, latency)
+				if err != nil {
+					logDebug("%s %s failed: %v", event.HTTPMethod, event.Endpoint, err)
+					stats.errors++
+					stats.statuses["error"]++
+				} else {
+					if strings.HasPrefix(actual.ResponseCode, "5") {
+						stats.errors++
+					}
+					stats.statuses[actual.ResponseCode]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	start := time.Now()
+	deadline := start.Add(opts.duration)
+schedule:
+	for loop := 0; ; loop++ {
+		for i, event := range events {
+			at := start.Add(time.Duration(loop)*loopLength + offsets[i])
+			if opts.duration > 0 && at.After(deadline) {
+				break schedule
+			}
+			time.Sleep(time.Until(at))
+			// blocks when every worker is busy, in which case the schedule slips
+			queue <- event
+		}
+		if opts.duration <= 0 {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+	stats.elapsed = time.Since(start)
+	sort.Slice(stats.latencies, func(i, j int) bool { return stats.latencies[i] < stats.latencies[j] })
+	return stats
+}
+
+// percentile uses the nearest-rank method on the sorted latencies
+func (s loadStats) percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(s.latencies))))
+	if rank < 1 {
+		rank = 1
+	}
+	return s.latencies[rank-1]
+}
+
+func (s loadStats) mean() time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, l := range s.latencies {
+		total += l
+	}
+	return total / time.Duration(len(s.latencies))
+}
+
+func printLoadReport(w io.Writer, s loadStats) {
+	requests := len(s.latencies)
+	rate, errorRate := 0.0, 0.0
+	if s.elapsed > 0 {
+		rate = float64(requests) / s.elapsed.Seconds()
+	}
+	if requests > 0 {
+		errorRate = 100 * float64(s.errors) / float64(requests)
+	}
+	fmt.Fprintf(w, "Sent %d requests in %s (%.1f req/s)\n", requests, s.elapsed.Round(time.Millisecond), rate)
+	fmt.Fprintf(w, "Errors: %d (%.1f%%)\n", s.errors, errorRate)
+
+	codes := make([]string, 0, len(s.statuses))
+	for code := range s.statuses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	statuses := make([]string, 0, len(codes))
+	for _, code := range codes {
+		statuses = append(statuses, fmt.Sprintf("%s=%d", code, s.statuses[code]))
+	}
+	fmt.Fprintf(w, "Status codes: %s\n", strings.Join(statuses, " "))
+
+	round := func(d time.Duration) time.Duration { return d.Round(100 * time.Microsecond) }
+	fmt.Fprintf(w, "Latency: mean=%s p50=%s p90=%s p95=%s p99=%s max=%s\n",
+		round(s.mean()), round(s.percentile(50)), round(s.percentile(90)), round(s.percentile(95)), round(s.percentile(99)), round(s.percentile(100)))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSpeed(t *testing.T) {
+	var speedTests = []struct {
+		input string
+		speed float64
+		valid bool
+	}{
+		{"5x", 5, true},
+		{"5X", 5, true},
+		{"0.5x", 0.5, true},
+		{"2", 2, true},
+		{"0x", 0, false},
+		{"-1x", 0, false},
+		{"fast", 0, false},
+		{"infx", 0, false},
+	}
+	for _, tt := range speedTests {
+		speed, err := parseSpeed(tt.input)
+		if (err == nil) != tt.valid || speed != tt.speed {
+			t.Errorf("parseSpeed(%q): expected %v (valid=%v), got %v %v", tt.input, tt.speed, tt.valid, speed, err)
+		}
+	}
+}
+
+func TestLoadSchedule(t *testing.T) {
+	events := []HTTPEvent{
+		{PairID: "untimed-first"},
+		{PairID: "b", Timestamp: 3000},
+		{PairID: "a", Timestamp: 1000},
+		{PairID: "untimed"},
+		{PairID: "c", Timestamp: 5000},
+	}
+	sorted, offsets := loadSchedule(events, 2)
+	ids := []string{}
+	for _, e := range sorted {
+		ids = append(ids, e.PairID)
+	}
+	expectedIDs := []string{"untimed-first", "a", "untimed", "b", "c"}
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Errorf("Expected order %v, got %v", expectedIDs, ids)
+	}
+	expectedOffsets := []time.Duration{0, 0, 0, time.Second, 2 * time.Second}
+	if !reflect.DeepEqual(offsets, expectedOffsets) {
+		t.Errorf("Expected offsets %v, got %v", expectedOffsets, offsets)
+	}
+}
+
+func TestRunLoadTest(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	events := []HTTPEvent{
+		{HTTPMethod: "GET", Endpoint: "/ok", Timestamp: 1000},
+		{HTTPMethod: "GET", Endpoint: "/fail", Timestamp: 1100},
+	}
+	start := time.Now()
+	stats := runLoadTest(events, loadOptions{target: server.URL, speed: 10, concurrency: 2}, server.Client())
+	if len(stats.latencies) != 2 || calls["/ok"] != 1 || calls["/fail"] != 1 {
+		t.Errorf("Expected each event to be sent once, got %v", calls)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Error("Expected the recorded gap (scaled down to 10ms) to be kept")
+	}
+	if stats.errors != 1 || !reflect.DeepEqual(stats.statuses, map[string]int{"200": 1, "500": 1}) {
+		t.Errorf("Expected 1 error out of 2, got %d %v", stats.errors, stats.statuses)
+	}
+
+	// short recordings loop as fast as --speed makes them (every 20ms here)
+	stats = runLoadTest(events, loadOptions{target: server.URL, speed: 10, concurrency: 2, duration: 50 * time.Millisecond}, server.Client())
+	if len(stats.latencies) < 4 {
+		t.Errorf("Expected the recording to be looped for the duration, got %d requests", len(stats.latencies))
+	}
+
+	// a single event has no time span to loop over
+	stats = runLoadTest(events[:1], loadOptions{target: server.URL, speed: 1, concurrency: 1, duration: 1200 * time.Millisecond}, server.Client())
+	if len(stats.latencies) != 2 {
+		t.Errorf("Expected a loop every second, got %d requests", len(stats.latencies))
+	}
+
+	server.Close()
+	stats = runLoadTest(events[:1], loadOptions{target: server.URL, speed: 1, concurrency: 1}, server.Client())
+	if stats.errors != 1 || stats.statuses["error"] != 1 {
+		t.Errorf("Expected a connection error, got %d %v", stats.errors, stats.statuses)
+	}
+}
+
+func TestLoadStats(t *testing.T) {
+	stats := loadStats{statuses: map[string]int{"200": 9, "500": 1}, errors: 1, elapsed: 2 * time.Second}
+	for i := 1; i <= 10; i++ {
+		stats.latencies = append(stats.latencies, time.Duration(i)*time.Millisecond)
+	}
+	if p := stats.percentile(50); p != 5*time.Millisecond {
+		t.Errorf("Expected p50 of 5ms, got %s", p)
+	}
+	if p := stats.percentile(99); p != 10*time.Millisecond {
+		t.Errorf("Expected p99 of 10ms, got %s", p)
+	}
+	if p := stats.percentile(0); p != time.Millisecond {
+		t.Errorf("Expected p0 of 1ms, got %s", p)
+	}
+	if m := stats.mean(); m != 5500*time.Microsecond {
+		t.Errorf("Expected a mean of 5.5ms, got %s", m)
+	}
+	if (loadStats{}).percentile(50) != 0 || (loadStats{}).mean() != 0 {
+		t.Error("Expected empty stats to report zero latencies")
+	}
+
+	var report bytes.Buffer
+	printLoadReport(&report, stats)
+	for _, expected := range []string{
+		"Sent 10 requests in 2s (5.0 req/s)",
+		"Errors: 1 (10.0%)",
+		"Status codes: 200=9 500=1",
+		"Latency: mean=5.5ms p50=5ms p90=9ms p95=10ms p99=10ms max=10ms",
+	} {
+		if !strings.Contains(report.String(), expected) {
+			t.Errorf("Expected report to contain %q, got:\n%s", expected, report.String())
+		}
+	}
+}
+
+func TestRunLoad(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recording.jsonl")
+	event := HTTPEvent{HTTPMethod: "GET", Endpoint: "/", Timestamp: 1000}
+	if err := ioutil.WriteFile(path, []byte(httpEventToString(event)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.jsonl")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	var exitCodeTests = []struct {
+		args []string
+		code int
+	}{
+		{[]string{"--target", server.URL, "--speed", "5x", "--concurrency", "2", path}, 0},
+		{[]string{"--target", "http://127.0.0.1:1", path}, 1},
+		{[]string{empty}, 1},
+		{[]string{filepath.Join(dir, "missing.jsonl")}, 1},
+		{[]string{"--speed", "fast", path}, 2},
+		{[]string{"--concurrency", "0", path}, 2},
+		{[]string{}, 2},
+	}
+	for _, tt := range exitCodeTests {
+		if code := runLoad(tt.args); code != tt.code {
+			t.Errorf("runLoad(%v): expected exit code %d, got %d", tt.args, tt.code, code)
+		}
+	}
+}
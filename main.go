@@ -10,6 +10,7 @@ import (
 	"os"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/markbates/pkger"
 	flag "github.com/spf13/pflag"
@@ -36,10 +37,38 @@ var (
 		debug             bool
 		streamRoleArn     string
 		streamName        string
+		streamFlush       time.Duration
+		kplAggregate      bool
+		spoolDir          string
+		spoolMaxSize      string
+		spoolFull         string
+		queueSize         int
+		queueWorkers      int
+		queueFull         string
+		streamStats       time.Duration
+		partitionKey      string
+		compression       string
+		encryptKMSKey     string
+		encryptKeyFile    string
+		openAPISpec       string
+		mode              string
+		cassette          string
+		match             string
+		matchHeaders      []string
+		learn             string
+		shadowTarget      string
+		shadowReport      string
+		shadowTimeout     time.Duration
+		shadowDiff        *diffOptions
+		faults            string
+		sinks             string
+		junit             string
+		summaryJSON       string
 	}
 
-	client    = &http.Client{}
-	telemetry telemetryAgent
+	client = &http.Client{}
+	// replaced with a real agent (if configured) once flags are read
+	telemetry telemetryAgent = &nopTelemetryAgent{}
 )
 
 func check(err error) {
@@ -78,6 +107,11 @@ func readFlags() {
 	flag.ErrHelp = errors.New("")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of replay-zero:\n")
+		fmt.Fprintf(os.Stderr, "  replay-zero [flags]                    record traffic through the proxy\n")
+		fmt.Fprintf(os.Stderr, "  replay-zero replay [flags] FILE...     re-send recorded events and diff the responses\n")
+		fmt.Fprintf(os.Stderr, "  replay-zero mock [flags] FILE...       serve recorded responses\n")
+		fmt.Fprintf(os.Stderr, "  replay-zero load [flags] FILE...       load test with recorded traffic on its recorded schedule\n")
+		fmt.Fprintf(os.Stderr, "  replay-zero consume [flags]            read recorded events back from a Kinesis stream\n\n")
 		flag.PrintDefaults()
 	}
 	flag.BoolVarP(&flags.version, "version", "V", false, "Print version info and exit")
@@ -85,10 +119,37 @@ func readFlags() {
 	flag.IntVarP(&flags.defaultTargetPort, "target-port", "p", 8080, "The port the Replay Zero proxy will forward to on localhost")
 	flag.BoolVar(&flags.debug, "debug", false, "Set logging to also print debug messages")
 	flag.IntVarP(&flags.batchSize, "batch-size", "b", 1, "Buffer events before writing out to a file")
-	flag.StringVarP(&flags.template, "template", "t", "karate", "Either [karate] or [gatling] or [path/to/custom/template]")
+	flag.StringVarP(&flags.template, "template", "t", "karate", "One of [karate, gatling, k6, go, jmeter, hurl, http, jsonl] or [path/to/custom/template]")
 	flag.StringVarP(&flags.extension, "extension", "e", "", "For custom output template")
 	flag.StringVarP(&flags.streamName, "stream-name", "s", "", "AWS Kinesis Stream name (streaming mode only)")
 	flag.StringVarP(&flags.streamRoleArn, "stream-role-arn", "r", "", "AWS Kinesis Stream ARN (streaming mode only)")
+	flag.DurationVar(&flags.streamFlush, "stream-flush-interval", onlineDefaults.FlushInterval, "Longest time recorded events wait to be batched into a Kinesis PutRecords call (streaming mode only)")
+	flag.BoolVar(&flags.kplAggregate, "kpl-aggregate", false, "Pack events into KPL aggregated records, read by KCL / KPL aware consumers (streaming mode only)")
+	flag.StringVar(&flags.spoolDir, "spool-dir", "", "Directory to save events to until they are delivered, resuming delivery on the next run (streaming mode only)")
+	flag.StringVar(&flags.spoolMaxSize, "spool-max-size", onlineDefaults.SpoolMaxSize, "Most disk space used by the spool (streaming mode only)")
+	flag.StringVar(&flags.spoolFull, "spool-full", onlineDefaults.SpoolFull, "When the spool is full: [drop-oldest] events or [block] until there's room (streaming mode only)")
+	flag.IntVar(&flags.queueSize, "stream-queue-size", onlineDefaults.QueueSize, "Recorded events waiting to be sent to Kinesis (streaming mode only)")
+	flag.IntVar(&flags.queueWorkers, "stream-workers", onlineDefaults.QueueWorkers, "Goroutines sending queued events to Kinesis (streaming mode only)")
+	flag.StringVar(&flags.queueFull, "stream-queue-full", onlineDefaults.QueueFull, "When the send queue is full: [block], [drop] the event or [spill] it to the spool (streaming mode only)")
+	flag.DurationVar(&flags.streamStats, "stream-stats-interval", onlineDefaults.StatsInterval, "How often to log send queue depth, latency and drops, 0 to only log them on exit (streaming mode only)")
+	flag.StringVar(&flags.partitionKey, "partition-key", onlineDefaults.PartitionKey, "How events are spread over shards: [uuid], [endpoint], [header:NAME], [cookie:NAME] or [random] (streaming mode only)")
+	flag.StringVar(&flags.compression, "stream-compression", onlineDefaults.Compression, "Compress events before splitting them into records: [none], [gzip] or [zstd] (streaming mode only)")
+	flag.StringVar(&flags.encryptKMSKey, "encrypt-kms-key", "", "Encrypt events with data keys from this KMS key (ID, ARN or alias/NAME) (streaming mode only)")
+	flag.StringVar(&flags.encryptKeyFile, "encrypt-key-file", "", "Encrypt events with data keys wrapped by the key in this file, for development (streaming mode only)")
+	flag.StringVar(&flags.openAPISpec, "openapi", "", "Validate recorded traffic against an OpenAPI / Swagger spec (JSON or YAML)")
+	flag.StringVar(&flags.mode, "mode", modeRecord, "Either [record] or [auto] (serve recorded responses from the cassette, forward + record everything else)")
+	flag.StringVar(&flags.cassette, "cassette", "cassette.jsonl", "JSONL archive of recorded events (auto mode only)")
+	flag.StringVar(&flags.match, "match", matchQuery, "What has to match a recording: [path], [query] or [body] (auto mode only)")
+	flag.StringSliceVar(&flags.matchHeaders, "match-header", nil, "Request header that also has to match a recording (auto mode only, repeatable)")
+	flag.StringVar(&flags.learn, "learn", "", "Detect volatile response fields: [twice] (re-send safe requests) or [repeat] (compare identical requests)")
+	flag.StringVar(&flags.shadowTarget, "shadow-target", "", "Base URL to mirror every request to, diffing its responses against the primary ones (ex. http://localhost:8081)")
+	flag.StringVar(&flags.shadowReport, "shadow-report", "", "File to append a JSON line per shadowed event to (shadow mode only)")
+	flag.DurationVar(&flags.shadowTimeout, "shadow-timeout", 10*time.Second, "Timeout for each mirrored request, after which the event is recorded without a shadow response and reported as failed (shadow mode only)")
+	flags.shadowDiff = registerDiffFlags(flag.CommandLine)
+	flag.StringVar(&flags.junit, "junit", "", "Write a JUnit XML report of shadow diffs and OpenAPI validation (one testcase per event) to this file on exit")
+	flag.StringVar(&flags.summaryJSON, "summary-json", "", "Write a JSON summary of shadow diffs and OpenAPI validation to this file on exit")
+	flag.StringVar(&flags.sinks, "sinks", "", "YAML file of sinks (template, archive, kinesis, kafka, webhook) to send every recorded event to, instead of one output mode")
+	flag.StringVar(&flags.faults, "faults", "", "YAML file of rules for injecting faults (latency, status, reset, truncate, trickle) into proxied requests")
 	flag.Parse()
 
 	if flags.version {
@@ -96,6 +157,16 @@ func readFlags() {
 		os.Exit(0)
 	}
 
+	if flags.mode != modeRecord && flags.mode != modeAuto {
+		log.Fatalf("Unknown mode %q, expected one of [record, auto]", flags.mode)
+	}
+	if err := validateMockOptions(flags.match, playbackSequential); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateLearnMode(flags.learn); err != nil {
+		log.Fatal(err)
+	}
+
 	if flags.batchSize == 0 {
 		log.Println("Batch size cannot be zero! Using batch=1")
 		flags.batchSize = 1
@@ -105,7 +176,7 @@ func readFlags() {
 
 	// check if template exist at the provided path
 	// TODO: add validation for correctness of template
-	if !(flags.template == "karate" || flags.template == "gatling") {
+	if !isBuiltinTemplate(flags.template) {
 		_, err := ioutil.ReadFile(flags.template)
 		if err != nil {
 			log.Printf("Failed to load template")
@@ -137,6 +208,14 @@ func getPkgTemplate(filePath string) string {
 	return string(b[:content])
 }
 
+func isBuiltinTemplate(template string) bool {
+	switch template {
+	case "karate", "gatling", "k6", "go", "jmeter", "hurl", "http", "jsonl":
+		return true
+	}
+	return false
+}
+
 func getFormat(template string, extension string) outputFormat {
 	switch template {
 	case "karate":
@@ -149,6 +228,38 @@ func getFormat(template string, extension string) outputFormat {
 			template:  getPkgTemplate("/templates/gatling_default.template"),
 			extension: "scala",
 		}
+	case "k6":
+		return outputFormat{
+			template:  getPkgTemplate("/templates/k6_default.template"),
+			extension: "js",
+		}
+	case "go":
+		return outputFormat{
+			template:   getPkgTemplate("/templates/go_default.template"),
+			extension:  "go",
+			nameSuffix: "_test",
+			gofmt:      true,
+		}
+	case "jmeter":
+		return outputFormat{
+			template:  getPkgTemplate("/templates/jmeter_default.template"),
+			extension: "jmx",
+		}
+	case "hurl":
+		return outputFormat{
+			template:  getPkgTemplate("/templates/hurl_default.template"),
+			extension: "hurl",
+		}
+	case "http":
+		return outputFormat{
+			template:  getPkgTemplate("/templates/http_default.template"),
+			extension: "http",
+		}
+	case "jsonl":
+		return outputFormat{
+			template:  getPkgTemplate("/templates/jsonl_default.template"),
+			extension: "jsonl",
+		}
 	default:
 		dat, err := ioutil.ReadFile(template)
 		if err != nil {
@@ -171,7 +282,11 @@ func buildNewTargetURL(req *http.Request) string {
 	if host == "" {
 		host = fmt.Sprintf("localhost:%d", flags.defaultTargetPort)
 	}
-	return fmt.Sprintf("%s://%s%s", scheme, host, req.URL.Path)
+	target := fmt.Sprintf("%s://%s%s", scheme, host, req.URL.Path)
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	return target
 }
 
 // A higher-order function that accepts an HTTPEvent handler and
@@ -179,6 +294,7 @@ func buildNewTargetURL(req *http.Request) string {
 // and passes that on to the parametrized handler for further processing.
 func createServerHandler(h eventHandler) func(http.ResponseWriter, *http.Request) {
 	return func(wr http.ResponseWriter, originalRequest *http.Request) {
+		receivedAt := time.Now()
 		// 1. Construct proxy request
 		newURL := buildNewTargetURL(originalRequest)
 		defer originalRequest.Body.Close()
@@ -188,35 +304,63 @@ func createServerHandler(h eventHandler) func(http.ResponseWriter, *http.Request
 			return
 		}
 		originalBodyString := string(originalBody)
+		if proxyCassette != nil {
+			if event, ok := proxyCassette.lookup(originalRequest, originalBodyString); ok {
+				log.Printf("Played back event:\n%s %s %s", event.PairID, event.HTTPMethod, event.Endpoint)
+				writeRecordedResponse(wr, event)
+				return
+			}
+		}
+		var fault *faultRule
+		if proxyFaults != nil {
+			fault = proxyFaults.match(originalRequest)
+		}
+		// the upstream never sees requests an injected fault answers, so neither should the shadow
+		var shadow *shadowRequest
+		if proxyShadow != nil && (fault == nil || !fault.aborts()) {
+			shadow = proxyShadow.mirror(originalRequest, originalBodyString)
+			defer shadow.abandon()
+		}
 		request, err := http.NewRequest(originalRequest.Method, newURL, strings.NewReader(originalBodyString))
 		if err != nil {
 			log.Printf("[ERROR] Could not build the outgoing request: %v\n", err)
 			return
 		}
 		request.Header = originalRequest.Header
+		if fault != nil {
+			fault.delay()
+		}
 
-		// 2. Execute proxy request
-		response, err := client.Do(request)
-		if err != nil {
-			log.Printf("[ERROR] Could not process HTTP request to target: %v\n", err)
-			return
+		// 2. Execute proxy request, unless a fault stands in for the response
+		var response *http.Response
+		var originalRespBody []byte
+		if fault != nil && fault.aborts() {
+			response, originalRespBody = fault.response()
+		} else {
+			response, err = client.Do(request)
+			if err != nil {
+				log.Printf("[ERROR] Could not process HTTP request to target: %v\n", err)
+				return
+			}
+			defer response.Body.Close()
+			originalRespBody, err = ioutil.ReadAll(response.Body)
+			if err != nil {
+				log.Printf("[ERROR] Could not read response body: %v\n", err)
+				return
+			}
 		}
 
 		// 3. Copy data for proxy response
-		for k, v := range response.Header {
-			wr.Header().Set(k, strings.Join(v, ","))
-		}
-		wr.WriteHeader(response.StatusCode)
-		defer response.Body.Close()
-		originalRespBody, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			log.Printf("[ERROR] Could not read response body: %v\n", err)
-			return
-		}
-		_, err = io.Copy(wr, strings.NewReader(string(originalRespBody)))
-		if err != nil {
-			log.Printf("[ERROR] Could not create copy of response body: %v\n", err)
-			return
+		if fault != nil {
+			originalRespBody = fault.write(wr, response, originalRespBody)
+		} else {
+			copyResponseHeaders(wr, response)
+			wr.WriteHeader(response.StatusCode)
+			_, err = io.Copy(wr, strings.NewReader(string(originalRespBody)))
+			if err != nil {
+				log.Printf("[ERROR] Could not create copy of response body: %v\n", err)
+				return
+			}
 		}
 		originalRespBodyString := string(originalRespBody)
 		// 4. Parse request + response data and pass on to event handler
@@ -225,32 +369,142 @@ func createServerHandler(h eventHandler) func(http.ResponseWriter, *http.Request
 			log.Printf("[ERROR] Could not convert request and response: %v\n", err)
 			return
 		}
+		event.Timestamp = receivedAt.UnixNano() / int64(time.Millisecond)
+		if fault != nil {
+			event.Fault = fault.describe()
+		}
+		// injected faults would make everything look volatile
+		if proxyLearner != nil && fault == nil {
+			proxyLearner.learn(&event, fmt.Sprintf("%s://%s", request.URL.Scheme, request.URL.Host))
+		}
+		validateAgainstSpec(&event)
 
 		log.Printf("Saw event:\n%s %s %s", event.PairID, event.HTTPMethod, event.Endpoint)
+		// a faulted response would be played back as if the upstream had sent it
+		if proxyCassette != nil && event.Fault == nil {
+			if err := proxyCassette.record(event); err != nil {
+				log.Printf("[ERROR] Could not record event to cassette: %v\n", err)
+			}
+		}
+		if shadow != nil {
+			shadow.pair(event, h)
+			return
+		}
 		h.handleEvent(event)
 	}
 }
 
+// Subcommands parse their own flags and return an exit code.
+// Running without a subcommand starts the recording proxy.
+var subcommands = map[string]func([]string) int{
+	"replay":  runReplay,
+	"mock":    runMock,
+	"load":    runLoad,
+	"consume": runConsume,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(subcommand(os.Args[2:]))
+		}
+	}
+
 	readFlags()
 	telemetry = getTelemetryAgent()
 	go telemetry.logUsage(telemetryUsageOpen)
 
+	if flags.openAPISpec != "" {
+		spec, err := loadOpenAPISpec(flags.openAPISpec)
+		check(err)
+		log.Printf("Validating recorded events against OpenAPI spec %s\n", flags.openAPISpec)
+		apiSpec = spec
+	}
+
+	if flags.mode == modeAuto {
+		c, err := loadCassette(flags.cassette, mockMatcher{strictness: flags.match, headers: flags.matchHeaders})
+		check(err)
+		log.Printf("Running in AUTO mode, playing back from + recording to cassette %s\n", flags.cassette)
+		proxyCassette = c
+	}
+
+	if flags.faults != "" {
+		faults, err := loadFaultRules(flags.faults)
+		check(err)
+		log.Printf("Injecting faults from %s\n", flags.faults)
+		proxyFaults = faults
+	}
+
+	if flags.learn != "" {
+		log.Printf("Learning volatile response fields (%s)\n", flags.learn)
+		proxyLearner = newLearner(flags.learn)
+	}
+
 	var h eventHandler
-	if len(flags.streamName) > 0 {
-		if len(flags.streamRoleArn) == 0 {
-			log.Println("AWS Kinesis Stream ARN and name required for streaming mode")
-			os.Exit(1)
+	if flags.sinks != "" {
+		if len(flags.streamName) > 0 {
+			log.Fatal("--sinks and --stream-name can't be used together, add a kinesis sink to the sinks file instead")
 		}
+		sinks, err := loadSinks(flags.sinks)
+		check(err)
+		log.Printf("Sending recorded events to %d sinks from %s\n", len(sinks.runners), flags.sinks)
+		h = sinks
+	} else if len(flags.streamName) > 0 {
 		log.Println("Running ONLINE, sending recorded events to Kinesis")
-		h = getOnlineHandler(flags.streamName, flags.streamRoleArn)
+		online, err := newOnlineHandler(onlineConfig{
+			StreamName:     flags.streamName,
+			StreamRoleArn:  flags.streamRoleArn,
+			FlushInterval:  flags.streamFlush,
+			KPLAggregate:   flags.kplAggregate,
+			PartitionKey:   flags.partitionKey,
+			Compression:    flags.compression,
+			EncryptKMSKey:  flags.encryptKMSKey,
+			EncryptKeyFile: flags.encryptKeyFile,
+			SpoolDir:       flags.spoolDir,
+			SpoolMaxSize:   flags.spoolMaxSize,
+			SpoolFull:      flags.spoolFull,
+			QueueSize:      flags.queueSize,
+			QueueWorkers:   flags.queueWorkers,
+			QueueFull:      flags.queueFull,
+			StatsInterval:  flags.streamStats,
+		})
+		check(err)
+		h = online
 	} else {
 		log.Printf("Running OFFLINE, writing out events to %s files\n", flags.template)
 		h = getOfflineHandler(flags.template, flags.extension)
 	}
 
+	if flags.shadowTarget != "" {
+		engine, err := flags.shadowDiff.engine()
+		check(err)
+		var report io.Writer
+		if flags.shadowReport != "" {
+			f, err := os.OpenFile(flags.shadowReport, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			check(err)
+			defer f.Close()
+			report = f
+		}
+		log.Printf("Shadowing requests to %s\n", flags.shadowTarget)
+		if flags.shadowTimeout <= 0 {
+			log.Fatal("--shadow-timeout must be positive")
+		}
+		proxyShadow = newShadower(flags.shadowTarget, flags.shadowTimeout, engine, report)
+	}
+
+	if flags.junit != "" || flags.summaryJSON != "" {
+		proxyReport = &reportCollector{}
+	}
+
 	shutdown.Add(func() {
 		log.Println("Cleaning up...")
+		if proxyShadow != nil {
+			proxyShadow.wait(flags.shadowTimeout + 5*time.Second)
+			log.Println(proxyShadow.summary())
+		}
+		if proxyReport != nil {
+			logErr(writeReports(flags.junit, flags.summaryJSON, proxyReport.snapshot()))
+		}
 		h.flushBuffer()
 	})
 
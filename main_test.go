@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"testing"
 )
 
@@ -11,3 +12,35 @@ func TestCheck(t *testing.T) {
 func TestLogError(t *testing.T) {
 	logErr(nil)
 }
+
+func TestIsBuiltinTemplate(t *testing.T) {
+	for _, name := range []string{"karate", "gatling", "k6", "go", "jmeter", "hurl", "http", "jsonl"} {
+		if !isBuiltinTemplate(name) {
+			t.Errorf("Expected %s to be a built-in template", name)
+		}
+	}
+	if isBuiltinTemplate("./custom.template") {
+		t.Error("Expected a template path not to be a built-in template")
+	}
+}
+
+func TestBuildNewTargetURL(t *testing.T) {
+	flags.defaultTargetPort = 8080
+	var targetTests = []struct {
+		in       string
+		expected string
+	}{
+		{"/path/to", "http://localhost:8080/path/to"},
+		{"/path/to?a=1&b=2", "http://localhost:8080/path/to?a=1&b=2"},
+		{"http://localhost:9999/other", "http://localhost:9999/other"},
+	}
+	for _, tt := range targetTests {
+		req, err := http.NewRequest("GET", tt.in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := buildNewTargetURL(req); actual != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, actual)
+		}
+	}
+}
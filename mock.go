@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	flag "github.com/spf13/pflag"
+)
+
+// How closely an incoming request has to match a recording
+const (
+	matchPath  = "path"  // method + path
+	matchQuery = "query" // method + path + query parameters
+	matchBody  = "body"  // method + path + query parameters + body
+)
+
+// What to serve when several recordings match the same request
+const (
+	playbackSequential = "sequential"  // each in recorded order, then repeat the last
+	playbackRoundRobin = "round-robin" // each in recorded order, then start over
+)
+
+// mockMatcher decides whether a recorded event can answer an incoming request
+type mockMatcher struct {
+	strictness string
+	headers    []string
+}
+
+// mockServer serves recorded responses for matching requests
+type mockServer struct {
+	matcher  mockMatcher
+	playback string
+
+	mu     sync.Mutex
+	events []HTTPEvent
+	// times each set of matching recordings has been served
+	served map[string]int
+}
+
+func newMockServer(events []HTTPEvent, matcher mockMatcher, playback string) *mockServer {
+	return &mockServer{
+		matcher:  matcher,
+		playback: playback,
+		events:   events,
+		served:   map[string]int{},
+	}
+}
+
+// runMock implements `replay-zero mock`, returning the process exit code
+func runMock(args []string) int {
+	fs := flag.NewFlagSet("mock", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of replay-zero mock:\n  replay-zero mock [flags] recording.jsonl...\n")
+		fs.PrintDefaults()
+	}
+	listen := fs.String("listen", "localhost:8080", "Address the mock server listens on")
+	matcher := mockMatcher{}
+	fs.StringVar(&matcher.strictness, "match", matchQuery, "What has to match a recording: [path], [query] or [body] (each includes the ones before it)")
+	fs.StringSliceVar(&matcher.headers, "match-header", nil, "Request header that also has to match a recording (repeatable)")
+	playback := fs.String("playback", playbackSequential, "How to serve repeated requests: [sequential] or [round-robin]")
+	fs.BoolVar(&flags.debug, "debug", false, "Set logging to also print debug messages")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := validateMockOptions(matcher.strictness, *playback); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	events, err := readRecordings(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	log.Printf("Serving %d recorded events on %s\n", len(events), *listen)
+	if err := http.ListenAndServe(*listen, newMockServer(events, matcher, *playback)); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func validateMockOptions(strictness, playback string) error {
+	switch strictness {
+	case matchPath, matchQuery, matchBody:
+	default:
+		return fmt.Errorf("Unknown match strictness %q, expected one of [path, query, body]", strictness)
+	}
+	switch playback {
+	case playbackSequential, playbackRoundRobin:
+	default:
+		return fmt.Errorf("Unknown playback mode %q, expected one of [sequential, round-robin]", playback)
+	}
+	return nil
+}
+
+func (m *mockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("replay-zero mock: could not read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	event, ok := m.findMatch(r, string(body))
+	if !ok {
+		logDebug("No recording matches %s %s", r.Method, r.URL.RequestURI())
+		http.Error(w, m.diagnose(r, string(body)), http.StatusNotFound)
+		return
+	}
+	logDebug("Serving recording %s for %s %s", event.PairID, r.Method, r.URL.RequestURI())
+	writeRecordedResponse(w, event)
+}
+
+// findMatch picks the recording to answer a request with, according to
+// the playback mode when there is more than one candidate
+func (m *mockServer) findMatch(r *http.Request, body string) (HTTPEvent, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	candidates := []int{}
+	for i, event := range m.events {
+		if m.matcher.mismatch(event, r, body) == "" {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return HTTPEvent{}, false
+	}
+
+	key := fmt.Sprint(candidates)
+	count := m.served[key]
+	m.served[key] = count + 1
+	if m.playback == playbackRoundRobin {
+		return m.events[candidates[count%len(candidates)]], true
+	}
+	return m.events[candidates[min(count, len(candidates)-1)]], true
+}
+
+// addEvent makes a new recording available to later requests
+func (m *mockServer) addEvent(event HTTPEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+}
+
+// mismatch returns the reason a recording can't answer a request, or "" if it can
+func (mm mockMatcher) mismatch(event HTTPEvent, r *http.Request, body string) string {
+	if !strings.EqualFold(event.HTTPMethod, r.Method) {
+		return "method differs"
+	}
+	if event.Endpoint != r.URL.Path {
+		return "path differs"
+	}
+	if mm.strictness == matchQuery || mm.strictness == matchBody {
+		recorded, _ := url.ParseQuery(event.Query)
+		incoming := r.URL.Query()
+		if len(recorded) != 0 || len(incoming) != 0 {
+			if !reflect.DeepEqual(recorded, incoming) {
+				return fmt.Sprintf("query differs (recorded %q)", event.Query)
+			}
+		}
+	}
+	if mm.strictness == matchBody && len(defaultDiffEngine.diffBodies(event.ReqBody, body)) > 0 {
+		return "body differs"
+	}
+	for _, name := range mm.headers {
+		if findHeader(event.ReqHeaders, name) != r.Header.Get(name) {
+			return fmt.Sprintf("header %s differs", http.CanonicalHeaderKey(name))
+		}
+	}
+	return ""
+}
+
+// diagnose explains why no recording matched, listing the
+// recordings for the same path (if any) and why each was skipped
+func (m *mockServer) diagnose(r *http.Request, body string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "replay-zero mock: no recording matches %s %s (match=%s)\n", r.Method, r.URL.RequestURI(), m.matcher.strictness)
+	nearMisses := 0
+	for _, event := range m.events {
+		if event.Endpoint != r.URL.Path {
+			continue
+		}
+		if nearMisses == 0 {
+			b.WriteString("Recordings for the same path:\n")
+		}
+		nearMisses++
+		fmt.Fprintf(&b, "  %s %s: %s\n", event.HTTPMethod, event.PairID, m.matcher.mismatch(event, r, body))
+	}
+	if nearMisses == 0 {
+		fmt.Fprintf(&b, "None of the %d recordings are for path %s\n", len(m.events), r.URL.Path)
+	}
+	return b.String()
+}
+
+func writeRecordedResponse(w http.ResponseWriter, event HTTPEvent) {
+	for _, h := range event.RespHeaders {
+		// the body is written in one go, so let net/http frame it
+		if clientManagedHeaders[http.CanonicalHeaderKey(h.Name)] {
+			continue
+		}
+		w.Header().Set(h.Name, h.Value)
+	}
+	status, err := strconv.Atoi(event.ResponseCode)
+	if err != nil {
+		log.Printf("[ERROR] Recording %s has an invalid status %q, serving 200\n", event.PairID, event.ResponseCode)
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(event.RespBody)); err != nil {
+		logErr(err)
+	}
+}
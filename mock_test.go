@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func mockEvent(id, method, endpoint, query, reqBody, respBody string) HTTPEvent {
+	return HTTPEvent{
+		PairID:       id,
+		HTTPMethod:   method,
+		Endpoint:     endpoint,
+		Query:        query,
+		ReqHeaders:   []Header{{Name: "X-Tenant", Value: "a"}},
+		ReqBody:      reqBody,
+		RespHeaders:  []Header{{Name: "Content-Type", Value: "application/json"}, {Name: "Content-Length", Value: "999"}},
+		RespBody:     respBody,
+		ResponseCode: "201",
+	}
+}
+
+func serveMock(m *mockServer, method, target, body string, headers ...Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for _, h := range headers {
+		r.Header.Set(h.Name, h.Value)
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	return w
+}
+
+func TestMockServerMatching(t *testing.T) {
+	events := []HTTPEvent{
+		mockEvent("get", "GET", "/users", "page=1&size=10", "", `[1]`),
+		mockEvent("post", "POST", "/users", "", `{"name": "a", "age": 1}`, `{"id": 1}`),
+	}
+
+	var matchTests = []struct {
+		name       string
+		matcher    mockMatcher
+		method     string
+		target     string
+		body       string
+		headers    []Header
+		expectedID string
+	}{
+		{"query order doesn't matter", mockMatcher{strictness: matchQuery}, "GET", "/users?size=10&page=1", "", nil, "get"},
+		{"query differs", mockMatcher{strictness: matchQuery}, "GET", "/users?page=2&size=10", "", nil, ""},
+		{"query ignored", mockMatcher{strictness: matchPath}, "GET", "/users?page=2", "", nil, "get"},
+		{"method differs", mockMatcher{strictness: matchPath}, "DELETE", "/users", "", nil, ""},
+		{"path differs", mockMatcher{strictness: matchPath}, "GET", "/groups", "", nil, ""},
+		{"body ignored", mockMatcher{strictness: matchQuery}, "POST", "/users", `{"name": "b"}`, nil, "post"},
+		{"JSON body reordered", mockMatcher{strictness: matchBody}, "POST", "/users", `{"age": 1, "name": "a"}`, nil, "post"},
+		{"body differs", mockMatcher{strictness: matchBody}, "POST", "/users", `{"name": "b"}`, nil, ""},
+		{"header matches", mockMatcher{strictness: matchPath, headers: []string{"x-tenant"}}, "POST", "/users", "", []Header{{Name: "X-Tenant", Value: "a"}}, "post"},
+		{"header differs", mockMatcher{strictness: matchPath, headers: []string{"x-tenant"}}, "POST", "/users", "", []Header{{Name: "X-Tenant", Value: "b"}}, ""},
+	}
+
+	for _, tt := range matchTests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockServer(events, tt.matcher, playbackSequential)
+			w := serveMock(m, tt.method, tt.target, tt.body, tt.headers...)
+			if tt.expectedID == "" {
+				if w.Code != http.StatusNotFound {
+					t.Errorf("Expected 404, got %d", w.Code)
+				}
+				return
+			}
+			if w.Code != 201 {
+				t.Fatalf("Expected recorded status 201, got %d: %s", w.Code, w.Body.String())
+			}
+			for _, event := range events {
+				if event.PairID == tt.expectedID && w.Body.String() != event.RespBody {
+					t.Errorf("Expected body of recording %s, got %s", tt.expectedID, w.Body.String())
+				}
+			}
+			if w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("Expected the recorded Content-Type, got %q", w.Header().Get("Content-Type"))
+			}
+			if w.Header().Get("Content-Length") == "999" {
+				t.Error("Expected the recorded Content-Length to be dropped")
+			}
+		})
+	}
+}
+
+func TestMockServerPlayback(t *testing.T) {
+	events := []HTTPEvent{
+		mockEvent("1", "GET", "/counter", "", "", "1"),
+		mockEvent("other", "GET", "/other", "", "", "other"),
+		mockEvent("2", "GET", "/counter", "", "", "2"),
+	}
+	var playbackTests = []struct {
+		playback string
+		expected []string
+	}{
+		{playbackSequential, []string{"1", "2", "2", "2"}},
+		{playbackRoundRobin, []string{"1", "2", "1", "2"}},
+	}
+	for _, tt := range playbackTests {
+		t.Run(tt.playback, func(t *testing.T) {
+			m := newMockServer(events, mockMatcher{strictness: matchQuery}, tt.playback)
+			for i, expected := range tt.expected {
+				if body := serveMock(m, "GET", "/counter", "").Body.String(); body != expected {
+					t.Errorf("Request %d: expected %s, got %s", i, expected, body)
+				}
+			}
+		})
+	}
+}
+
+func TestMockServerDiagnostics(t *testing.T) {
+	events := []HTTPEvent{
+		mockEvent("get", "GET", "/users", "page=1", "", ""),
+		mockEvent("post", "POST", "/users", "", "", ""),
+	}
+	m := newMockServer(events, mockMatcher{strictness: matchQuery}, playbackSequential)
+
+	body := serveMock(m, "GET", "/users?page=2", "").Body.String()
+	for _, expected := range []string{
+		"no recording matches GET /users?page=2 (match=query)",
+		`GET get: query differs (recorded "page=1")`,
+		"POST post: method differs",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected diagnostic to contain %q, got:\n%s", expected, body)
+		}
+	}
+
+	body = serveMock(m, "GET", "/nothing", "").Body.String()
+	if !strings.Contains(body, "None of the 2 recordings are for path /nothing") {
+		t.Errorf("Unexpected diagnostic:\n%s", body)
+	}
+}
+
+func TestWriteRecordedResponseBadStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeRecordedResponse(w, HTTPEvent{ResponseCode: "abc", RespBody: "ok"})
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("Expected a 200 fallback, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestValidateMockOptions(t *testing.T) {
+	if err := validateMockOptions(matchBody, playbackRoundRobin); err != nil {
+		t.Errorf("Expected valid options, got %v", err)
+	}
+	if err := validateMockOptions("exact", playbackSequential); err == nil {
+		t.Error("Expected an error for an unknown strictness, but got <nil>")
+	}
+	if err := validateMockOptions(matchPath, "random"); err == nil {
+		t.Error("Expected an error for an unknown playback mode, but got <nil>")
+	}
+	if code := runMock([]string{"--match", "exact", "recording.jsonl"}); code != 2 {
+		t.Errorf("Expected exit code 2 for invalid options, got %d", code)
+	}
+	if code := runMock([]string{"does/not/exist.jsonl"}); code != 1 {
+		t.Errorf("Expected exit code 1 for a missing recording, got %d", code)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"go/format"
 	"io"
 	"log"
 	"os"
@@ -9,8 +11,6 @@ import (
 	"strconv"
 	"strings"
 	"text/template"
-
-	"github.com/Masterminds/sprig"
 )
 
 const (
@@ -22,6 +22,37 @@ type writerFactory func(*offlineHandler) io.Writer
 type outputFormat struct {
 	template  string
 	extension string
+	// appended to the file name before the extension (ex. "_test")
+	nameSuffix string
+	// run the rendered output through gofmt before writing it out
+	gofmt bool
+}
+
+// gofmtWriter buffers rendered Go source and writes it
+// out formatted once the template has finished executing
+type gofmtWriter struct {
+	buffer bytes.Buffer
+	out    io.WriteCloser
+}
+
+func (w *gofmtWriter) Write(p []byte) (int, error) {
+	return w.buffer.Write(p)
+}
+
+// Close formats and flushes the buffered source. If the source can't be
+// parsed it's written as-is so that no recorded data is lost.
+func (w *gofmtWriter) Close() error {
+	src := w.buffer.Bytes()
+	formatted, err := format.Source(src)
+	if err != nil {
+		log.Printf("[ERROR] Could not gofmt generated file, writing it unformatted: %v\n", err)
+		formatted = src
+	}
+	_, err = w.out.Write(formatted)
+	if closeErr := w.out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 type offlineHandler struct {
@@ -30,8 +61,10 @@ type offlineHandler struct {
 	defaultBatchSize int
 	currentBatchSize int
 	numWrites        int
-	writerFactory    writerFactory
-	templateFuncMap  template.FuncMap
+	// Where files are written, outDir when empty
+	dir             string
+	writerFactory   writerFactory
+	templateFuncMap template.FuncMap
 }
 
 func getOfflineHandler(template string, extension string) eventHandler {
@@ -40,7 +73,7 @@ func getOfflineHandler(template string, extension string) eventHandler {
 		defaultBatchSize: flags.batchSize,
 		currentBatchSize: flags.batchSize,
 		writerFactory:    getFileWriter,
-		templateFuncMap:  sprig.TxtFuncMap(),
+		templateFuncMap:  getTemplateFuncMap(),
 	}
 }
 
@@ -85,7 +118,7 @@ func (h *offlineHandler) readReplayHeaders(headers []Header) []Header {
 }
 
 func (h *offlineHandler) getNextFileName() string {
-	return fmt.Sprintf("replay_scenarios_%d.%s", h.numWrites, h.format.extension)
+	return fmt.Sprintf("replay_scenarios_%d%s.%s", h.numWrites, h.format.nameSuffix, h.format.extension)
 }
 
 func getFileWriter(h *offlineHandler) io.Writer {
@@ -94,12 +127,19 @@ func getFileWriter(h *offlineHandler) io.Writer {
 		return nil
 	}
 	fileName := h.getNextFileName()
-	out := filepath.Join(outDir, fileName)
+	dir := h.dir
+	if dir == "" {
+		dir = outDir
+	}
+	out := filepath.Join(dir, fileName)
 	f, err := os.Create(out)
 	if err != nil {
 		logErr(err)
 		return nil
 	}
+	if h.format.gofmt {
+		return &gofmtWriter{out: f}
+	}
 	return f
 }
 
@@ -109,7 +149,14 @@ func (h *offlineHandler) runTemplate() error {
 		return err
 	}
 
-	return t.Execute(h.writerFactory(h), h.buffer)
+	w := h.writerFactory(h)
+	err = t.Execute(w, h.buffer)
+	if closer, ok := w.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 // KarateGen: Write out buffered events in the case of a user-enacted exit (i.e. ctrl+c)
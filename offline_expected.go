@@ -29,6 +29,8 @@ Feature:
 
 	Scenario: test scenario c1487b92-01a0-4b08-b66d-52c597e88e67
 		Given path '/test/api'
+		And param page = '2'
+		And param tag = ['a', 'b c']
 		And header User-Agent = 'curl/7.54.0'
 		And header Accept = '*/*'
 		And header Content-Length = '22'
@@ -94,7 +96,7 @@ val scenario_0: ScenarioBuilder = scenario("scenario_0")
 
 val scenario_1: ScenarioBuilder = scenario("scenario_1")
 	.exec(http("http_1"))
-	.post("/test/api")
+	.post("/test/api?page=2&tag=a&tag=b%20c")
 	.headers(
 		"User-Agent" = "curl/7.54.0",
 		"Accept" = "*/*",
@@ -124,5 +126,365 @@ setUp(
 		global.failedRequests.percent.lessThan(100 - AVAILABILITY_RATE)
 	)
 }
+`
+
+	testK6Expected = `// Generated by Replay Zero at 18 Feb 20 12:22 PST
+import http from 'k6/http';
+import { check, sleep } from 'k6';
+
+const TP99_RESPONSE_TIME = 1600;
+const TP90_RESPONSE_TIME = 800;
+const TP50_RESPONSE_TIME = 600;
+const AVAILABILITY_RATE = 99;
+
+const BASE_URL = __ENV.BASE_URL || 'http://localhost:8080';
+
+export const options = {
+	vus: parseInt(__ENV.VUS || '1'),
+	duration: __ENV.DURATION || '1m',
+	thresholds: {
+		http_req_duration: [
+			'p(99)<' + TP99_RESPONSE_TIME,
+			'p(90)<' + TP90_RESPONSE_TIME,
+			'p(50)<' + TP50_RESPONSE_TIME,
+		],
+		http_req_failed: ['rate<' + (100 - AVAILABILITY_RATE) / 100],
+		checks: ['rate>' + AVAILABILITY_RATE / 100],
+	},
+};
+
+export default function () {
+	let res;
+
+	// c1487b92-01a0-4b08-b66d-52c597e88e67
+	res = http.request(
+		"POST",
+		BASE_URL + "/test/api",
+		"this is a test payload",
+		{
+			headers: {
+				"User-Agent": "curl/7.54.0",
+				"Accept": "*/*",
+			},
+			tags: { name: 'http_0' },
+		}
+	);
+	check(res, {
+		'http_0 status is 200': (r) => r.status === 200,
+	});
+
+	sleep(1.5);
+
+	// c1487b92-01a0-4b08-b66d-52c597e88e67
+	res = http.request(
+		"POST",
+		BASE_URL + "/test/api?page=2\u0026tag=a\u0026tag=b%20c",
+		"this is a test payload",
+		{
+			headers: {
+				"User-Agent": "curl/7.54.0",
+				"Accept": "*/*",
+			},
+			tags: { name: 'http_1' },
+		}
+	);
+	check(res, {
+		'http_1 status is 200': (r) => r.status === 200,
+	});
+}
+`
+
+	testGoExpected = `// Generated by Replay Zero at 18 Feb 20 12:22 PST
+
+// TODO: rename to the package this test lives in
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReplay_c1487b92_01a0_4b08_b66d_52c597e88e67(t *testing.T) {
+	baseURL := os.Getenv("REPLAY_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+
+	// Bodies that are both valid JSON are compared structurally, otherwise byte for byte
+	bodiesEqual := func(expected string, actual []byte) bool {
+		var e, a interface{}
+		if json.Unmarshal([]byte(expected), &e) != nil || json.Unmarshal(actual, &a) != nil {
+			return expected == string(actual)
+		}
+		return reflect.DeepEqual(e, a)
+	}
+
+	scenarios := []struct {
+		name        string
+		method      string
+		path        string
+		reqHeaders  map[string]string
+		reqBody     string
+		status      int
+		respHeaders map[string]string
+		respBody    string
+	}{
+		{
+			name:   "c1487b92-01a0-4b08-b66d-52c597e88e67",
+			method: "POST",
+			path:   "/test/api",
+			reqHeaders: map[string]string{
+				"User-Agent": "curl/7.54.0",
+				"Accept":     "*/*",
+			},
+			reqBody: "this is a test payload",
+			status:  200,
+			respHeaders: map[string]string{
+				"X-Real-Server": "test.server",
+			},
+			respBody: "Test payload back atcha",
+		},
+		{
+			name:   "c1487b92-01a0-4b08-b66d-52c597e88e67",
+			method: "POST",
+			path:   "/test/api?page=2&tag=a&tag=b%20c",
+			reqHeaders: map[string]string{
+				"User-Agent": "curl/7.54.0",
+				"Accept":     "*/*",
+			},
+			reqBody: "this is a test payload",
+			status:  200,
+			respHeaders: map[string]string{
+				"X-Real-Server": "test.server",
+			},
+			respBody: "Test payload back atcha",
+		},
+	}
+
+	for _, sc := range scenarios {
+		sc := sc
+		t.Run(sc.name, func(t *testing.T) {
+			req, err := http.NewRequest(sc.method, baseURL+sc.path, bytes.NewBufferString(sc.reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range sc.reqHeaders {
+				req.Header.Set(k, v)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != sc.status {
+				t.Errorf("Expected status %d, got %d", sc.status, resp.StatusCode)
+			}
+			for k, v := range sc.respHeaders {
+				if actual := resp.Header.Get(k); actual != v {
+					t.Errorf("Expected header %s=%q, got %q", k, v, actual)
+				}
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bodiesEqual(sc.respBody, body) {
+				t.Errorf("Expected body:\n%s\ngot:\n%s", sc.respBody, body)
+			}
+		})
+	}
+}
+`
+
+	testJMeterExpected = `<?xml version="1.0" encoding="UTF-8"?>
+<!-- Generated by Replay Zero at 18 Feb 20 12:22 PST -->
+<jmeterTestPlan version="1.2" properties="5.0" jmeter="5.3">
+  <hashTree>
+    <TestPlan guiclass="TestPlanGui" testclass="TestPlan" testname="Replay Zero" enabled="true">
+      <boolProp name="TestPlan.functional_mode">false</boolProp>
+      <boolProp name="TestPlan.serialize_threadgroups">false</boolProp>
+      <elementProp name="TestPlan.user_defined_variables" elementType="Arguments" guiclass="ArgumentsPanel" testclass="Arguments" testname="User Defined Variables" enabled="true">
+        <collectionProp name="Arguments.arguments">
+          <elementProp name="host" elementType="Argument">
+            <stringProp name="Argument.name">host</stringProp>
+            <stringProp name="Argument.value">${__P(host,localhost)}</stringProp>
+            <stringProp name="Argument.metadata">=</stringProp>
+          </elementProp>
+          <elementProp name="port" elementType="Argument">
+            <stringProp name="Argument.name">port</stringProp>
+            <stringProp name="Argument.value">${__P(port,8080)}</stringProp>
+            <stringProp name="Argument.metadata">=</stringProp>
+          </elementProp>
+          <elementProp name="protocol" elementType="Argument">
+            <stringProp name="Argument.name">protocol</stringProp>
+            <stringProp name="Argument.value">${__P(protocol,http)}</stringProp>
+            <stringProp name="Argument.metadata">=</stringProp>
+          </elementProp>
+        </collectionProp>
+      </elementProp>
+    </TestPlan>
+    <hashTree>
+      <ThreadGroup guiclass="ThreadGroupGui" testclass="ThreadGroup" testname="Replay Zero Thread Group" enabled="true">
+        <stringProp name="ThreadGroup.on_sample_error">continue</stringProp>
+        <elementProp name="ThreadGroup.main_controller" elementType="LoopController" guiclass="LoopControlPanel" testclass="LoopController" testname="Loop Controller" enabled="true">
+          <boolProp name="LoopController.continue_forever">false</boolProp>
+          <stringProp name="LoopController.loops">${__P(loops,1)}</stringProp>
+        </elementProp>
+        <stringProp name="ThreadGroup.num_threads">${__P(threads,1)}</stringProp>
+        <stringProp name="ThreadGroup.ramp_time">${__P(rampup,1)}</stringProp>
+        <boolProp name="ThreadGroup.scheduler">false</boolProp>
+      </ThreadGroup>
+      <hashTree>
+        <HTTPSamplerProxy guiclass="HttpTestSampleGui" testclass="HTTPSamplerProxy" testname="http_0 POST /test/api" enabled="true">
+          <boolProp name="HTTPSampler.postBodyRaw">true</boolProp>
+          <elementProp name="HTTPsampler.Arguments" elementType="Arguments">
+            <collectionProp name="Arguments.arguments">
+              <elementProp name="" elementType="HTTPArgument">
+                <boolProp name="HTTPArgument.always_encode">false</boolProp>
+                <stringProp name="Argument.value">this is a test payload</stringProp>
+                <stringProp name="Argument.metadata">=</stringProp>
+              </elementProp>
+            </collectionProp>
+          </elementProp>
+          <stringProp name="HTTPSampler.domain">${host}</stringProp>
+          <stringProp name="HTTPSampler.port">${port}</stringProp>
+          <stringProp name="HTTPSampler.protocol">${protocol}</stringProp>
+          <stringProp name="HTTPSampler.path">/test/api</stringProp>
+          <stringProp name="HTTPSampler.method">POST</stringProp>
+          <boolProp name="HTTPSampler.follow_redirects">false</boolProp>
+          <boolProp name="HTTPSampler.auto_redirects">false</boolProp>
+          <boolProp name="HTTPSampler.use_keepalive">true</boolProp>
+        </HTTPSamplerProxy>
+        <hashTree>
+          <HeaderManager guiclass="HeaderPanel" testclass="HeaderManager" testname="HTTP Header Manager" enabled="true">
+            <collectionProp name="HeaderManager.headers">
+              <elementProp name="" elementType="Header">
+                <stringProp name="Header.name">User-Agent</stringProp>
+                <stringProp name="Header.value">curl/7.54.0</stringProp>
+              </elementProp>
+              <elementProp name="" elementType="Header">
+                <stringProp name="Header.name">Accept</stringProp>
+                <stringProp name="Header.value">*/*</stringProp>
+              </elementProp>
+            </collectionProp>
+          </HeaderManager>
+          <hashTree/>
+          <ResponseAssertion guiclass="AssertionGui" testclass="ResponseAssertion" testname="Response Status" enabled="true">
+            <collectionProp name="Asserion.test_strings">
+              <stringProp name="status">200</stringProp>
+            </collectionProp>
+            <stringProp name="Assertion.test_field">Assertion.response_code</stringProp>
+            <boolProp name="Assertion.assume_success">false</boolProp>
+            <intProp name="Assertion.test_type">8</intProp>
+          </ResponseAssertion>
+          <hashTree/>
+        </hashTree>
+        <HTTPSamplerProxy guiclass="HttpTestSampleGui" testclass="HTTPSamplerProxy" testname="http_1 POST /test/api" enabled="true">
+          <boolProp name="HTTPSampler.postBodyRaw">true</boolProp>
+          <elementProp name="HTTPsampler.Arguments" elementType="Arguments">
+            <collectionProp name="Arguments.arguments">
+              <elementProp name="" elementType="HTTPArgument">
+                <boolProp name="HTTPArgument.always_encode">false</boolProp>
+                <stringProp name="Argument.value">this is a test payload</stringProp>
+                <stringProp name="Argument.metadata">=</stringProp>
+              </elementProp>
+            </collectionProp>
+          </elementProp>
+          <stringProp name="HTTPSampler.domain">${host}</stringProp>
+          <stringProp name="HTTPSampler.port">${port}</stringProp>
+          <stringProp name="HTTPSampler.protocol">${protocol}</stringProp>
+          <stringProp name="HTTPSampler.path">/test/api?page=2&amp;tag=a&amp;tag=b%20c</stringProp>
+          <stringProp name="HTTPSampler.method">POST</stringProp>
+          <boolProp name="HTTPSampler.follow_redirects">false</boolProp>
+          <boolProp name="HTTPSampler.auto_redirects">false</boolProp>
+          <boolProp name="HTTPSampler.use_keepalive">true</boolProp>
+        </HTTPSamplerProxy>
+        <hashTree>
+          <HeaderManager guiclass="HeaderPanel" testclass="HeaderManager" testname="HTTP Header Manager" enabled="true">
+            <collectionProp name="HeaderManager.headers">
+              <elementProp name="" elementType="Header">
+                <stringProp name="Header.name">User-Agent</stringProp>
+                <stringProp name="Header.value">curl/7.54.0</stringProp>
+              </elementProp>
+              <elementProp name="" elementType="Header">
+                <stringProp name="Header.name">Accept</stringProp>
+                <stringProp name="Header.value">*/*</stringProp>
+              </elementProp>
+            </collectionProp>
+          </HeaderManager>
+          <hashTree/>
+          <ResponseAssertion guiclass="AssertionGui" testclass="ResponseAssertion" testname="Response Status" enabled="true">
+            <collectionProp name="Asserion.test_strings">
+              <stringProp name="status">200</stringProp>
+            </collectionProp>
+            <stringProp name="Assertion.test_field">Assertion.response_code</stringProp>
+            <boolProp name="Assertion.assume_success">false</boolProp>
+            <intProp name="Assertion.test_type">8</intProp>
+          </ResponseAssertion>
+          <hashTree/>
+          <ConstantTimer guiclass="ConstantTimerGui" testclass="ConstantTimer" testname="Recorded think time" enabled="true">
+            <stringProp name="ConstantTimer.delay">1500</stringProp>
+          </ConstantTimer>
+          <hashTree/>
+        </hashTree>
+      </hashTree>
+    </hashTree>
+  </hashTree>
+</jmeterTestPlan>
+`
+
+	testHurlExpected = `# Generated by Replay Zero at 18 Feb 20 12:22 PST
+# Run with: hurl --variable base_url=http://localhost:8080 replay_scenarios_N.hurl
+
+# c1487b92-01a0-4b08-b66d-52c597e88e67
+POST {{base_url}}/test/api
+User-Agent: curl/7.54.0
+Accept: */*
+` + "```" + `
+this is a test payload
+` + "```" + `
+
+HTTP 200
+
+# c1487b92-01a0-4b08-b66d-52c597e88e67
+POST {{base_url}}/test/api?page=2&tag=a&tag=b%20c
+User-Agent: curl/7.54.0
+Accept: */*
+` + "```" + `
+this is a test payload
+` + "```" + `
+
+HTTP 200
+`
+
+	testHTTPExpected = `# Generated by Replay Zero at 18 Feb 20 12:22 PST
+@baseUrl = http://localhost:8080
+
+### c1487b92-01a0-4b08-b66d-52c597e88e67
+# Recorded response: HTTP 200
+POST {{baseUrl}}/test/api
+User-Agent: curl/7.54.0
+Accept: */*
+
+this is a test payload
+
+### c1487b92-01a0-4b08-b66d-52c597e88e67
+# Recorded response: HTTP 200
+POST {{baseUrl}}/test/api?page=2&tag=a&tag=b%20c
+User-Agent: curl/7.54.0
+Accept: */*
+
+this is a test payload
+`
+
+	testJSONLExpected = `{"event_pair_id":"c1487b92-01a0-4b08-b66d-52c597e88e67","http_method":"POST","endpoint":"/test/api","req_headers":[{"name":"User-Agent","value":"curl/7.54.0"},{"name":"Accept","value":"*/*"},{"name":"Content-Length","value":"22"}],"request_body":"this is a test payload","resp_headers":[{"name":"X-Real-Server","value":"test.server"},{"name":"Content-Length","value":"22"},{"name":"Date","value":"Date: Tue, 18 Feb 2020 20:42:12 GMT"}],"response_body":"Test payload back atcha","http_response_code":"200","timestamp":1582058532000}
+{"event_pair_id":"c1487b92-01a0-4b08-b66d-52c597e88e67","http_method":"POST","endpoint":"/test/api","query":"page=2\u0026tag=a\u0026tag=b%20c","req_headers":[{"name":"User-Agent","value":"curl/7.54.0"},{"name":"Accept","value":"*/*"},{"name":"Content-Length","value":"22"}],"request_body":"this is a test payload","resp_headers":[{"name":"X-Real-Server","value":"test.server"},{"name":"Content-Length","value":"22"},{"name":"Date","value":"Date: Tue, 18 Feb 2020 20:42:12 GMT"}],"response_body":"Test payload back atcha","http_response_code":"200","timestamp":1582058533500}
 `
 )
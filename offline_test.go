@@ -3,11 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/xml"
 	"io"
+	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strings"
 	"testing"
 
-	"github.com/Masterminds/sprig"
 	"github.com/intuit/replay-zero/templates"
 	"github.com/kylelemons/godebug/diff"
 )
@@ -97,7 +100,7 @@ func TestReadBadBatchSize(t *testing.T) {
 
 // Table-driven test for validating all templates
 func TestVerifyTemplates(t *testing.T) {
-	testFuncMap := sprig.TxtFuncMap()
+	testFuncMap := getTemplateFuncMap()
 	testFuncMap["now"] = func() string {
 		return "18 Feb 20 12:22 PST"
 	}
@@ -106,11 +109,23 @@ func TestVerifyTemplates(t *testing.T) {
 		name     string
 		template string
 		expected string
+		gofmt    bool
 	}{
-		{"karate", templates.KarateBase, testKarateExpected},
-		{"gatling", templates.GatlingBase, testGatlingExpected},
+		{"karate", templates.KarateBase, testKarateExpected, false},
+		{"gatling", templates.GatlingBase, testGatlingExpected, false},
+		{"k6", templates.K6Base, testK6Expected, false},
+		{"go", templates.GoBase, testGoExpected, true},
+		{"jmeter", templates.JMeterBase, testJMeterExpected, false},
+		{"hurl", templates.HurlBase, testHurlExpected, false},
+		{"http", templates.HTTPBase, testHTTPExpected, false},
+		{"jsonl", templates.JSONLBase, testJSONLExpected, false},
 	}
 
+	// Recorded 1.5s after the first event, for templates that replay think time
+	laterSampleEvent := sampleEvent
+	laterSampleEvent.Timestamp = sampleEvent.Timestamp + 1500
+	laterSampleEvent.Query = "page=2&tag=a&tag=b%20c"
+
 	for _, tt := range templateTests {
 		t.Run(tt.name, func(t *testing.T) {
 			var buff bytes.Buffer
@@ -120,8 +135,11 @@ func TestVerifyTemplates(t *testing.T) {
 					template: tt.template,
 				},
 				// Making sure to test that multiple scenarios don't bunch up against each other
-				buffer: []HTTPEvent{sampleEvent, sampleEvent},
+				buffer: []HTTPEvent{sampleEvent, laterSampleEvent},
 				writerFactory: func(h *offlineHandler) io.Writer {
+					if tt.gofmt {
+						return &gofmtWriter{out: nopWriteCloser{buffWriter}}
+					}
 					return buffWriter
 				},
 				templateFuncMap: testFuncMap,
@@ -144,6 +162,32 @@ func TestVerifyTemplates(t *testing.T) {
 	}
 }
 
+// The binary renders the .template files, while TestVerifyTemplates checks the constants
+func TestTemplateFilesMatchConstants(t *testing.T) {
+	var templateFiles = []struct {
+		file     string
+		template string
+	}{
+		{"karate_default.template", templates.KarateBase},
+		{"gatling_default.template", templates.GatlingBase},
+		{"k6_default.template", templates.K6Base},
+		{"go_default.template", templates.GoBase},
+		{"jmeter_default.template", templates.JMeterBase},
+		{"hurl_default.template", templates.HurlBase},
+		{"http_default.template", templates.HTTPBase},
+		{"jsonl_default.template", templates.JSONLBase},
+	}
+	for _, tt := range templateFiles {
+		contents, err := ioutil.ReadFile(filepath.Join("templates", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if difference := diff.Diff(tt.template, string(contents)); len(difference) != 0 {
+			t.Errorf("Expected %s to match its constant, got\n%s", tt.file, difference)
+		}
+	}
+}
+
 func TestRunTemplateError(t *testing.T) {
 	handler := &offlineHandler{
 		format: outputFormat{
@@ -180,3 +224,80 @@ func TestResetHandler(t *testing.T) {
 		log.Fatalf("Current batch size should be 1, not %d", handler.currentBatchSize)
 	}
 }
+
+func TestGofmtWriter(t *testing.T) {
+	var gofmtTests = []struct {
+		name     string
+		in       string
+		expected string
+	}{
+		{"formats valid source", "package a\nvar  x = map[string]int{\n\"a\": 1,\n\"bbb\": 2,\n}\n", "package a\n\nvar x = map[string]int{\n\t\"a\":   1,\n\t\"bbb\": 2,\n}\n"},
+		{"keeps invalid source", "package a\nfunc {", "package a\nfunc {"},
+	}
+	for _, tt := range gofmtTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			w := &gofmtWriter{out: nopWriteCloser{&buff}}
+			if _, err := w.Write([]byte(tt.in)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if buff.String() != tt.expected {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tt.expected, buff.String())
+			}
+		})
+	}
+}
+
+func TestGetNextFileName(t *testing.T) {
+	handler := offlineHandler{
+		format:    outputFormat{extension: "go", nameSuffix: "_test"},
+		numWrites: 3,
+	}
+	if name := handler.getNextFileName(); name != "replay_scenarios_3_test.go" {
+		t.Errorf("Unexpected file name %s", name)
+	}
+}
+
+func TestJMeterOutputIsWellFormed(t *testing.T) {
+	decoder := xml.NewDecoder(strings.NewReader(testJMeterExpected))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Generated JMX is not well-formed XML: %v", err)
+		}
+	}
+}
+
+func TestHurlTemplateJSONBodies(t *testing.T) {
+	event := sampleEvent
+	event.ReqBody = `{"name": "test"}`
+	event.RespBody = `{"id": 1, "tags": ["a"]}`
+	var buff bytes.Buffer
+	handler := &offlineHandler{
+		format:          outputFormat{template: templates.HurlBase},
+		buffer:          []HTTPEvent{event},
+		writerFactory:   func(h *offlineHandler) io.Writer { return &buff },
+		templateFuncMap: getTemplateFuncMap(),
+	}
+	if err := handler.runTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Accept: */*
+{"name": "test"}
+
+HTTP 200
+[Asserts]
+jsonpath "$.id" == 1
+jsonpath "$.tags" count == 1
+jsonpath "$.tags[0]" == "a"
+`
+	if !strings.HasSuffix(buff.String(), expected) {
+		t.Errorf("Expected output to end with:\n%s\ngot:\n%s", expected, buff.String())
+	}
+}
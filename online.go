@@ -1,41 +1,393 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/intuit/replay-zero/envelope"
+)
+
+// What to do with a recorded event when the send queue is full
+const (
+	queueBlock = "block" // wait for a spot in the queue
+	queueDrop  = "drop"  // drop the event
+	queueSpill = "spill" // write the event straight to the spool (needs --spool-dir)
 )
 
 // EventChunk contains raw event data + metadata if chunking a large event
-type EventChunk struct {
-	ChunkNumber int    `json:"chunkNumber"`
-	NumChunks   int    `json:"numberOfChunks"`
-	UUID        string `json:"uuid"`
-	Data        string `json:"data"`
-}
+type EventChunk = envelope.Chunk
 
 type onlineHandler struct {
 	kinesisStreamName string
 	kinesisHandle     *kinesisWrapper
+	batcher           *recordBatcher
+	partition         partitionStrategy
+	// one of the envelope compression methods, empty for none
+	compression string
+	// set when encrypting events, nil otherwise
+	keys *envelope.DataKeys
+	// set when running with --spool-dir, nil otherwise
+	spool *spool
+	// events waiting for a worker, nil to send events from the proxy's goroutine
+	queue       chan HTTPEvent
+	queuePolicy string
+	// events queued or being sent
+	inFlight int64
+	stats    *streamStats
+}
+
+// spooledRecord is how the records of an event are saved in the spool
+type spooledRecord struct {
+	PartitionKey string          `json:"partitionKey"`
+	Data         json.RawMessage `json:"data"`
+}
+
+// onlineConfig configures streaming to Kinesis, from the flags or a kinesis sink (see sinks.go)
+type onlineConfig struct {
+	StreamName     string        `yaml:"stream_name"`
+	StreamRoleArn  string        `yaml:"stream_role_arn"`
+	FlushInterval  time.Duration `yaml:"flush_interval"`
+	KPLAggregate   bool          `yaml:"kpl_aggregate"`
+	PartitionKey   string        `yaml:"partition_key"`
+	Compression    string        `yaml:"compression"`
+	EncryptKMSKey  string        `yaml:"encrypt_kms_key"`
+	EncryptKeyFile string        `yaml:"encrypt_key_file"`
+	SpoolDir       string        `yaml:"spool_dir"`
+	SpoolMaxSize   string        `yaml:"spool_max_size"`
+	SpoolFull      string        `yaml:"spool_full"`
+	QueueSize      int           `yaml:"queue_size"`
+	QueueWorkers   int           `yaml:"workers"`
+	QueueFull      string        `yaml:"queue_full"`
+	StatsInterval  time.Duration `yaml:"stats_interval"`
+}
+
+// onlineDefaults are the defaults of the streaming flags
+var onlineDefaults = onlineConfig{
+	FlushInterval: time.Second,
+	PartitionKey:  partitionUUID,
+	Compression:   "none",
+	SpoolMaxSize:  "512MB",
+	SpoolFull:     spoolDropOldest,
+	QueueSize:     1000,
+	QueueWorkers:  4,
+	QueueFull:     queueBlock,
+	StatsInterval: time.Minute,
+}
+
+// newOnlineHandler validates config, then connects to the stream and starts sending events
+func newOnlineHandler(config onlineConfig) (*onlineHandler, error) {
+	if config.StreamName == "" || config.StreamRoleArn == "" {
+		return nil, fmt.Errorf("AWS Kinesis Stream ARN and name required for streaming mode")
+	}
+	partition, err := parsePartitionStrategy(config.PartitionKey)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := parseCompression(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newKeyProvider(config.EncryptKMSKey, config.EncryptKeyFile, config.StreamRoleArn)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		if partition, err = partition.hidden(keys); err != nil {
+			return nil, err
+		}
+	}
+	var s *spool
+	if config.SpoolDir != "" {
+		maxSize, err := parseByteSize(config.SpoolMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		if s, err = openSpool(config.SpoolDir, maxSize, config.SpoolFull); err != nil {
+			return nil, err
+		}
+	}
+
+	h := getOnlineHandler(config.StreamName, config.StreamRoleArn, config.FlushInterval, config.KPLAggregate)
+	h.partition = partition
+	h.compression = compression
+	if keys != nil {
+		log.Println("Encrypting events before sending them")
+		h.keys = envelope.NewDataKeys(keys, dataKeyEvents, dataKeyLifetime)
+	}
+	if s != nil {
+		log.Printf("Spooling events to %s before sending them\n", config.SpoolDir)
+		h.spoolTo(s)
+	}
+	if err := h.startQueue(config.QueueSize, config.QueueWorkers, config.QueueFull); err != nil {
+		return nil, err
+	}
+	if config.StatsInterval > 0 {
+		go h.logStats(config.StatsInterval)
+	}
+	return h, nil
 }
 
-func getOnlineHandler(streamName, streamRole string) *onlineHandler {
+func getOnlineHandler(streamName, streamRole string, flushInterval time.Duration, aggregate bool) *onlineHandler {
+	handle := buildClient(streamName, streamRole, log.Printf)
+	stats := &streamStats{}
+	batcher := newRecordBatcher(handle, streamName, flushInterval, aggregate)
+	batcher.stats = stats
 	return &onlineHandler{
 		kinesisStreamName: streamName,
-		kinesisHandle:     buildClient(streamName, streamRole, log.Printf),
+		kinesisHandle:     handle,
+		batcher:           batcher,
+		stats:             stats,
 	}
 }
 
 func (h *onlineHandler) handleEvent(line HTTPEvent) {
 	go telemetry.logUsage(telemetryUsageOnline)
+	if h.queue == nil {
+		h.send(line)
+		return
+	}
+	atomic.AddInt64(&h.inFlight, 1)
+	if h.queuePolicy == queueBlock {
+		h.queue <- line
+		h.stats.count(&h.stats.enqueued)
+		return
+	}
+	select {
+	case h.queue <- line:
+		h.stats.count(&h.stats.enqueued)
+		return
+	default:
+	}
+	atomic.AddInt64(&h.inFlight, -1)
+	if h.queuePolicy == queueSpill {
+		h.stats.count(&h.stats.spilled)
+		h.send(line)
+		return
+	}
+	h.stats.count(&h.stats.dropped)
+	logWarn(fmt.Sprintf("Send queue is full, dropped event %s %s", line.HTTPMethod, line.Endpoint))
+}
+
+// startQueue sends events from worker goroutines, so slow Kinesis calls don't hold the proxy
+func (h *onlineHandler) startQueue(size, workers int, policy string) error {
+	if size <= 0 || workers <= 0 {
+		return fmt.Errorf("Send queue size and workers must be positive, got %d and %d", size, workers)
+	}
+	switch policy {
+	case queueBlock, queueDrop:
+	case queueSpill:
+		if h.spool == nil {
+			return fmt.Errorf("The [spill] queue policy needs a spool, set with --spool-dir")
+		}
+	default:
+		return fmt.Errorf("Unknown queue policy %q, expected one of [block, drop, spill]", policy)
+	}
+	if h.stats == nil {
+		h.stats = &streamStats{}
+	}
+	h.queue = make(chan HTTPEvent, size)
+	h.queuePolicy = policy
+	for i := 0; i < workers; i++ {
+		go func() {
+			for event := range h.queue {
+				h.send(event)
+				atomic.AddInt64(&h.inFlight, -1)
+			}
+		}()
+	}
+	return nil
+}
+
+// send chunks an event, then either spools its records or hands them to the batcher
+func (h *onlineHandler) send(line HTTPEvent) {
+	line.SchemaVersion = eventSchemaVersion
 	lineStr := httpEventToString(line)
-	messages := buildMessages(lineStr)
+	messages, err := buildMessages(lineStr, envelope.Options{Compression: h.compression, Keys: h.keys})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	spooled := []spooledRecord{}
 	for _, m := range messages {
 		log.Println("Sending event with UUID=" + m.UUID)
-		err := h.kinesisHandle.sendToStream(m, flags.streamName)
+		partition := h.partition.key(line, m.UUID)
+		// the record key is all consumers need, and it'd be in the clear next to an encrypted event
+		if h.keys == nil {
+			m.PartitionKey = partition
+		}
+		if h.spool != nil {
+			data, err := json.Marshal(m)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			spooled = append(spooled, spooledRecord{PartitionKey: partition, Data: data})
+			continue
+		}
+		err := h.batcher.add(m, partition)
 		if err != nil {
 			log.Println(err)
 		}
 	}
+	if h.spool != nil {
+		entry, err := json.Marshal(spooled)
+		if err == nil {
+			err = h.spool.append(entry)
+		}
+		logErr(err)
+	}
+}
+
+// parseCompression reads --stream-compression, where "none" is spelled out
+func parseCompression(method string) (string, error) {
+	if method == "none" {
+		return envelope.CompressionNone, nil
+	}
+	return method, envelope.ValidCompression(method)
+}
+
+// spoolTo saves events to the spool before sending them, instead of only keeping them in memory
+func (h *onlineHandler) spoolTo(s *spool) {
+	h.spool = s
+	go s.deliverPartial(h.sendSpooled)
+}
+
+// sendSpooled sends the records of spooled events with as few PutRecords calls
+// as possible, keeping each event's records in the same call when they fit.
+// It stops at the first call that fails and returns how many events were
+// delivered before it, so events already accepted aren't sent again.
+func (h *onlineHandler) sendSpooled(payloads [][]byte) (int, error) {
+	delivered := 0
+	group := []streamRecord{}
+	groupEvents, groupBytes := 0, 0
+	sendGroup := func() error {
+		if err := h.batcher.send(group); err != nil {
+			return err
+		}
+		delivered += groupEvents
+		group, groupEvents, groupBytes = nil, 0, 0
+		return nil
+	}
+	for _, payload := range payloads {
+		spooled := []spooledRecord{}
+		if err := json.Unmarshal(payload, &spooled); err != nil {
+			// retrying would never fix it, so it's counted as delivered to drop it
+			log.Printf("[ERROR] Dropping unreadable spooled event: %v\n", err)
+			spooled = nil
+		}
+		records := []streamRecord{}
+		size := 0
+		for _, r := range spooled {
+			record := streamRecord{partitionKey: r.PartitionKey, data: r.Data}
+			records = append(records, record)
+			size += record.size()
+		}
+		if len(group) > 0 && (len(group)+len(records) > maxBatchRecords || groupBytes+size > maxBatchBytes) {
+			if err := sendGroup(); err != nil {
+				return delivered, err
+			}
+		}
+		group = append(group, records...)
+		groupEvents++
+		groupBytes += size
+	}
+	if err := sendGroup(); err != nil {
+		return delivered, err
+	}
+	return delivered, nil
+}
+
+// drain waits up to timeout for the queue to empty, returning how many events are left
+func (h *onlineHandler) drain(timeout time.Duration) int64 {
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		left := atomic.LoadInt64(&h.inFlight)
+		if left == 0 || time.Now().After(deadline) {
+			return left
+		}
+	}
+}
+
+// logStats logs the queue and send statistics every interval
+func (h *onlineHandler) logStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		log.Println(h.statsSummary())
+	}
 }
 
-// Kinesis: No-op as this handler doesn't buffer anything
-func (h *onlineHandler) flushBuffer() {}
+func (h *onlineHandler) statsSummary() string {
+	depth := 0
+	if h.queue != nil {
+		depth = len(h.queue)
+	}
+	return h.stats.summary(depth, cap(h.queue))
+}
+
+// Kinesis: drains the send queue, then sends the records still waiting for a
+// batch or gives the spool some time to empty
+func (h *onlineHandler) flushBuffer() {
+	if h.queue != nil {
+		if left := h.drain(30 * time.Second); left > 0 {
+			log.Printf("Gave up waiting for %d queued events\n", left)
+		}
+		log.Println(h.statsSummary())
+	}
+	if h.spool != nil {
+		if left := h.spool.wait(10 * time.Second); left > 0 {
+			log.Printf("%d events are still spooled in %s, they will be sent on the next run\n", left, h.spool.dir)
+		}
+		return
+	}
+	if h.batcher != nil {
+		logErr(h.batcher.flush())
+	}
+}
+
+// streamStats counts what happened to recorded events on their way to the stream
+type streamStats struct {
+	mu       sync.Mutex
+	enqueued int
+	dropped  int
+	spilled  int
+	// PutRecords calls and how long they took (retries included)
+	sends    int
+	sendTime time.Duration
+	maxSend  time.Duration
+}
+
+// count increments one of the counters
+func (s *streamStats) count(counter *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*counter++
+}
+
+func (s *streamStats) recordSend(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sends++
+	s.sendTime += d
+	if d > s.maxSend {
+		s.maxSend = d
+	}
+}
+
+func (s *streamStats) summary(depth, capacity int) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var mean time.Duration
+	if s.sends > 0 {
+		mean = s.sendTime / time.Duration(s.sends)
+	}
+	return fmt.Sprintf("Stream: queue=%d/%d enqueued=%d dropped=%d spilled=%d | PutRecords calls=%d latency mean=%s max=%s",
+		depth, capacity, s.enqueued, s.dropped, s.spilled, s.sends, mean.Round(time.Millisecond), s.maxSend.Round(time.Millisecond))
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/intuit/replay-zero/envelope"
 )
 
 // - - - - - - - - - - - - -
@@ -22,14 +29,321 @@ func TestHandleEvent(t *testing.T) {
 	testHandler := &onlineHandler{
 		kinesisStreamName: "test",
 		kinesisHandle:     wrapper,
+		batcher:           newRecordBatcher(wrapper, "test", 0, false),
+	}
+
+	onlineSampleEvent := generateSampleEvent()
+	onlineSampleEvent.ReqBody = randomStringWithLength(1.5 * maxRecordBytes)
+
+	testHandler.handleEvent(onlineSampleEvent)
+	if mockKinesis.timesCalled != 0 {
+		t.Errorf("Expected records to wait for a batch, but Kinesis was called %d times", mockKinesis.timesCalled)
+	}
+	testHandler.flushBuffer()
+	if mockKinesis.timesCalled != 1 || len(mockKinesis.putRecords[0]) != 2 {
+		t.Errorf("Expected both chunks in a single PutRecords call, got %d calls", mockKinesis.timesCalled)
+	}
+}
+
+func TestHandleEventCompressed(t *testing.T) {
+	mockKinesis := &mockKinesisClient{}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	testHandler := &onlineHandler{
+		kinesisStreamName: "test",
+		kinesisHandle:     wrapper,
+		batcher:           newRecordBatcher(wrapper, "test", 0, false),
+		compression:       envelope.CompressionZstd,
+	}
+
+	onlineSampleEvent := generateSampleEvent()
+	onlineSampleEvent.ReqBody = strings.Repeat(`{"item":"widget","quantity":1},`, maxRecordBytes/10)
+	testHandler.handleEvent(onlineSampleEvent)
+	testHandler.flushBuffer()
+	if mockKinesis.timesCalled != 1 || len(mockKinesis.putRecords[0]) != 1 {
+		t.Fatalf("Expected the compressed event to fit in a single record, got %d calls", mockKinesis.timesCalled)
+	}
+
+	chunk, err := envelope.Decode(mockKinesis.putRecords[0][0].Data)
+	if err != nil || chunk.Compression != envelope.CompressionZstd {
+		t.Fatalf("Expected a zstd compressed chunk, got %+v %v", chunk, err)
+	}
+	line, ok := newChunkAssembler(time.Minute).add(chunk, time.Now())
+	event := HTTPEvent{}
+	if err := json.Unmarshal(line, &event); !ok || err != nil || event.ReqBody != onlineSampleEvent.ReqBody {
+		t.Errorf("Expected the event to decompress back, got %d bytes %v", len(line), err)
+	}
+}
+
+func TestHandleEventEncrypted(t *testing.T) {
+	keyFile, cleanup := writeKeyFile(t)
+	defer cleanup()
+	keys, err := envelope.LoadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockKinesis := &mockKinesisClient{}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	testHandler := &onlineHandler{
+		kinesisStreamName: "test",
+		kinesisHandle:     wrapper,
+		batcher:           newRecordBatcher(wrapper, "test", 0, false),
+		compression:       envelope.CompressionGzip,
+		keys:              envelope.NewDataKeys(keys, dataKeyEvents, dataKeyLifetime),
+	}
+
+	onlineSampleEvent := generateSampleEvent()
+	onlineSampleEvent.ReqBody = "secret"
+	testHandler.handleEvent(onlineSampleEvent)
+	testHandler.flushBuffer()
+	if mockKinesis.timesCalled != 1 || strings.Contains(string(mockKinesis.putRecords[0][0].Data), "secret") {
+		t.Fatalf("Expected an encrypted record, got %d calls", mockKinesis.timesCalled)
+	}
+
+	chunk, err := envelope.Decode(mockKinesis.putRecords[0][0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := newChunkAssembler(time.Minute).add(chunk, time.Now()); ok {
+		t.Error("Expected the event to be unreadable without the key")
+	}
+	assembler := newChunkAssembler(time.Minute)
+	assembler.keys = keys
+	line, ok := assembler.add(chunk, time.Now())
+	event := HTTPEvent{}
+	if err := json.Unmarshal(line, &event); !ok || err != nil || event.ReqBody != "secret" {
+		t.Errorf("Expected the event to decrypt with the key, got %q %v", line, err)
+	}
+}
+
+func TestHandleEventRecordLimit(t *testing.T) {
+	keyFile, cleanup := writeKeyFile(t)
+	defer cleanup()
+	keys, err := envelope.LoadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockKinesis := &mockKinesisClient{}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	testHandler := &onlineHandler{
+		kinesisStreamName: "test",
+		kinesisHandle:     wrapper,
+		batcher:           newRecordBatcher(wrapper, "test", 0, false),
+		partition:         partitionStrategy{kind: partitionHeader, name: "X-Session-Id"},
+		keys:              envelope.NewDataKeys(keys, dataKeyEvents, dataKeyLifetime),
 	}
 
+	// the longest key allowed, and 3 bytes to a character
 	onlineSampleEvent := generateSampleEvent()
-	expectedKinesisCalls := 2
-	onlineSampleEvent.ReqBody = randomStringWithLength(1.5 * chunkSize)
+	onlineSampleEvent.ReqHeaders = []Header{{"X-Session-Id", strings.Repeat("\u2028", maxPartitionKeyLength)}}
+	onlineSampleEvent.ReqBody = randomStringWithLength(3 * maxRecordBytes)
+	testHandler.handleEvent(onlineSampleEvent)
+	testHandler.flushBuffer()
+
+	assembler := newChunkAssembler(time.Minute)
+	assembler.keys = keys
+	largest := 0
+	var line []byte
+	for _, records := range mockKinesis.putRecords {
+		for _, record := range records {
+			size := len(record.Data) + len(*record.PartitionKey)
+			if size > maxRecordBytes {
+				t.Errorf("Expected records of up to %d bytes, got %d", maxRecordBytes, size)
+			}
+			if size > largest {
+				largest = size
+			}
+			chunk, err := envelope.Decode(record.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if joined, ok := assembler.add(chunk, time.Now()); ok {
+				line = joined
+			}
+		}
+	}
+	// when encrypting, chunks leave out the partition key the reserve makes room for
+	if largest < maxRecordBytes-partitionKeyReserve {
+		t.Errorf("Expected full records close to %d bytes, got %d", maxRecordBytes, largest)
+	}
+	event := HTTPEvent{}
+	if err := json.Unmarshal(line, &event); err != nil || event.ReqBody != onlineSampleEvent.ReqBody {
+		t.Errorf("Expected every chunk to arrive and join back together, got %v", err)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	var compressionTests = []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"none", envelope.CompressionNone, true},
+		{"gzip", envelope.CompressionGzip, true},
+		{"zstd", envelope.CompressionZstd, true},
+		{"lz4", "lz4", false},
+	}
+	for _, tt := range compressionTests {
+		method, err := parseCompression(tt.input)
+		if (err == nil) != tt.valid || method != tt.expected {
+			t.Errorf("parseCompression(%q): expected %q (valid=%v), got %q %v", tt.input, tt.expected, tt.valid, method, err)
+		}
+	}
+}
+
+func TestHandleEventSpooled(t *testing.T) {
+	mockKinesis := &syncKinesisClient{}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	testHandler := &onlineHandler{
+		kinesisStreamName: "test",
+		kinesisHandle:     wrapper,
+		batcher:           newRecordBatcher(wrapper, "test", 0, false),
+	}
+	s, cleanup := newTestSpool(t, 10*maxRecordBytes, spoolBlock)
+	defer cleanup()
+	testHandler.spoolTo(s)
 
+	onlineSampleEvent := generateSampleEvent()
+	onlineSampleEvent.ReqBody = randomStringWithLength(1.5 * maxRecordBytes)
 	testHandler.handleEvent(onlineSampleEvent)
-	if mockKinesis.timesCalled != expectedKinesisCalls {
-		t.Errorf("Expected to call Kinesis %d times, but saw %d", expectedKinesisCalls, mockKinesis.timesCalled)
+	testHandler.flushBuffer()
+	if left := s.wait(0); left != 0 {
+		t.Fatalf("Expected the spool to be emptied, %d events left", left)
+	}
+	mockKinesis.mu.Lock()
+	defer mockKinesis.mu.Unlock()
+	if mockKinesis.timesCalled != 1 || len(mockKinesis.putRecords[0]) != 2 || *mockKinesis.putRecords[0][0].PartitionKey == "" {
+		t.Errorf("Expected both chunks in a single PutRecords call, got %d calls", mockKinesis.timesCalled)
+	}
+}
+
+func TestSendSpooledSkipsUnreadableEvents(t *testing.T) {
+	mockKinesis := &mockKinesisClient{}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	testHandler := &onlineHandler{batcher: newRecordBatcher(wrapper, "test", 0, false)}
+	delivered, err := testHandler.sendSpooled([][]byte{[]byte("{"), []byte(`[{"partitionKey": "a", "data": {"uuid": "x"}}]`)})
+	if err != nil || delivered != 2 || mockKinesis.timesCalled != 1 || len(mockKinesis.putRecords[0]) != 1 {
+		t.Errorf("Expected only the readable event to be sent, got %d calls %v", mockKinesis.timesCalled, err)
+	}
+}
+
+// Accepts the first calls to PutRecords, then fails every call after them
+type flakyKinesisClient struct {
+	mockKinesisClient
+	accept int
+}
+
+func (m *flakyKinesisClient) PutRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	if m.timesCalled >= m.accept {
+		m.timesCalled++
+		return nil, errors.New("simulated service error")
+	}
+	return m.mockKinesisClient.PutRecords(inp)
+}
+
+func TestSendSpooledPartialDelivery(t *testing.T) {
+	mockKinesis := &flakyKinesisClient{accept: 1}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	testHandler := &onlineHandler{batcher: newRecordBatcher(wrapper, "test", 0, false)}
+	testHandler.batcher.backoff = 0
+
+	// two of these fit in a PutRecords call, but not three
+	payloads := [][]byte{}
+	for _, key := range []string{"a", "b", "c"} {
+		record := `{"partitionKey": "` + key + `", "data": ` + jsString(strings.Repeat(key, 900*1024)) + `}`
+		payloads = append(payloads, []byte("["+record+","+record+"]"))
+	}
+	delivered, err := testHandler.sendSpooled(payloads)
+	if err == nil || delivered != 2 || len(mockKinesis.putRecords) != 1 || len(mockKinesis.putRecords[0]) != 4 {
+		t.Fatalf("Expected the first 2 events to be delivered in one call, got %d %v", delivered, err)
+	}
+
+	mockKinesis.accept = mockKinesis.timesCalled + 1
+	delivered, err = testHandler.sendSpooled(payloads[delivered:])
+	if err != nil || delivered != 1 || len(mockKinesis.putRecords) != 2 || *mockKinesis.putRecords[1][0].PartitionKey != "c" {
+		t.Errorf("Expected only the undelivered event to be sent again, got %d %v", delivered, err)
+	}
+}
+
+func TestQueuedHandleEvent(t *testing.T) {
+	mockKinesis := &syncKinesisClient{}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	testHandler := &onlineHandler{
+		kinesisStreamName: "test",
+		kinesisHandle:     wrapper,
+		batcher:           newRecordBatcher(wrapper, "test", 0, false),
+	}
+	var invalidQueues = []struct {
+		size, workers int
+		policy        string
+	}{
+		{0, 1, queueBlock},
+		{1, 0, queueBlock},
+		{1, 1, "explode"},
+		{1, 1, queueSpill},
+	}
+	for _, tt := range invalidQueues {
+		if err := testHandler.startQueue(tt.size, tt.workers, tt.policy); err == nil {
+			t.Errorf("Expected an error for %+v, but got <nil>", tt)
+		}
+	}
+
+	if err := testHandler.startQueue(10, 2, queueBlock); err != nil {
+		t.Fatal(err)
+	}
+	testHandler.batcher.stats = testHandler.stats
+	for i := 0; i < 5; i++ {
+		testHandler.handleEvent(generateSampleEvent())
+	}
+	testHandler.flushBuffer()
+	if mockKinesis.calls() != 1 || len(mockKinesis.putRecords[0]) != 5 {
+		t.Errorf("Expected every queued event to be sent on flush, got %d calls", mockKinesis.calls())
+	}
+	if summary := testHandler.statsSummary(); !strings.HasPrefix(summary, "Stream: queue=0/10 enqueued=5 dropped=0 spilled=0 | PutRecords calls=1 latency") {
+		t.Errorf("Unexpected stats %q", summary)
+	}
+}
+
+func TestQueueFullPolicies(t *testing.T) {
+	mockKinesis := &mockKinesisClient{}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	s, cleanup := newTestSpool(t, 10*maxRecordBytes, spoolBlock)
+	defer cleanup()
+	// no workers, so the queue stays full after the first event
+	testHandler := &onlineHandler{
+		kinesisHandle: wrapper,
+		batcher:       newRecordBatcher(wrapper, "test", 0, false),
+		spool:         s,
+		queue:         make(chan HTTPEvent, 1),
+		queuePolicy:   queueSpill,
+		stats:         &streamStats{},
+	}
+	testHandler.handleEvent(generateSampleEvent())
+	testHandler.handleEvent(generateSampleEvent())
+	if len(s.entries) != 1 || testHandler.stats.spilled != 1 || testHandler.inFlight != 1 {
+		t.Errorf("Expected the second event to be spilled to the spool, got %d spooled, stats %+v", len(s.entries), testHandler.stats)
+	}
+
+	testHandler.queuePolicy = queueDrop
+	testHandler.handleEvent(generateSampleEvent())
+	if len(s.entries) != 1 || testHandler.stats.dropped != 1 || testHandler.inFlight != 1 {
+		t.Errorf("Expected the third event to be dropped, got %d spooled, stats %+v", len(s.entries), testHandler.stats)
+	}
+	if left := testHandler.drain(0); left != 1 {
+		t.Errorf("Expected the queued event to still be waiting, got %d", left)
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	stats := &streamStats{enqueued: 4, dropped: 1}
+	stats.recordSend(10 * time.Millisecond)
+	stats.recordSend(30 * time.Millisecond)
+	expected := "Stream: queue=2/8 enqueued=4 dropped=1 spilled=0 | PutRecords calls=2 latency mean=20ms max=30ms"
+	if summary := stats.summary(2, 8); summary != expected {
+		t.Errorf("Expected %q, got %q", expected, summary)
+	}
+	var noStats *streamStats
+	noStats.recordSend(time.Second)
+	if noStats.summary(0, 0) != "" {
+		t.Error("Expected no summary without stats")
 	}
 }
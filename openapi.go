@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// guards against self-referencing schemas ($ref cycles)
+	maxSchemaDepth = 64
+)
+
+// openAPISpec is a parsed OpenAPI 3.x or Swagger 2.0 document
+// that recorded events can be validated against.
+type openAPISpec struct {
+	root     map[string]interface{}
+	swagger  bool
+	basePath string
+	paths    []specPath
+}
+
+type specPath struct {
+	template   string
+	segments   []string
+	operations map[string]map[string]interface{}
+}
+
+// Set when the --openapi flag is passed, nil otherwise
+var apiSpec *openAPISpec
+
+var specMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+func loadOpenAPISpec(specFile string) (*openAPISpec, error) {
+	dat, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseOpenAPISpec(dat)
+}
+
+// parseOpenAPISpec accepts either YAML or JSON (JSON being a subset of YAML)
+func parseOpenAPISpec(dat []byte) (*openAPISpec, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(dat, &raw); err != nil {
+		return nil, fmt.Errorf("Could not parse OpenAPI spec: %w", err)
+	}
+	root, ok := normalizeYAML(raw).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("OpenAPI spec must be a YAML/JSON object")
+	}
+	spec := &openAPISpec{root: root}
+	if _, ok := root["swagger"]; ok {
+		spec.swagger = true
+		spec.basePath, _ = root["basePath"].(string)
+	} else if _, ok := root["openapi"]; ok {
+		spec.basePath = serverBasePath(root)
+	} else {
+		return nil, fmt.Errorf("OpenAPI spec has neither an 'openapi' nor a 'swagger' version field")
+	}
+	spec.basePath = strings.TrimSuffix(spec.basePath, "/")
+
+	paths, _ := root["paths"].(map[string]interface{})
+	for template, item := range paths {
+		itemMap, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		p := specPath{
+			template:   template,
+			segments:   splitPath(template),
+			operations: map[string]map[string]interface{}{},
+		}
+		for _, method := range specMethods {
+			if op, ok := itemMap[method].(map[string]interface{}); ok {
+				p.operations[method] = op
+			}
+		}
+		spec.paths = append(spec.paths, p)
+	}
+	// Keep matching deterministic regardless of map ordering
+	sort.Slice(spec.paths, func(i, j int) bool {
+		return spec.paths[i].template < spec.paths[j].template
+	})
+	return spec, nil
+}
+
+// YAML mappings with non-string keys (ex. unquoted status codes like `200:`)
+// decode to map[interface{}]interface{}, so flatten every key to a string
+func normalizeYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			t[k] = normalizeYAML(val)
+		}
+		return t
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprint(k)] = normalizeYAML(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range t {
+			t[i] = normalizeYAML(val)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+// The path of the first declared server is treated as a prefix for all spec paths
+func serverBasePath(root map[string]interface{}) string {
+	servers, _ := root["servers"].([]interface{})
+	if len(servers) == 0 {
+		return ""
+	}
+	server, _ := servers[0].(map[string]interface{})
+	rawURL, _ := server["url"].(string)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+func isPathParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// findPath returns the spec path matching the endpoint, preferring
+// literal segments over templated ones (ex. /users/me over /users/{id})
+func (s *openAPISpec) findPath(endpoint string) *specPath {
+	// the base path has to end on a segment boundary, ex. /api doesn't match /apiv2
+	if rest := strings.TrimPrefix(endpoint, s.basePath); s.basePath != "" && rest != endpoint && (rest == "" || rest[0] == '/') {
+		endpoint = rest
+	}
+	segments := splitPath(endpoint)
+	var best *specPath
+	bestScore := -1
+	for i := range s.paths {
+		p := &s.paths[i]
+		if len(p.segments) != len(segments) {
+			continue
+		}
+		score := 0
+		for j, segment := range p.segments {
+			if isPathParam(segment) {
+				if segments[j] == "" {
+					score = -1
+					break
+				}
+			} else if segment == segments[j] {
+				score++
+			} else {
+				score = -1
+				break
+			}
+		}
+		if score > bestScore {
+			best = p
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// validate checks a recorded event against the spec and returns a
+// human-readable list of violations (empty if the event conforms)
+func (s *openAPISpec) validate(event HTTPEvent) []string {
+	violations := []string{}
+	p := s.findPath(event.Endpoint)
+	if p == nil {
+		return append(violations, fmt.Sprintf("path %s is not declared in the spec", event.Endpoint))
+	}
+	op, ok := p.operations[strings.ToLower(event.HTTPMethod)]
+	if !ok {
+		return append(violations, fmt.Sprintf("method %s is not declared for path %s", event.HTTPMethod, p.template))
+	}
+
+	reqSchema, reqMediaType := s.requestSchema(op, findHeader(event.ReqHeaders, "Content-Type"))
+	if reqSchema != nil && event.ReqBody != "" {
+		violations = append(violations, s.validateBody("request body", reqSchema, reqMediaType, event.ReqBody)...)
+	}
+
+	response, ok := findResponse(op, event.ResponseCode)
+	if !ok {
+		return append(violations, fmt.Sprintf("response status %s is not declared for %s %s", event.ResponseCode, event.HTTPMethod, p.template))
+	}
+	respSchema, respMediaType := s.responseSchema(s.resolve(response), findHeader(event.RespHeaders, "Content-Type"))
+	if respSchema != nil && event.RespBody != "" {
+		violations = append(violations, s.validateBody("response body", respSchema, respMediaType, event.RespBody)...)
+	}
+	return violations
+}
+
+func (s *openAPISpec) requestSchema(op map[string]interface{}, contentType string) (map[string]interface{}, string) {
+	if s.swagger {
+		params, _ := op["parameters"].([]interface{})
+		for _, param := range params {
+			paramMap := s.resolve(param)
+			if paramMap["in"] == "body" {
+				schema, _ := paramMap["schema"].(map[string]interface{})
+				return schema, "application/json"
+			}
+		}
+		return nil, ""
+	}
+	requestBody := s.resolve(op["requestBody"])
+	return mediaTypeSchema(requestBody, contentType)
+}
+
+func (s *openAPISpec) responseSchema(response map[string]interface{}, contentType string) (map[string]interface{}, string) {
+	if s.swagger {
+		schema, _ := response["schema"].(map[string]interface{})
+		return schema, "application/json"
+	}
+	return mediaTypeSchema(response, contentType)
+}
+
+// mediaTypeSchema picks the OpenAPI 3 `content` entry that matches the
+// recorded Content-Type, falling back to any JSON media type declared
+func mediaTypeSchema(holder map[string]interface{}, contentType string) (map[string]interface{}, string) {
+	content, _ := holder["content"].(map[string]interface{})
+	if len(content) == 0 {
+		return nil, ""
+	}
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	if entry, ok := content[mediaType].(map[string]interface{}); ok {
+		schema, _ := entry["schema"].(map[string]interface{})
+		return schema, mediaType
+	}
+	keys := make([]string, 0, len(content))
+	for k := range content {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if strings.Contains(k, "json") {
+			entry, _ := content[k].(map[string]interface{})
+			schema, _ := entry["schema"].(map[string]interface{})
+			return schema, k
+		}
+	}
+	return nil, ""
+}
+
+// findResponse looks up a response by exact status code, then by
+// range (ex. "2XX"), then by the "default" response
+func findResponse(op map[string]interface{}, code string) (interface{}, bool) {
+	responses, _ := op["responses"].(map[string]interface{})
+	if r, ok := responses[code]; ok {
+		return r, true
+	}
+	if len(code) == 3 {
+		for _, rangeKey := range []string{code[:1] + "XX", code[:1] + "xx"} {
+			if r, ok := responses[rangeKey]; ok {
+				return r, true
+			}
+		}
+	}
+	r, ok := responses["default"]
+	return r, ok
+}
+
+func (s *openAPISpec) validateBody(location string, schema map[string]interface{}, mediaType, body string) []string {
+	if !strings.Contains(mediaType, "json") {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return []string{fmt.Sprintf("%s is not valid JSON: %v", location, err)}
+	}
+	errs := s.validateSchema(schema, value, "$", 0)
+	for i := range errs {
+		errs[i] = location + ": " + errs[i]
+	}
+	return errs
+}
+
+// resolve follows local references (ex. "#/components/schemas/User")
+func (s *openAPISpec) resolve(node interface{}) map[string]interface{} {
+	m, _ := node.(map[string]interface{})
+	for i := 0; i < maxSchemaDepth && m != nil; i++ {
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return m
+		}
+		m = s.lookupRef(ref)
+	}
+	return m
+}
+
+func (s *openAPISpec) lookupRef(ref string) map[string]interface{} {
+	if !strings.HasPrefix(ref, "#/") {
+		logDebug("Skipping unsupported non-local $ref %s", ref)
+		return nil
+	}
+	var node interface{} = s.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = m[part]
+	}
+	m, _ := node.(map[string]interface{})
+	return m
+}
+
+// validateSchema implements the subset of JSON Schema used by most API
+// specs: type, nullable, enum, properties, required, additionalProperties,
+// items, allOf, anyOf and oneOf
+func (s *openAPISpec) validateSchema(schemaNode interface{}, value interface{}, at string, depth int) []string {
+	if depth > maxSchemaDepth {
+		return nil
+	}
+	schema := s.resolve(schemaNode)
+	if schema == nil {
+		return nil
+	}
+	errs := []string{}
+
+	if value == nil {
+		if schema["nullable"] == true || schema["x-nullable"] == true || schema["type"] == "null" || schema["type"] == nil {
+			return errs
+		}
+		return append(errs, fmt.Sprintf("%s is null but the schema is not nullable", at))
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			errs = append(errs, s.validateSchema(sub, value, at, depth+1)...)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && s.countMatches(anyOf, value, at, depth) == 0 {
+		errs = append(errs, fmt.Sprintf("%s does not match any schema in anyOf", at))
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		if n := s.countMatches(oneOf, value, at, depth); n != 1 {
+			errs = append(errs, fmt.Sprintf("%s matches %d schemas in oneOf, expected exactly 1", at, n))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok && !inEnum(enum, value) {
+		errs = append(errs, fmt.Sprintf("%s value %v is not one of %v", at, value, enum))
+	}
+
+	schemaType, _ := schema["type"].(string)
+	if schemaType != "" && !matchesType(schemaType, value) {
+		return append(errs, fmt.Sprintf("%s should be of type %s but was %s", at, schemaType, jsonTypeName(value)))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		errs = append(errs, s.validateObject(schema, v, at, depth)...)
+	case []interface{}:
+		if items, ok := schema["items"]; ok {
+			for i, item := range v {
+				errs = append(errs, s.validateSchema(items, item, fmt.Sprintf("%s[%d]", at, i), depth+1)...)
+			}
+		}
+	}
+	return errs
+}
+
+func (s *openAPISpec) validateObject(schema map[string]interface{}, obj map[string]interface{}, at string, depth int) []string {
+	errs := []string{}
+	required, _ := schema["required"].([]interface{})
+	for _, r := range required {
+		name := fmt.Sprint(r)
+		if _, ok := obj[name]; !ok {
+			errs = append(errs, fmt.Sprintf("%s is missing required property '%s'", at, name))
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		propAt := at + "." + k
+		if propSchema, ok := properties[k]; ok {
+			errs = append(errs, s.validateSchema(propSchema, obj[k], propAt, depth+1)...)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				errs = append(errs, fmt.Sprintf("%s is not an allowed property", propAt))
+			}
+		case map[string]interface{}:
+			errs = append(errs, s.validateSchema(additional, obj[k], propAt, depth+1)...)
+		}
+	}
+	return errs
+}
+
+func (s *openAPISpec) countMatches(schemas []interface{}, value interface{}, at string, depth int) int {
+	matches := 0
+	for _, sub := range schemas {
+		if len(s.validateSchema(sub, value, at, depth+1)) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func matchesType(schemaType string, value interface{}) bool {
+	switch schemaType {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return schemaType == jsonTypeName(value)
+	}
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// YAML enums decode numbers as ints while JSON bodies decode them
+// as float64, so compare on the printed value instead
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAgainstSpec attaches any violations to the event and logs them
+func validateAgainstSpec(event *HTTPEvent) {
+	if apiSpec == nil {
+		return
+	}
+	event.SpecViolations = apiSpec.validate(*event)
+	for _, v := range event.SpecViolations {
+		logWarn("OpenAPI violation (%s %s %s): %s", event.PairID, event.HTTPMethod, event.Endpoint, v)
+	}
+	if proxyReport != nil {
+		proxyReport.add("openapi", specTestCase(*event))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testOpenAPISpec = `
+openapi: 3.0.0
+servers:
+  - url: http://localhost:8080/api
+paths:
+  /users/{id}:
+    get:
+      responses:
+        200:
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/User'
+        4XX:
+          description: client error
+  /users/me:
+    get:
+      responses:
+        default:
+          description: anything goes
+  /users:
+    post:
+      requestBody:
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/User'
+      responses:
+        '201':
+          description: created
+components:
+  schemas:
+    User:
+      type: object
+      required: [id, name]
+      additionalProperties: false
+      properties:
+        id:
+          type: integer
+        name:
+          type: string
+        role:
+          type: string
+          enum: [admin, viewer]
+        manager:
+          nullable: true
+          allOf:
+            - $ref: '#/components/schemas/User'
+        tags:
+          type: array
+          items:
+            type: string
+`
+
+const testSwaggerSpec = `{
+  "swagger": "2.0",
+  "basePath": "/v1",
+  "paths": {
+    "/items": {
+      "post": {
+        "parameters": [{"in": "body", "name": "item", "schema": {"type": "object", "required": ["sku"]}}],
+        "responses": {"200": {"schema": {"type": "array", "items": {"type": "number"}}}}
+      }
+    }
+  }
+}`
+
+func specEvent(method, endpoint, code, reqBody, respBody string) HTTPEvent {
+	return HTTPEvent{
+		HTTPMethod:   method,
+		Endpoint:     endpoint,
+		ReqHeaders:   []Header{{Name: "Content-Type", Value: "application/json"}},
+		ReqBody:      reqBody,
+		RespHeaders:  []Header{{Name: "Content-Type", Value: "application/json; charset=utf-8"}},
+		RespBody:     respBody,
+		ResponseCode: code,
+	}
+}
+
+func TestOpenAPIValidate(t *testing.T) {
+	spec, err := parseOpenAPISpec([]byte(testOpenAPISpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var validateTests = []struct {
+		name     string
+		event    HTTPEvent
+		expected []string
+	}{
+		{"valid", specEvent("GET", "/api/users/1", "200", "", `{"id": 1, "name": "a", "tags": ["x"]}`), nil},
+		{"literal path preferred", specEvent("GET", "/api/users/me", "500", "", `not json`), nil},
+		{"status range", specEvent("GET", "/api/users/1", "404", "", `not json`), nil},
+		{"unknown path", specEvent("GET", "/api/orders", "200", "", ""), []string{"path /api/orders is not declared"}},
+		{"outside the base path", specEvent("GET", "/apiusers/1", "200", "", ""), []string{"path /apiusers/1 is not declared"}},
+		{"unknown method", specEvent("DELETE", "/api/users/1", "200", "", ""), []string{"method DELETE is not declared"}},
+		{"unknown status", specEvent("POST", "/api/users", "200", `{"id": 1, "name": "a"}`, ""), []string{"response status 200 is not declared"}},
+		{"invalid JSON", specEvent("GET", "/api/users/1", "200", "", `{`), []string{"response body is not valid JSON"}},
+		{"schema violations", specEvent("POST", "/api/users", "201", `{"id": 1.5, "role": "owner", "extra": true, "tags": [1]}`, ""), []string{
+			"request body: $ is missing required property 'name'",
+			"request body: $.extra is not an allowed property",
+			"request body: $.id should be of type integer but was number",
+			"request body: $.role value owner is not one of [admin viewer]",
+			"request body: $.tags[0] should be of type string but was number",
+		}},
+		{"nested ref", specEvent("GET", "/api/users/1", "200", "", `{"id": 1, "name": "a", "manager": {"id": "2"}}`), []string{
+			"response body: $.manager is missing required property 'name'",
+			"response body: $.manager.id should be of type integer but was string",
+		}},
+		{"nullable", specEvent("GET", "/api/users/1", "200", "", `{"id": 1, "name": null, "manager": null}`), []string{
+			"response body: $.name is null but the schema is not nullable",
+		}},
+	}
+
+	for _, tt := range validateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := spec.validate(tt.event)
+			if len(violations) != len(tt.expected) {
+				t.Fatalf("Expected %d violations, got %d: %v", len(tt.expected), len(violations), violations)
+			}
+			for i, expected := range tt.expected {
+				if !strings.HasPrefix(violations[i], expected) {
+					t.Errorf("Expected violation starting with %q, got %q", expected, violations[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSwaggerValidate(t *testing.T) {
+	spec, err := parseOpenAPISpec([]byte(testSwaggerSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	violations := spec.validate(specEvent("POST", "/v1/items", "200", `{}`, `[1, "two"]`))
+	expected := []string{
+		"request body: $ is missing required property 'sku'",
+		"response body: $[1] should be of type number but was string",
+	}
+	if len(violations) != len(expected) {
+		t.Fatalf("Expected %d violations, got %v", len(expected), violations)
+	}
+	for i := range expected {
+		if violations[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], violations[i])
+		}
+	}
+}
+
+func TestParseOpenAPISpecErrors(t *testing.T) {
+	if _, err := parseOpenAPISpec([]byte(`{{{`)); err == nil {
+		t.Error("Expected a parse error, but got <nil>")
+	}
+	if _, err := parseOpenAPISpec([]byte(`- a list`)); err == nil {
+		t.Error("Expected an error for a non-object spec, but got <nil>")
+	}
+	if _, err := parseOpenAPISpec([]byte(`info: {}`)); err == nil {
+		t.Error("Expected an error for a spec with no version, but got <nil>")
+	}
+	if _, err := loadOpenAPISpec("does/not/exist.yaml"); err == nil {
+		t.Error("Expected an error for a missing file, but got <nil>")
+	}
+}
+
+func TestValidateAgainstSpec(t *testing.T) {
+	spec, err := parseOpenAPISpec([]byte(testOpenAPISpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := specEvent("GET", "/nowhere", "200", "", "")
+
+	apiSpec = nil
+	validateAgainstSpec(&event)
+	if event.SpecViolations != nil {
+		t.Errorf("Expected no validation without a spec, got %v", event.SpecViolations)
+	}
+
+	apiSpec = spec
+	defer func() { apiSpec = nil }()
+	validateAgainstSpec(&event)
+	if len(event.SpecViolations) != 1 {
+		t.Errorf("Expected 1 violation, got %v", event.SpecViolations)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/intuit/replay-zero/envelope"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// How recorded events are spread over the shards of a stream (--partition-key)
+const (
+	partitionUUID     = "uuid"     // one key per event: all of its chunks land on the same shard, in order
+	partitionEndpoint = "endpoint" // one key per endpoint: events for an endpoint stay in order
+	partitionHeader   = "header"   // header:NAME, the value of a request header (ex. a session ID)
+	partitionCookie   = "cookie"   // cookie:NAME, the value of a request cookie (ex. a session cookie)
+	partitionRandom   = "random"   // a new key per chunk: the most even spread, but chunks can arrive out of order
+)
+
+// Kinesis partition keys are 1 to 256 unicode characters
+const maxPartitionKeyLength = 256
+
+// Most bytes a partition key adds to a record: once as the record's key (up
+// to 4 bytes per character) and once in the chunk's partitionKey field (up
+// to 6 bytes per character once JSON escaped)
+const partitionKeyReserve = maxPartitionKeyLength*(utf8.UTFMax+6) + len(`,"partitionKey":""`)
+
+// partitionStrategy picks the partition key of each chunk of an event
+type partitionStrategy struct {
+	kind string
+	// header or cookie name
+	name string
+	// HMAC key for header and cookie values when encrypting, see hidden
+	secret string
+}
+
+func parsePartitionStrategy(strategy string) (partitionStrategy, error) {
+	kind, name := strategy, ""
+	if i := strings.Index(strategy, ":"); i >= 0 {
+		kind, name = strategy[:i], strategy[i+1:]
+	}
+	switch kind {
+	case partitionUUID, partitionEndpoint, partitionRandom:
+		if name == "" {
+			return partitionStrategy{kind: kind}, nil
+		}
+	case partitionHeader, partitionCookie:
+		if name != "" {
+			return partitionStrategy{kind: kind, name: name}, nil
+		}
+		return partitionStrategy{}, fmt.Errorf("Partition key %q needs a name, ex. %s:X-Session-Id", strategy, kind)
+	}
+	return partitionStrategy{}, fmt.Errorf("Unknown partition key %q, expected one of [uuid, endpoint, header:NAME, cookie:NAME, random]", strategy)
+}
+
+// key returns the partition key for a chunk of event, where eventUUID is shared by all of its chunks.
+// Events without the header or cookie fall back to their UUID.
+func (p partitionStrategy) key(event HTTPEvent, eventUUID string) string {
+	key := ""
+	switch p.kind {
+	case partitionEndpoint:
+		key = event.HTTPMethod + " " + event.Endpoint
+	case partitionHeader:
+		key = p.hide(findHeader(event.ReqHeaders, p.name))
+	case partitionCookie:
+		request := http.Request{Header: http.Header{"Cookie": {findHeader(event.ReqHeaders, "Cookie")}}}
+		if cookie, err := request.Cookie(p.name); err == nil {
+			key = p.hide(cookie.Value)
+		}
+	case partitionRandom:
+		if random, err := uuid.NewV4(); err == nil {
+			key = random.String()
+		}
+	}
+	if key == "" {
+		key = eventUUID
+	}
+	if utf8.RuneCountInString(key) > maxPartitionKeyLength {
+		// keeps values that are alike on the same shard
+		key = fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+	}
+	return key
+}
+
+// hidden returns the strategy to use when encrypting events. Header and cookie
+// values are usually session IDs, which would otherwise be readable by anyone
+// with access to the stream, so they're replaced by an HMAC under a data key
+// that's never sent. Keys stay the same for a value until Replay Zero restarts.
+func (p partitionStrategy) hidden(keys envelope.KeyProvider) (partitionStrategy, error) {
+	if p.kind != partitionHeader && p.kind != partitionCookie {
+		return p, nil
+	}
+	secret, _, err := keys.DataKey()
+	if err != nil {
+		return p, fmt.Errorf("Could not get a key to hide partition keys: %w", err)
+	}
+	p.secret = string(secret)
+	return p, nil
+}
+
+func (p partitionStrategy) hide(value string) string {
+	if p.secret == "" || value == "" {
+		return value
+	}
+	mac := hmac.New(sha256.New, []byte(p.secret))
+	mac.Write([]byte(value))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/intuit/replay-zero/envelope"
+)
+
+func TestParsePartitionStrategy(t *testing.T) {
+	var strategyTests = []struct {
+		input    string
+		expected partitionStrategy
+		valid    bool
+	}{
+		{"uuid", partitionStrategy{kind: partitionUUID}, true},
+		{"endpoint", partitionStrategy{kind: partitionEndpoint}, true},
+		{"random", partitionStrategy{kind: partitionRandom}, true},
+		{"header:X-Session-Id", partitionStrategy{kind: partitionHeader, name: "X-Session-Id"}, true},
+		{"cookie:JSESSIONID", partitionStrategy{kind: partitionCookie, name: "JSESSIONID"}, true},
+		{"header", partitionStrategy{}, false},
+		{"header:", partitionStrategy{}, false},
+		{"uuid:x", partitionStrategy{}, false},
+		{"time", partitionStrategy{}, false},
+	}
+	for _, tt := range strategyTests {
+		strategy, err := parsePartitionStrategy(tt.input)
+		if (err == nil) != tt.valid || strategy != tt.expected {
+			t.Errorf("parsePartitionStrategy(%q): expected %+v (valid=%v), got %+v %v", tt.input, tt.expected, tt.valid, strategy, err)
+		}
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	event := HTTPEvent{
+		HTTPMethod: "GET",
+		Endpoint:   "/api/orders",
+		ReqHeaders: []Header{
+			{"x-session-id", "session-1"},
+			{"Cookie", "theme=dark; JSESSIONID=abc123"},
+		},
+	}
+	var keyTests = []struct {
+		strategy partitionStrategy
+		key      string
+	}{
+		{partitionStrategy{}, "event-uuid"},
+		{partitionStrategy{kind: partitionUUID}, "event-uuid"},
+		{partitionStrategy{kind: partitionEndpoint}, "GET /api/orders"},
+		{partitionStrategy{kind: partitionHeader, name: "X-Session-Id"}, "session-1"},
+		{partitionStrategy{kind: partitionHeader, name: "X-Missing"}, "event-uuid"},
+		{partitionStrategy{kind: partitionCookie, name: "JSESSIONID"}, "abc123"},
+		{partitionStrategy{kind: partitionCookie, name: "missing"}, "event-uuid"},
+	}
+	for _, tt := range keyTests {
+		if key := tt.strategy.key(event, "event-uuid"); key != tt.key {
+			t.Errorf("%+v: expected key %q, got %q", tt.strategy, tt.key, key)
+		}
+	}
+
+	random := partitionStrategy{kind: partitionRandom}
+	if first, second := random.key(event, "event-uuid"), random.key(event, "event-uuid"); first == second || first == "event-uuid" {
+		t.Errorf("Expected a new random key for every chunk, got %q and %q", first, second)
+	}
+
+	event.ReqHeaders = []Header{{"X-Session-Id", strings.Repeat("s", 300)}}
+	byHeader := partitionStrategy{kind: partitionHeader, name: "X-Session-Id"}
+	if key := byHeader.key(event, "event-uuid"); len(key) != 64 || key != byHeader.key(event, "other-uuid") {
+		t.Errorf("Expected long values to be hashed consistently, got %q", key)
+	}
+}
+
+func TestHandleEventPartitionKey(t *testing.T) {
+	mockKinesis := &mockKinesisClient{}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	testHandler := &onlineHandler{
+		kinesisHandle: wrapper,
+		batcher:       newRecordBatcher(wrapper, "test", 0, false),
+	}
+	event := generateSampleEvent()
+	event.ReqBody = randomStringWithLength(1.5 * maxRecordBytes)
+	testHandler.handleEvent(event)
+	testHandler.flushBuffer()
+
+	records := mockKinesis.putRecords[0]
+	if len(records) != 2 || *records[0].PartitionKey != *records[1].PartitionKey {
+		t.Fatalf("Expected both chunks of an event to share a partition key, got %d records", len(records))
+	}
+	chunk := EventChunk{}
+	if err := json.Unmarshal(records[1].Data, &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if chunk.PartitionKey != *records[1].PartitionKey || chunk.PartitionKey != chunk.UUID {
+		t.Errorf("Expected the event UUID to be recorded as the chunk's partition key, got %q (uuid %q)", chunk.PartitionKey, chunk.UUID)
+	}
+}
+
+func TestHiddenPartitionKey(t *testing.T) {
+	keyFile, cleanup := writeKeyFile(t)
+	defer cleanup()
+	keys, err := envelope.LoadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := HTTPEvent{
+		HTTPMethod: "GET",
+		Endpoint:   "/api/orders",
+		ReqHeaders: []Header{
+			{"X-Session-Id", "session-1"},
+			{"Cookie", "JSESSIONID=session-1"},
+		},
+	}
+
+	for _, strategy := range []partitionStrategy{{kind: partitionHeader, name: "X-Session-Id"}, {kind: partitionCookie, name: "JSESSIONID"}} {
+		hidden, err := strategy.hidden(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := hidden.key(event, "event-uuid")
+		if len(key) != 64 || key != hidden.key(event, "other-uuid") {
+			t.Errorf("%s: expected the value to be hashed consistently, got %q", strategy.kind, key)
+		}
+		if other, _ := strategy.hidden(keys); other.key(event, "event-uuid") == key {
+			t.Errorf("%s: expected a key nobody else can compute, got %q twice", strategy.kind, key)
+		}
+		if missing := (partitionStrategy{kind: strategy.kind, name: "missing", secret: hidden.secret}); missing.key(event, "event-uuid") != "event-uuid" {
+			t.Errorf("%s: expected events without a value to fall back to their UUID", strategy.kind)
+		}
+	}
+	endpoint := partitionStrategy{kind: partitionEndpoint}
+	if hidden, err := endpoint.hidden(keys); err != nil || hidden != endpoint {
+		t.Errorf("Expected only header and cookie keys to be hidden, got %+v %v", hidden, err)
+	}
+
+	mockKinesis := &mockKinesisClient{}
+	wrapper := &kinesisWrapper{client: mockKinesis, logger: nopLog}
+	hidden, err := partitionStrategy{kind: partitionHeader, name: "X-Session-Id"}.hidden(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHandler := &onlineHandler{
+		kinesisHandle: wrapper,
+		batcher:       newRecordBatcher(wrapper, "test", 0, false),
+		partition:     hidden,
+		keys:          envelope.NewDataKeys(keys, dataKeyEvents, dataKeyLifetime),
+	}
+	testHandler.send(event)
+	testHandler.flushBuffer()
+	record := mockKinesis.putRecords[0][0]
+	chunk, err := envelope.Decode(record.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *record.PartitionKey != hidden.key(event, chunk.UUID) || chunk.PartitionKey != "" || strings.Contains(string(record.Data), "session-1") {
+		t.Errorf("Expected the session ID to stay out of the record, got key %q and chunk %+v", *record.PartitionKey, chunk)
+	}
+}
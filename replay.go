@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// replayResult is the outcome of re-sending a single recorded event
+type replayResult struct {
+	Expected    HTTPEvent
+	Actual      HTTPEvent
+	Differences []difference
+	Err         error
+	Duration    time.Duration
+}
+
+// replayReportEntry is the machine-readable form of a replayResult
+type replayReportEntry struct {
+	PairID      string       `json:"pair_id"`
+	Method      string       `json:"method"`
+	Endpoint    string       `json:"endpoint"`
+	Passed      bool         `json:"passed"`
+	DurationMs  int64        `json:"duration_ms"`
+	Error       string       `json:"error,omitempty"`
+	Differences []difference `json:"differences"`
+}
+
+func (r replayResult) passed() bool {
+	return r.Err == nil && len(r.Differences) == 0
+}
+
+// runReplay implements `replay-zero replay`, returning the process exit code
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of replay-zero replay:\n  replay-zero replay [flags] recording.jsonl...\n")
+		fs.PrintDefaults()
+	}
+	target := fs.String("target", "http://localhost:8080", "Base URL to re-send recorded requests to")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout for each replayed request")
+	format := fs.String("format", "text", "Report format: [text] or [json]")
+	junit := fs.String("junit", "", "Also write a JUnit XML report (one testcase per event) to this file")
+	summary := fs.String("summary-json", "", "Also write a JSON summary of the run to this file")
+	diffOpts := registerDiffFlags(fs)
+	fs.BoolVar(&flags.debug, "debug", false, "Set logging to also print debug messages")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown report format %q, expected one of [text, json]\n", *format)
+		return 2
+	}
+	engine, err := diffOpts.engine()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	events, err := readRecordings(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	results := replayEvents(events, *target, &http.Client{Timeout: *timeout}, engine)
+	printReport := printReplayReport
+	if *format == "json" {
+		printReport = printReplayJSON
+	}
+	failed := printReport(os.Stdout, results)
+	cases := []testCase{}
+	for _, r := range results {
+		cases = append(cases, replayTestCase("replay", r))
+	}
+	if err := writeReports(*junit, *summary, []testSuite{{Name: "replay", Cases: cases}}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readRecordings reads HTTPEvents from one or more JSONL files (one event per line)
+func readRecordings(paths []string) ([]HTTPEvent, error) {
+	events := []HTTPEvent{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fileEvents, err := readRecording(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read recording %s: %w", path, err)
+		}
+		events = append(events, fileEvents...)
+	}
+	return events, nil
+}
+
+func readRecording(r io.Reader) ([]HTTPEvent, error) {
+	events := []HTTPEvent{}
+	// bufio.Reader rather than a Scanner, since recorded bodies
+	// can easily exceed the Scanner's maximum token size
+	reader := bufio.NewReader(r)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			event := HTTPEvent{}
+			if jsonErr := json.Unmarshal(line, &event); jsonErr != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, jsonErr)
+			}
+			events = append(events, event)
+		}
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// replayEvents re-sends each event in the order it was recorded
+func replayEvents(events []HTTPEvent, target string, c *http.Client, engine *diffEngine) []replayResult {
+	results := []replayResult{}
+	for _, event := range events {
+		results = append(results, replayEvent(event, target, c, engine))
+	}
+	return results
+}
+
+func replayEvent(event HTTPEvent, target string, c *http.Client, engine *diffEngine) replayResult {
+	result := replayResult{Expected: event}
+	actual, duration, err := sendEvent(event, target, c)
+	result.Duration = duration
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Actual = actual
+	result.Differences = engine.diffEvents(event, actual)
+	return result
+}
+
+// sendEvent re-sends the request of a recorded event to target and returns the
+// live event (keeping the recorded PairID) along with how long the response took
+func sendEvent(event HTTPEvent, target string, c *http.Client) (HTTPEvent, time.Duration, error) {
+	url := strings.TrimSuffix(target, "/") + event.Endpoint
+	if event.Query != "" {
+		url += "?" + event.Query
+	}
+	request, err := http.NewRequest(event.HTTPMethod, url, strings.NewReader(event.ReqBody))
+	if err != nil {
+		return HTTPEvent{}, 0, fmt.Errorf("Could not build request: %w", err)
+	}
+	for _, h := range event.ReqHeaders {
+		request.Header.Add(h.Name, h.Value)
+	}
+
+	start := time.Now()
+	response, err := c.Do(request)
+	if err != nil {
+		return HTTPEvent{}, time.Since(start), fmt.Errorf("Could not send request: %w", err)
+	}
+	defer response.Body.Close()
+	respBody, err := ioutil.ReadAll(response.Body)
+	duration := time.Since(start)
+	if err != nil {
+		return HTTPEvent{}, duration, fmt.Errorf("Could not read response body: %w", err)
+	}
+
+	actual, err := convertRequestResponse(request, response, event.ReqBody, string(respBody))
+	if err != nil {
+		return HTTPEvent{}, duration, err
+	}
+	actual.PairID = event.PairID
+	actual.Timestamp = start.UnixNano() / int64(time.Millisecond)
+	return actual, duration, nil
+}
+
+// printReplayReport writes a pass/fail line per event plus a
+// summary, and returns the number of events that failed
+func printReplayReport(w io.Writer, results []replayResult) int {
+	failed := 0
+	for _, r := range results {
+		status := "PASS"
+		if !r.passed() {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(w, "%s  %s %s %s (%s)\n", status, r.Expected.PairID, r.Expected.HTTPMethod, r.Expected.Endpoint, r.Duration.Round(time.Millisecond))
+		if r.Err != nil {
+			fmt.Fprintf(w, "      error: %v\n", r.Err)
+		}
+		for _, d := range r.Differences {
+			fmt.Fprintf(w, "      %s\n", d)
+		}
+	}
+	fmt.Fprintf(w, "\nReplayed %d events: %d passed, %d failed\n", len(results), len(results)-failed, failed)
+	return failed
+}
+
+// printReplayJSON writes the results as a JSON array, for CI and other
+// tooling, and returns the number of events that failed
+func printReplayJSON(w io.Writer, results []replayResult) int {
+	failed := 0
+	entries := []replayReportEntry{}
+	for _, r := range results {
+		entry := replayReportEntry{
+			PairID:      r.Expected.PairID,
+			Method:      r.Expected.HTTPMethod,
+			Endpoint:    r.Expected.Endpoint,
+			Passed:      r.passed(),
+			DurationMs:  r.Duration.Milliseconds(),
+			Differences: r.Differences,
+		}
+		if entry.Differences == nil {
+			entry.Differences = []difference{}
+		}
+		if r.Err != nil {
+			entry.Error = r.Err.Error()
+		}
+		if !entry.Passed {
+			failed++
+		}
+		entries = append(entries, entry)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(entries); err != nil {
+		logErr(err)
+	}
+	return failed
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Method", r.Method)
+		if strings.HasPrefix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		_, _ = w.Write(body)
+	}))
+}
+
+func TestReadRecording(t *testing.T) {
+	recording := exampleHTTPEventJSON + "\n\n" + exampleHTTPEventJSON
+	events, err := readRecording(strings.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if !eventsAreEqual(events[1], exampleHTTPEvent) {
+		t.Errorf("Unexpected event %v", events[1])
+	}
+
+	_, err = readRecording(strings.NewReader(exampleHTTPEventJSON + "\n{oops"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("Expected an error on line 2, got %v", err)
+	}
+}
+
+func TestReadRecordings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recording.jsonl")
+	if err := ioutil.WriteFile(path, []byte(exampleHTTPEventJSON+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := readRecordings([]string{path, path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("Expected 2 events, got %d", len(events))
+	}
+	if _, err := readRecordings([]string{filepath.Join(dir, "missing.jsonl")}); err == nil {
+		t.Error("Expected an error for a missing file, but got <nil>")
+	}
+}
+
+func TestReplayEvents(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+
+	passing := HTTPEvent{
+		PairID:       "pass",
+		HTTPMethod:   "POST",
+		Endpoint:     "/echo",
+		ReqBody:      `{"a": 1}`,
+		RespHeaders:  []Header{{Name: "X-Method", Value: "POST"}},
+		RespBody:     `{"a":1}`,
+		ResponseCode: "200",
+	}
+	failing := passing
+	failing.PairID = "fail"
+	failing.Endpoint = "/missing"
+	failing.RespBody = `{"a": 2}`
+
+	results := replayEvents([]HTTPEvent{passing, failing}, server.URL+"/", server.Client(), defaultDiffEngine)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	if !results[0].passed() {
+		t.Errorf("Expected first event to pass, got %v %v", results[0].Err, results[0].Differences)
+	}
+	if results[0].Actual.PairID != "pass" {
+		t.Errorf("Expected the live event to keep the recorded PairID, got %s", results[0].Actual.PairID)
+	}
+	if results[1].passed() || len(results[1].Differences) != 2 {
+		t.Errorf("Expected second event to fail with 2 differences, got %v", results[1].Differences)
+	}
+
+	var report bytes.Buffer
+	failed := printReplayReport(&report, results)
+	if failed != 1 {
+		t.Errorf("Expected 1 failure, got %d", failed)
+	}
+	for _, expected := range []string{"PASS  pass POST /echo", "FAIL  fail POST /missing", "status: expected 200, got 404", "Replayed 2 events: 1 passed, 1 failed"} {
+		if !strings.Contains(report.String(), expected) {
+			t.Errorf("Expected report to contain %q, got:\n%s", expected, report.String())
+		}
+	}
+}
+
+func TestReplayEventConnectionError(t *testing.T) {
+	server := newEchoServer()
+	server.Close()
+
+	result := replayEvent(exampleHTTPEvent, server.URL, &http.Client{}, defaultDiffEngine)
+	if result.Err == nil || result.passed() {
+		t.Error("Expected a connection error, but got <nil>")
+	}
+	result = replayEvent(HTTPEvent{HTTPMethod: "BAD METHOD"}, server.URL, &http.Client{}, defaultDiffEngine)
+	if result.Err == nil {
+		t.Error("Expected a request build error, but got <nil>")
+	}
+}
+
+func TestRunReplay(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recording.jsonl")
+	event := HTTPEvent{PairID: "a", HTTPMethod: "GET", Endpoint: "/", ResponseCode: "200"}
+	if err := ioutil.WriteFile(path, []byte(httpEventToString(event)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	if code := runReplay([]string{"--target", server.URL, path}); code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+	if code := runReplay([]string{"--target", server.URL + "/missing", path}); code != 1 {
+		t.Errorf("Expected exit code 1 for a failing replay, got %d", code)
+	}
+	if code := runReplay([]string{filepath.Join(dir, "missing.jsonl")}); code != 1 {
+		t.Errorf("Expected exit code 1 for a missing recording, got %d", code)
+	}
+	if code := runReplay([]string{"--format", "json", "--target", server.URL, path}); code != 0 {
+		t.Errorf("Expected exit code 0 with a JSON report, got %d", code)
+	}
+	if code := runReplay([]string{"--format", "xml", path}); code != 2 {
+		t.Errorf("Expected exit code 2 for an unknown format, got %d", code)
+	}
+	if code := runReplay([]string{"--ignore-path", "items", path}); code != 2 {
+		t.Errorf("Expected exit code 2 for an invalid ignore path, got %d", code)
+	}
+}
+
+func TestPrintReplayJSON(t *testing.T) {
+	results := []replayResult{
+		{Expected: HTTPEvent{PairID: "a", HTTPMethod: "GET", Endpoint: "/"}, Duration: 1500 * time.Microsecond},
+		{
+			Expected:    HTTPEvent{PairID: "b", HTTPMethod: "GET", Endpoint: "/b"},
+			Differences: []difference{{Kind: diffStatus, Expected: "200", Actual: "500", Message: "status: expected 200, got 500"}},
+		},
+		{Expected: HTTPEvent{PairID: "c", HTTPMethod: "GET", Endpoint: "/c"}, Err: errors.New("connection refused")},
+	}
+	var report bytes.Buffer
+	if failed := printReplayJSON(&report, results); failed != 2 {
+		t.Errorf("Expected 2 failures, got %d", failed)
+	}
+	entries := []replayReportEntry{}
+	if err := json.Unmarshal(report.Bytes(), &entries); err != nil {
+		t.Fatalf("Expected a JSON report, got %v:\n%s", err, report.String())
+	}
+	expected := []replayReportEntry{
+		{PairID: "a", Method: "GET", Endpoint: "/", Passed: true, DurationMs: 1, Differences: []difference{}},
+		{PairID: "b", Method: "GET", Endpoint: "/b", Differences: results[1].Differences},
+		{PairID: "c", Method: "GET", Endpoint: "/c", Error: "connection refused", Differences: []difference{}},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected:\n%+v\ngot:\n%+v", expected, entries)
+	}
+}
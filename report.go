@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// testCase is the outcome of checking a single HTTPEvent (replaying it,
+// shadowing it or validating it against a spec), as reported to CI
+type testCase struct {
+	Name      string
+	Classname string
+	Duration  time.Duration
+	// one line per problem found (differences, spec violations)
+	Failures []string
+	// set when the check itself couldn't be done (ex. connection refused)
+	Error string
+}
+
+func (c testCase) passed() bool {
+	return len(c.Failures) == 0 && c.Error == ""
+}
+
+// testSuite groups the test cases of one kind of check
+type testSuite struct {
+	Name  string
+	Cases []testCase
+}
+
+func testCaseName(event HTTPEvent) string {
+	return fmt.Sprintf("%s %s %s", event.PairID, event.HTTPMethod, event.Endpoint)
+}
+
+// replayTestCase reports a replayed or shadowed event
+func replayTestCase(suite string, r replayResult) testCase {
+	c := testCase{
+		Name:      testCaseName(r.Expected),
+		Classname: "replay-zero." + suite,
+		Duration:  r.Duration,
+	}
+	for _, d := range r.Differences {
+		c.Failures = append(c.Failures, d.String())
+	}
+	if r.Err != nil {
+		c.Error = r.Err.Error()
+	}
+	return c
+}
+
+// specTestCase reports an event validated against an OpenAPI spec
+func specTestCase(event HTTPEvent) testCase {
+	return testCase{
+		Name:      testCaseName(event),
+		Classname: "replay-zero.openapi",
+		Failures:  event.SpecViolations,
+	}
+}
+
+// reportCollector gathers test cases from concurrent proxy requests
+type reportCollector struct {
+	mu     sync.Mutex
+	suites []testSuite
+}
+
+// Set when the proxy was asked for a JUnit or JSON report, nil otherwise
+var proxyReport *reportCollector
+
+func (r *reportCollector) add(suite string, c testCase) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.suites {
+		if r.suites[i].Name == suite {
+			r.suites[i].Cases = append(r.suites[i].Cases, c)
+			return
+		}
+	}
+	r.suites = append(r.suites, testSuite{Name: suite, Cases: []testCase{c}})
+}
+
+func (r *reportCollector) snapshot() []testSuite {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	suites := make([]testSuite, len(r.suites))
+	copy(suites, r.suites)
+	return suites
+}
+
+// - - - - - - - - - - - - -
+//          JUNIT
+// - - - - - - - - - - - - -
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnit writes the suites as JUnit XML, with one testcase per event
+func writeJUnit(w io.Writer, suites []testSuite) error {
+	report := junitTestSuites{}
+	var total time.Duration
+	for _, suite := range suites {
+		junitSuite := junitTestSuite{Name: suite.Name, Tests: len(suite.Cases)}
+		var suiteTime time.Duration
+		for _, c := range suite.Cases {
+			junitCase := junitTestCase{Name: c.Name, Classname: c.Classname, Time: junitSeconds(c.Duration)}
+			if c.Error != "" {
+				junitSuite.Errors++
+				junitCase.Error = &junitProblem{Message: c.Error, Text: c.Error}
+			} else if len(c.Failures) > 0 {
+				junitSuite.Failures++
+				message := c.Failures[0]
+				if len(c.Failures) > 1 {
+					message = fmt.Sprintf("%s (and %d more)", message, len(c.Failures)-1)
+				}
+				junitCase.Failure = &junitProblem{Message: message, Type: suite.Name, Text: strings.Join(c.Failures, "\n")}
+			}
+			suiteTime += c.Duration
+			junitSuite.Cases = append(junitSuite.Cases, junitCase)
+		}
+		junitSuite.Time = junitSeconds(suiteTime)
+		report.Tests += junitSuite.Tests
+		report.Failures += junitSuite.Failures
+		report.Errors += junitSuite.Errors
+		total += suiteTime
+		report.Suites = append(report.Suites, junitSuite)
+	}
+	report.Time = junitSeconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// - - - - - - - - - - - - -
+//       JSON SUMMARY
+// - - - - - - - - - - - - -
+
+type jsonSummary struct {
+	Tests    int                `json:"tests"`
+	Passed   int                `json:"passed"`
+	Failed   int                `json:"failed"`
+	Errors   int                `json:"errors"`
+	Suites   []jsonSuiteSummary `json:"suites"`
+	Failures []jsonFailure      `json:"failures"`
+}
+
+type jsonSuiteSummary struct {
+	Name       string `json:"name"`
+	Tests      int    `json:"tests"`
+	Passed     int    `json:"passed"`
+	Failed     int    `json:"failed"`
+	Errors     int    `json:"errors"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type jsonFailure struct {
+	Suite    string   `json:"suite"`
+	Name     string   `json:"name"`
+	Messages []string `json:"messages,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// writeJSONSummary writes pass/fail counts per suite, plus the details of each failure
+func writeJSONSummary(w io.Writer, suites []testSuite) error {
+	summary := jsonSummary{Suites: []jsonSuiteSummary{}, Failures: []jsonFailure{}}
+	for _, suite := range suites {
+		suiteSummary := jsonSuiteSummary{Name: suite.Name, Tests: len(suite.Cases)}
+		var duration time.Duration
+		for _, c := range suite.Cases {
+			duration += c.Duration
+			switch {
+			case c.Error != "":
+				suiteSummary.Errors++
+			case len(c.Failures) > 0:
+				suiteSummary.Failed++
+			default:
+				suiteSummary.Passed++
+				continue
+			}
+			summary.Failures = append(summary.Failures, jsonFailure{Suite: suite.Name, Name: c.Name, Messages: c.Failures, Error: c.Error})
+		}
+		suiteSummary.DurationMs = duration.Milliseconds()
+		summary.Tests += suiteSummary.Tests
+		summary.Passed += suiteSummary.Passed
+		summary.Failed += suiteSummary.Failed
+		summary.Errors += suiteSummary.Errors
+		summary.Suites = append(summary.Suites, suiteSummary)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(summary)
+}
+
+// writeReports writes whichever of the JUnit XML and JSON summary files were asked for
+func writeReports(junitPath, summaryPath string, suites []testSuite) error {
+	write := func(path string, writer func(io.Writer, []testSuite) error) error {
+		if path == "" {
+			return nil
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if err := writer(f, suites); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	if err := write(junitPath, writeJUnit); err != nil {
+		return fmt.Errorf("Could not write JUnit report: %w", err)
+	}
+	if err := write(summaryPath, writeJSONSummary); err != nil {
+		return fmt.Errorf("Could not write JSON summary: %w", err)
+	}
+	return nil
+}
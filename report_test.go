@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var sampleSuites = []testSuite{
+	{Name: "replay", Cases: []testCase{
+		{Name: "a GET /ok", Classname: "replay-zero.replay", Duration: 1500 * time.Millisecond},
+		{Name: "b POST /diff", Classname: "replay-zero.replay", Duration: 500 * time.Millisecond, Failures: []string{"status: expected 200, got 500", `$.id: expected 1, got "<1>"`}},
+		{Name: "c GET /down", Classname: "replay-zero.replay", Error: "connection refused"},
+	}},
+	{Name: "openapi", Cases: []testCase{
+		{Name: "d GET /spec", Classname: "replay-zero.openapi", Failures: []string{"response body: $.id: expected integer, got string"}},
+	}},
+}
+
+func TestReplayTestCase(t *testing.T) {
+	result := replayResult{
+		Expected:    HTTPEvent{PairID: "a", HTTPMethod: "GET", Endpoint: "/x"},
+		Differences: []difference{{Message: "status: expected 200, got 500"}},
+		Err:         errors.New("oops"),
+		Duration:    time.Second,
+	}
+	expected := testCase{Name: "a GET /x", Classname: "replay-zero.shadow", Duration: time.Second, Failures: []string{"status: expected 200, got 500"}, Error: "oops"}
+	if c := replayTestCase("shadow", result); !reflect.DeepEqual(c, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, c)
+	}
+	if c := replayTestCase("replay", replayResult{}); !c.passed() {
+		t.Errorf("Expected a clean result to pass, got %+v", c)
+	}
+
+	c := specTestCase(HTTPEvent{PairID: "b", HTTPMethod: "POST", Endpoint: "/y", SpecViolations: []string{"bad"}})
+	if c.Name != "b POST /y" || c.passed() || c.Classname != "replay-zero.openapi" {
+		t.Errorf("Expected a failing openapi case, got %+v", c)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeJUnit(&out, sampleSuites); err != nil {
+		t.Fatal(err)
+	}
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites tests="4" failures="2" errors="1" time="2.000">
+  <testsuite name="replay" tests="3" failures="1" errors="1" time="2.000">
+    <testcase name="a GET /ok" classname="replay-zero.replay" time="1.500"></testcase>
+    <testcase name="b POST /diff" classname="replay-zero.replay" time="0.500">
+      <failure message="status: expected 200, got 500 (and 1 more)" type="replay">status: expected 200, got 500&#xA;$.id: expected 1, got &#34;&lt;1&gt;&#34;</failure>
+    </testcase>
+    <testcase name="c GET /down" classname="replay-zero.replay" time="0.000">
+      <error message="connection refused">connection refused</error>
+    </testcase>
+  </testsuite>
+  <testsuite name="openapi" tests="1" failures="1" errors="0" time="0.000">
+    <testcase name="d GET /spec" classname="replay-zero.openapi" time="0.000">
+      <failure message="response body: $.id: expected integer, got string" type="openapi">response body: $.id: expected integer, got string</failure>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+	// and it has to round trip as XML
+	parsed := junitTestSuites{}
+	if err := xml.Unmarshal(out.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Suites[0].Cases[1].Failure.Text != "status: expected 200, got 500\n$.id: expected 1, got \"<1>\"" {
+		t.Errorf("Unexpected failure text %q", parsed.Suites[0].Cases[1].Failure.Text)
+	}
+}
+
+func TestWriteJSONSummary(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeJSONSummary(&out, sampleSuites); err != nil {
+		t.Fatal(err)
+	}
+	summary := jsonSummary{}
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	expected := jsonSummary{
+		Tests: 4, Passed: 1, Failed: 2, Errors: 1,
+		Suites: []jsonSuiteSummary{
+			{Name: "replay", Tests: 3, Passed: 1, Failed: 1, Errors: 1, DurationMs: 2000},
+			{Name: "openapi", Tests: 1, Failed: 1},
+		},
+		Failures: []jsonFailure{
+			{Suite: "replay", Name: "b POST /diff", Messages: sampleSuites[0].Cases[1].Failures},
+			{Suite: "replay", Name: "c GET /down", Error: "connection refused"},
+			{Suite: "openapi", Name: "d GET /spec", Messages: sampleSuites[1].Cases[0].Failures},
+		},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Expected:\n%+v\ngot:\n%+v", expected, summary)
+	}
+
+	out.Reset()
+	if err := writeJSONSummary(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"suites": []`) || !strings.Contains(out.String(), `"failures": []`) {
+		t.Errorf("Expected empty lists rather than null, got %s", out.String())
+	}
+}
+
+func TestReportCollector(t *testing.T) {
+	r := &reportCollector{}
+	r.add("shadow", testCase{Name: "a"})
+	r.add("openapi", testCase{Name: "b"})
+	r.add("shadow", testCase{Name: "c"})
+	suites := r.snapshot()
+	if len(suites) != 2 || suites[0].Name != "shadow" || len(suites[0].Cases) != 2 || suites[1].Name != "openapi" {
+		t.Errorf("Expected cases grouped by suite in first-seen order, got %+v", suites)
+	}
+}
+
+func TestWriteReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	junit := filepath.Join(dir, "junit.xml")
+	summary := filepath.Join(dir, "summary.json")
+	if err := writeReports(junit, summary, sampleSuites); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{junit, summary} {
+		if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+			t.Errorf("Expected %s to be written, got %v", path, err)
+		}
+	}
+	if err := writeReports("", "", sampleSuites); err != nil {
+		t.Errorf("Expected no reports to be a no-op, got %v", err)
+	}
+	if err := writeReports(filepath.Join(dir, "missing", "junit.xml"), "", sampleSuites); err == nil {
+		t.Error("Expected an error for an invalid JUnit path, but got <nil>")
+	}
+	if err := writeReports("", filepath.Join(dir, "missing", "summary.json"), sampleSuites); err == nil {
+		t.Error("Expected an error for an invalid summary path, but got <nil>")
+	}
+}
+
+func TestRunReplayReports(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recording := filepath.Join(dir, "recording.jsonl")
+	event := HTTPEvent{PairID: "a", HTTPMethod: "GET", Endpoint: "/", ResponseCode: "200"}
+	if err := ioutil.WriteFile(recording, []byte(httpEventToString(event)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	junit := filepath.Join(dir, "junit.xml")
+	summary := filepath.Join(dir, "summary.json")
+	if code := runReplay([]string{"--target", server.URL, "--junit", junit, "--summary-json", summary, recording}); code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+	dat, err := ioutil.ReadFile(junit)
+	if err != nil || !strings.Contains(string(dat), `<testcase name="a GET /" classname="replay-zero.replay"`) {
+		t.Errorf("Expected a testcase for the event, got %s %v", dat, err)
+	}
+	if code := runReplay([]string{"--target", server.URL, "--junit", filepath.Join(dir, "missing", "junit.xml"), recording}); code != 1 {
+		t.Errorf("Expected exit code 1 when the report can't be written, got %d", code)
+	}
+}
+
+func TestProxyReport(t *testing.T) {
+	proxyReport = &reportCollector{}
+	defer func() { proxyReport = nil }()
+	spec, err := parseOpenAPISpec([]byte(`{"openapi": "3.0.0", "paths": {}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiSpec = spec
+	defer func() { apiSpec = nil }()
+
+	validateAgainstSpec(&HTTPEvent{PairID: "a", HTTPMethod: "GET", Endpoint: "/nowhere"})
+	newShadower("http://localhost", time.Second, defaultDiffEngine, nil).track(replayResult{Expected: HTTPEvent{PairID: "b"}})
+	suites := proxyReport.snapshot()
+	if len(suites) != 2 || suites[0].Name != "openapi" || suites[0].Cases[0].passed() || suites[1].Name != "shadow" || !suites[1].Cases[0].passed() {
+		t.Errorf("Expected a failing openapi case and a passing shadow case, got %+v", suites)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shadower mirrors proxied requests to a second upstream (ex. a new build of
+// the service) and diffs its responses against the primary ones
+type shadower struct {
+	target string
+	// bounds each shadow request, so a slow shadow never holds up recording for long
+	timeout time.Duration
+	client  *http.Client
+	engine  *diffEngine
+	// running report, one JSON line per shadowed event (optional)
+	report io.Writer
+
+	mu     sync.Mutex
+	passed int
+	failed int
+	// shadow requests still in flight
+	pending sync.WaitGroup
+}
+
+// Set when running with --shadow-target, nil otherwise
+var proxyShadow *shadower
+
+func newShadower(target string, timeout time.Duration, engine *diffEngine, report io.Writer) *shadower {
+	return &shadower{
+		target:  strings.TrimSuffix(target, "/"),
+		timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+		engine:  engine,
+		report:  report,
+	}
+}
+
+// shadowRequest is a request in flight to the shadow target
+type shadowRequest struct {
+	shadower *shadower
+	results  chan replayResult
+	paired   bool
+}
+
+// mirror starts sending a copy of an incoming request to the shadow target.
+// The caller must either pair it with the primary event, or abandon it.
+func (s *shadower) mirror(originalRequest *http.Request, body string) *shadowRequest {
+	var requestHeaders []Header
+	for key, value := range originalRequest.Header {
+		requestHeaders = append(requestHeaders, Header{key, strings.Join(value, ",")})
+	}
+	request := HTTPEvent{
+		HTTPMethod: originalRequest.Method,
+		Endpoint:   originalRequest.URL.Path,
+		Query:      originalRequest.URL.RawQuery,
+		ReqHeaders: requestHeaders,
+		ReqBody:    body,
+	}
+
+	s.pending.Add(1)
+	r := &shadowRequest{shadower: s, results: make(chan replayResult, 1)}
+	go func() {
+		// the primary response isn't known yet, so differences are computed once it is
+		r.results <- replayEvent(request, s.target, s.client, s.engine)
+	}()
+	return r
+}
+
+// pair waits (in the background) for the shadow response, attaches it and
+// its differences to the primary event, and hands the event on to h. The
+// primary event is always handed on, at the latest once the shadow timeout
+// is up: a shadow request failing or timing out is only reported as a FAIL.
+func (r *shadowRequest) pair(primary HTTPEvent, h eventHandler) {
+	r.paired = true
+	go func() {
+		defer r.shadower.pending.Done()
+		var result replayResult
+		timer := time.NewTimer(r.shadower.timeout)
+		select {
+		case result = <-r.results:
+			timer.Stop()
+		case <-timer.C:
+			result.Err = fmt.Errorf("Shadow request timed out after %s", r.shadower.timeout)
+		}
+		result.Expected = primary
+		if result.Err == nil {
+			result.Actual.PairID = primary.PairID
+			result.Differences = r.shadower.engine.diffEvents(primary, result.Actual)
+			primary.Shadow = &result.Actual
+			primary.ShadowDifferences = result.Differences
+		}
+		r.shadower.track(result)
+		h.handleEvent(primary)
+	}()
+}
+
+// abandon drops the shadow response when there's no primary event to pair it
+// with (ex. the primary upstream failed). It's a no-op once paired.
+func (r *shadowRequest) abandon() {
+	if !r.paired {
+		r.paired = true
+		r.shadower.pending.Done()
+	}
+}
+
+// track logs the outcome of a shadowed event and adds it to the running report
+func (s *shadower) track(result replayResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := "PASS"
+	if result.passed() {
+		s.passed++
+	} else {
+		status = "FAIL"
+		s.failed++
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Shadow %s %s %s %s (%d passed, %d failed so far)", status, result.Expected.PairID, result.Expected.HTTPMethod, result.Expected.Endpoint, s.passed, s.failed)
+	if result.Err != nil {
+		fmt.Fprintf(&b, "\n      error: %v", result.Err)
+	}
+	for _, d := range result.Differences {
+		fmt.Fprintf(&b, "\n      %s", d)
+	}
+	log.Println(b.String())
+	if proxyReport != nil {
+		proxyReport.add("shadow", replayTestCase("shadow", result))
+	}
+
+	if s.report == nil {
+		return
+	}
+	entry := replayReportEntry{
+		PairID:      result.Expected.PairID,
+		Method:      result.Expected.HTTPMethod,
+		Endpoint:    result.Expected.Endpoint,
+		Passed:      result.passed(),
+		DurationMs:  result.Duration.Milliseconds(),
+		Differences: result.Differences,
+	}
+	if entry.Differences == nil {
+		entry.Differences = []difference{}
+	}
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = s.report.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Printf("[ERROR] Could not write to shadow report: %v\n", err)
+	}
+}
+
+// wait blocks until every in-flight shadow request has been paired up
+// and handled, giving up after timeout. Paired events are handled within
+// the shadow timeout, so a longer timeout here doesn't lose any.
+func (s *shadower) wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("[ERROR] Timed out waiting for shadow requests to finish")
+	}
+}
+
+// summary is the final line of the running report
+func (s *shadower) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("Shadowed %d events to %s: %d passed, %d failed", s.passed+s.failed, s.target, s.passed, s.failed)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Responds with a fixed body, recording how many requests it saw
+func newStaticServer(body string, calls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func TestShadowServerHandler(t *testing.T) {
+	primaryCalls, shadowCalls := 0, 0
+	primary := newStaticServer(`{"id": 1, "name": "old"}`, &primaryCalls)
+	defer primary.Close()
+	shadowServer := newStaticServer(`{"id": 2, "name": "new"}`, &shadowCalls)
+	defer shadowServer.Close()
+
+	engine, err := newDiffEngine(diffRules{IgnorePaths: []string{"$.id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report bytes.Buffer
+	proxyShadow = newShadower(shadowServer.URL+"/", 5*time.Second, engine, &report)
+	defer func() { proxyShadow = nil }()
+
+	h := &capturingHandler{}
+	w := httptest.NewRecorder()
+	createServerHandler(h)(w, httptest.NewRequest("POST", primary.URL+"/api?a=1", strings.NewReader(`{"q": 1}`)))
+	proxyShadow.wait(5 * time.Second)
+
+	if w.Body.String() != `{"id": 1, "name": "old"}` {
+		t.Errorf("Expected the client to get the primary response, got %s", w.Body.String())
+	}
+	if primaryCalls != 1 || shadowCalls != 1 {
+		t.Errorf("Expected one call to each upstream, got %d and %d", primaryCalls, shadowCalls)
+	}
+	if len(h.events) != 1 {
+		t.Fatalf("Expected 1 paired event, got %d", len(h.events))
+	}
+	event := h.events[0]
+	if event.Shadow == nil || event.Shadow.RespBody != `{"id": 2, "name": "new"}` || event.Shadow.PairID != event.PairID {
+		t.Errorf("Expected the shadow response to be paired with the event, got %+v", event.Shadow)
+	}
+	if event.Shadow != nil && (event.Shadow.Query != "a=1" || event.Shadow.ReqBody != `{"q": 1}`) {
+		t.Errorf("Expected the shadow to get the same request, got %+v", event.Shadow)
+	}
+	if len(event.ShadowDifferences) != 1 || event.ShadowDifferences[0].Path != "$.name" {
+		t.Errorf("Expected only $.name to differ, got %v", event.ShadowDifferences)
+	}
+
+	entry := replayReportEntry{}
+	if err := json.Unmarshal(report.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON line in the report, got %v:\n%s", err, report.String())
+	}
+	if entry.PairID != event.PairID || entry.Passed || len(entry.Differences) != 1 {
+		t.Errorf("Expected a failing report entry for %s, got %+v", event.PairID, entry)
+	}
+	if summary := proxyShadow.summary(); !strings.Contains(summary, "Shadowed 1 events") || !strings.Contains(summary, "0 passed, 1 failed") {
+		t.Errorf("Unexpected summary %q", summary)
+	}
+}
+
+func TestShadowErrors(t *testing.T) {
+	primaryCalls, shadowCalls := 0, 0
+	primary := newStaticServer("ok", &primaryCalls)
+	defer primary.Close()
+	shadowServer := newStaticServer("ok", &shadowCalls)
+	shadowServer.Close()
+
+	proxyShadow = newShadower(shadowServer.URL, 5*time.Second, defaultDiffEngine, nil)
+	defer func() { proxyShadow = nil }()
+
+	h := &capturingHandler{}
+	serve := createServerHandler(h)
+	serve(httptest.NewRecorder(), httptest.NewRequest("GET", primary.URL+"/api", nil))
+	proxyShadow.wait(5 * time.Second)
+	if len(h.events) != 1 || h.events[0].Shadow != nil {
+		t.Errorf("Expected the event to be handled without a shadow, got %v", h.events)
+	}
+	if summary := proxyShadow.summary(); !strings.Contains(summary, "0 passed, 1 failed") {
+		t.Errorf("Expected an unreachable shadow to count as a failure, got %q", summary)
+	}
+
+	// nothing to pair the shadow response with when the primary is down
+	primary.Close()
+	serve(httptest.NewRecorder(), httptest.NewRequest("GET", primary.URL+"/api", nil))
+	proxyShadow.wait(5 * time.Second)
+	if len(h.events) != 1 {
+		t.Errorf("Expected no new event when the primary fails, got %d events", len(h.events))
+	}
+}
+
+func TestShadowTimeout(t *testing.T) {
+	primaryCalls := 0
+	primary := newStaticServer("ok", &primaryCalls)
+	defer primary.Close()
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	var report bytes.Buffer
+	proxyShadow = newShadower(hung.URL, 50*time.Millisecond, defaultDiffEngine, &report)
+	defer func() { proxyShadow = nil }()
+
+	h := &capturingHandler{}
+	start := time.Now()
+	createServerHandler(h)(httptest.NewRecorder(), httptest.NewRequest("GET", primary.URL+"/api", nil))
+	proxyShadow.wait(5 * time.Second)
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the event to be recorded once the shadow timed out, took %s", time.Since(start))
+	}
+	if len(h.events) != 1 || h.events[0].Shadow != nil {
+		t.Errorf("Expected the event to be handled without a shadow, got %v", h.events)
+	}
+	entry := replayReportEntry{}
+	if err := json.Unmarshal(report.Bytes(), &entry); err != nil || entry.Passed || entry.Error == "" {
+		t.Errorf("Expected a failing report entry with an error, got %+v %v", entry, err)
+	}
+
+	// the event is handed on even if the shadow response never comes back
+	s := newShadower(hung.URL, 10*time.Millisecond, defaultDiffEngine, nil)
+	s.pending.Add(1)
+	r := &shadowRequest{shadower: s, results: make(chan replayResult, 1)}
+	r.pair(generateSampleEvent(), h)
+	s.wait(5 * time.Second)
+	if len(h.events) != 2 || !strings.Contains(s.summary(), "0 passed, 1 failed") {
+		t.Errorf("Expected a stuck shadow request to fail without holding the event, got %d events and %q", len(h.events), s.summary())
+	}
+}
+
+func TestShadowSkipsAbortingFaults(t *testing.T) {
+	primaryCalls, shadowCalls := 0, 0
+	primary := newStaticServer("ok", &primaryCalls)
+	defer primary.Close()
+	shadowServer := newStaticServer("ok", &shadowCalls)
+	defer shadowServer.Close()
+
+	var report bytes.Buffer
+	proxyShadow = newShadower(shadowServer.URL, 5*time.Second, defaultDiffEngine, &report)
+	defer func() { proxyShadow = nil }()
+	injector, err := newFaultInjector([]faultRule{{Fault: faultStatus, Status: 503}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyFaults = injector
+	defer func() { proxyFaults = nil }()
+
+	h := &capturingHandler{}
+	createServerHandler(h)(httptest.NewRecorder(), httptest.NewRequest("POST", primary.URL+"/api", strings.NewReader(`{"q": 1}`)))
+	proxyShadow.wait(5 * time.Second)
+	if primaryCalls != 0 || shadowCalls != 0 {
+		t.Errorf("Expected neither upstream to get the faulted request, got %d and %d calls", primaryCalls, shadowCalls)
+	}
+	if len(h.events) != 1 || h.events[0].Shadow != nil || report.Len() != 0 {
+		t.Errorf("Expected the event to be handled without a shadow, got %v and report %q", h.events, report.String())
+	}
+}
+
+func TestShadowWaitTimeout(t *testing.T) {
+	s := newShadower("http://localhost", time.Second, defaultDiffEngine, nil)
+	s.pending.Add(1)
+	defer s.pending.Done()
+	start := time.Now()
+	s.wait(10 * time.Millisecond)
+	if time.Since(start) > time.Second {
+		t.Error("Expected wait to give up after the timeout")
+	}
+}
@@ -16,16 +16,37 @@ type Header struct {
 	Value string `json:"value"`
 }
 
+// eventSchemaVersion is bumped when HTTPEvent changes in a way consumers need to know about
+const eventSchemaVersion = 1
+
 // HTTPEvent is the JSON representation of an HTTP event.
 type HTTPEvent struct {
 	PairID       string   `json:"event_pair_id"`
 	HTTPMethod   string   `json:"http_method"`
 	Endpoint     string   `json:"endpoint"`
+	Query        string   `json:"query,omitempty"`
 	ReqHeaders   []Header `json:"req_headers"`
 	ReqBody      string   `json:"request_body"`
 	RespHeaders  []Header `json:"resp_headers"`
 	RespBody     string   `json:"response_body"`
 	ResponseCode string   `json:"http_response_code"`
+	// Unix time in milliseconds when the request was received
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Populated when validating against an OpenAPI spec (--openapi)
+	SpecViolations []string `json:"spec_violations,omitempty"`
+	// Populated when the proxy injected a fault into this exchange (--faults)
+	Fault *Fault `json:"fault,omitempty"`
+	// Populated in learn mode (--learn): JSONPaths of response body values that changed
+	// between identical requests, mapped to their kind (uuid, string, number, boolean or any)
+	VolatileFields map[string]string `json:"volatile_fields,omitempty"`
+	// Populated in learn mode (--learn): response headers that changed between identical requests
+	VolatileHeaders []string `json:"volatile_headers,omitempty"`
+	// Populated when shadowing (--shadow-target): the shadow upstream's response
+	// to the same request, and how it differs from this one
+	Shadow            *HTTPEvent   `json:"shadow,omitempty"`
+	ShadowDifferences []difference `json:"shadow_differences,omitempty"`
+	// Set on streamed events (see eventSchemaVersion), so consumers can tell which fields to expect
+	SchemaVersion int `json:"schema_version,omitempty"`
 }
 
 type eventHandler interface {
@@ -46,6 +67,21 @@ func httpEventToString(data HTTPEvent) string {
 	return string(s)
 }
 
+// findHeader returns the value of a header by case-insensitive name, or "" if missing
+func findHeader(headers []Header, name string) string {
+	value, _ := lookupHeader(headers, name)
+	return value
+}
+
+func lookupHeader(headers []Header, name string) (string, bool) {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value, true
+		}
+	}
+	return "", false
+}
+
 // https://stackoverflow.com/a/37335777
 // Process the largest indices marked for removal first.
 // Processing smaller indices could make larger indices
@@ -78,6 +114,7 @@ func convertRequestResponse(request *http.Request, response *http.Response, reqB
 		PairID:       uuid.String(),
 		HTTPMethod:   request.Method,
 		Endpoint:     request.URL.Path,
+		Query:        request.URL.RawQuery,
 		ReqHeaders:   requestHeaders,
 		ReqBody:      reqBody,
 		RespHeaders:  responseHeaders,
@@ -117,3 +117,17 @@ func headersAreEqual(h1, h2 []Header) bool {
 
 	return true
 }
+
+func TestConvertRequestResponseQuery(t *testing.T) {
+	request := http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/path/to", RawQuery: "a=1&b=2"},
+	}
+	httpEvent, err := convertRequestResponse(&request, &http.Response{StatusCode: 200}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if httpEvent.Query != "a=1&b=2" {
+		t.Errorf("Expected query a=1&b=2, got %s", httpEvent.Query)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Events waiting for a sink, by default. Events for a sink that falls this far behind are dropped.
+const defaultSinkQueueSize = 1000
+
+// How long flushing waits for the sinks to catch up on shutdown
+const sinkDrainTimeout = 30 * time.Second
+
+// sinkConfig is one sink in a sinks file (--sinks)
+type sinkConfig struct {
+	Name string `yaml:"name"`
+	// A registered sink type, see sinkTypes
+	Type   string     `yaml:"type"`
+	Filter sinkFilter `yaml:"filter"`
+	// Events waiting for the sink (default 1000)
+	QueueSize int `yaml:"queue_size"`
+	// Settings of the sink type, decoded by its factory
+	Options yaml.Node `yaml:"options"`
+}
+
+// sinkFilter picks the events a sink gets, every field is optional
+type sinkFilter struct {
+	Methods []string `yaml:"methods"`
+	// Globs (ex. /api/orders/*) matched against the endpoint
+	Paths        []string `yaml:"paths"`
+	ExcludePaths []string `yaml:"exclude_paths"`
+	// Response codes (ex. 404) or classes (ex. 5xx)
+	Status []string `yaml:"status"`
+}
+
+// sinkFactory builds a sink from its options (see decodeSinkOptions)
+type sinkFactory func(options *yaml.Node) (eventHandler, error)
+
+// sinkTypes maps the type of a sink in a sinks file to its factory
+var sinkTypes = map[string]sinkFactory{}
+
+// registerSink makes a sink type available to sinks files
+func registerSink(kind string, factory sinkFactory) {
+	sinkTypes[kind] = factory
+}
+
+func init() {
+	registerSink("template", newTemplateSink)
+	registerSink("archive", newArchiveSink)
+	registerSink("kinesis", newKinesisSink)
+}
+
+// decodeSinkOptions decodes the options of a sink into out, which holds the defaults.
+// Unknown options are an error, to catch typos.
+func decodeSinkOptions(options *yaml.Node, out interface{}) error {
+	if options.Kind == 0 {
+		return nil
+	}
+	dat, err := yaml.Marshal(options)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(dat))
+	decoder.KnownFields(true)
+	return decoder.Decode(out)
+}
+
+func (f *sinkFilter) validate() error {
+	for _, pattern := range append(append([]string{}, f.Paths...), f.ExcludePaths...) {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+	}
+	for _, status := range f.Status {
+		class := strings.TrimSuffix(strings.ToLower(status), "xx")
+		if _, err := strconv.Atoi(class); err != nil || len(status) != 3 {
+			return fmt.Errorf("invalid status %q, expected a code (ex. 404) or a class (ex. 5xx)", status)
+		}
+	}
+	return nil
+}
+
+func (f *sinkFilter) matches(event HTTPEvent) bool {
+	if len(f.Methods) > 0 && !containsFold(f.Methods, event.HTTPMethod) {
+		return false
+	}
+	if len(f.Paths) > 0 && !matchesAny(f.Paths, event.Endpoint) {
+		return false
+	}
+	if matchesAny(f.ExcludePaths, event.Endpoint) {
+		return false
+	}
+	if len(f.Status) == 0 {
+		return true
+	}
+	for _, status := range f.Status {
+		// validated when loading the sinks
+		if status == event.ResponseCode || (strings.HasSuffix(strings.ToLower(status), "xx") && strings.HasPrefix(event.ResponseCode, status[:1])) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, endpoint string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, endpoint); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sinkRunner feeds events to a sink from its own goroutine, so a slow or
+// failing sink doesn't hold up the proxy or the other sinks
+type sinkRunner struct {
+	name   string
+	sink   eventHandler
+	filter sinkFilter
+	queue  chan HTTPEvent
+	done   chan struct{}
+
+	delivered int64
+	dropped   int64
+	failed    int64
+}
+
+func (r *sinkRunner) run() {
+	defer close(r.done)
+	for event := range r.queue {
+		if r.call(func() { r.sink.handleEvent(event) }) {
+			atomic.AddInt64(&r.delivered, 1)
+		}
+	}
+}
+
+// call runs f, returning false if the sink panicked
+func (r *sinkRunner) call(f func()) (ok bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			atomic.AddInt64(&r.failed, 1)
+			log.Printf("[ERROR] Sink %s failed: %v\n", r.name, p)
+			ok = false
+		}
+	}()
+	f()
+	return true
+}
+
+func (r *sinkRunner) summary() string {
+	return fmt.Sprintf("Sink %s: delivered=%d dropped=%d failed=%d", r.name,
+		atomic.LoadInt64(&r.delivered), atomic.LoadInt64(&r.dropped), atomic.LoadInt64(&r.failed))
+}
+
+// fanOut is the eventHandler sending events to every sink in a sinks file
+type fanOut struct {
+	runners []*sinkRunner
+	// guards against sending events to closed queues once flushed
+	mu     sync.RWMutex
+	closed bool
+}
+
+func loadSinks(filePath string) (*fanOut, error) {
+	dat, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	config := struct {
+		Sinks []sinkConfig `yaml:"sinks"`
+	}{}
+	if err := yaml.Unmarshal(dat, &config); err != nil {
+		return nil, fmt.Errorf("Could not parse sinks %s: %w", filePath, err)
+	}
+	return newFanOut(config.Sinks)
+}
+
+func newFanOut(configs []sinkConfig) (*fanOut, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("No sinks configured")
+	}
+	names := map[string]bool{}
+	runners := []*sinkRunner{}
+	for i := range configs {
+		c := &configs[i]
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("%s-%d", c.Type, i+1)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("Sink %s: name used twice", c.Name)
+		}
+		names[c.Name] = true
+		factory, ok := sinkTypes[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("Sink %s: unknown type %q, expected one of [%s]", c.Name, c.Type, strings.Join(registeredSinkTypes(), ", "))
+		}
+		if err := c.Filter.validate(); err != nil {
+			return nil, fmt.Errorf("Sink %s: %w", c.Name, err)
+		}
+		if c.QueueSize < 0 {
+			return nil, fmt.Errorf("Sink %s: queue_size can't be negative", c.Name)
+		}
+		if c.QueueSize == 0 {
+			c.QueueSize = defaultSinkQueueSize
+		}
+		sink, err := factory(&c.Options)
+		if err != nil {
+			return nil, fmt.Errorf("Sink %s: %w", c.Name, err)
+		}
+		runners = append(runners, &sinkRunner{
+			name:   c.Name,
+			sink:   sink,
+			filter: c.Filter,
+			queue:  make(chan HTTPEvent, c.QueueSize),
+			done:   make(chan struct{}),
+		})
+	}
+	for _, r := range runners {
+		go r.run()
+	}
+	return &fanOut{runners: runners}, nil
+}
+
+func registeredSinkTypes() []string {
+	kinds := []string{}
+	for kind := range sinkTypes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func (f *fanOut) handleEvent(event HTTPEvent) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return
+	}
+	for _, r := range f.runners {
+		if !r.filter.matches(event) {
+			continue
+		}
+		select {
+		case r.queue <- copyEvent(event):
+		default:
+			atomic.AddInt64(&r.dropped, 1)
+			logWarn(fmt.Sprintf("Sink %s is falling behind, dropped event %s %s", r.name, event.HTTPMethod, event.Endpoint))
+		}
+	}
+}
+
+// copyEvent gives each sink its own copy of an event's slices and maps, since
+// sinks run concurrently and some edit them (ex. removing Replay_ headers)
+func copyEvent(event HTTPEvent) HTTPEvent {
+	event.ReqHeaders = append([]Header(nil), event.ReqHeaders...)
+	event.RespHeaders = append([]Header(nil), event.RespHeaders...)
+	event.SpecViolations = append([]string(nil), event.SpecViolations...)
+	event.VolatileHeaders = append([]string(nil), event.VolatileHeaders...)
+	event.ShadowDifferences = append([]difference(nil), event.ShadowDifferences...)
+	if event.VolatileFields != nil {
+		fields := make(map[string]string, len(event.VolatileFields))
+		for path, kind := range event.VolatileFields {
+			fields[path] = kind
+		}
+		event.VolatileFields = fields
+	}
+	if event.Fault != nil {
+		fault := *event.Fault
+		event.Fault = &fault
+	}
+	if event.Shadow != nil {
+		shadow := copyEvent(*event.Shadow)
+		event.Shadow = &shadow
+	}
+	return event
+}
+
+// Waits for every sink to catch up, then flushes them
+func (f *fanOut) flushBuffer() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	for _, r := range f.runners {
+		close(r.queue)
+	}
+	f.mu.Unlock()
+
+	deadline := time.NewTimer(sinkDrainTimeout)
+	defer deadline.Stop()
+	expired := false
+	for _, r := range f.runners {
+		if !expired {
+			select {
+			case <-r.done:
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		select {
+		case <-r.done:
+			r.call(r.sink.flushBuffer)
+		default:
+			log.Printf("[ERROR] Gave up waiting for sink %s, %d events were not delivered\n", r.name, len(r.queue))
+		}
+		log.Println(r.summary())
+	}
+}
+
+// - - - - - - - - - - - - -
+//      BUILT-IN SINKS
+// - - - - - - - - - - - - -
+
+// newTemplateSink writes events out with a template, like offline mode
+func newTemplateSink(options *yaml.Node) (eventHandler, error) {
+	config := struct {
+		Template  string `yaml:"template"`
+		Extension string `yaml:"extension"`
+		BatchSize int    `yaml:"batch_size"`
+		// Where files are written, the current directory by default
+		Dir string `yaml:"dir"`
+	}{Template: "karate", BatchSize: 1}
+	if err := decodeSinkOptions(options, &config); err != nil {
+		return nil, err
+	}
+	if !isBuiltinTemplate(config.Template) {
+		if _, err := ioutil.ReadFile(config.Template); err != nil {
+			return nil, err
+		}
+		if config.Extension == "" {
+			return nil, fmt.Errorf("custom template %s needs an extension", config.Template)
+		}
+	}
+	if config.BatchSize == 0 {
+		return nil, fmt.Errorf("batch_size can't be zero")
+	}
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &offlineHandler{
+		format:           getFormat(config.Template, config.Extension),
+		defaultBatchSize: config.BatchSize,
+		currentBatchSize: config.BatchSize,
+		dir:              config.Dir,
+		writerFactory:    getFileWriter,
+		templateFuncMap:  getTemplateFuncMap(),
+	}, nil
+}
+
+// newArchiveSink appends events to a JSONL archive
+func newArchiveSink(options *yaml.Node) (eventHandler, error) {
+	config := struct {
+		Path string `yaml:"path"`
+	}{}
+	if err := decodeSinkOptions(options, &config); err != nil {
+		return nil, err
+	}
+	if config.Path == "" {
+		return nil, fmt.Errorf("archive sinks need a path")
+	}
+	return newArchiveHandler(config.Path)
+}
+
+// newKinesisSink streams events to Kinesis, taking the same settings as the streaming flags
+func newKinesisSink(options *yaml.Node) (eventHandler, error) {
+	config := onlineDefaults
+	if err := decodeSinkOptions(options, &config); err != nil {
+		return nil, err
+	}
+	return newOnlineHandler(config)
+}
+
+// archiveHandler appends events to a JSONL archive, as read by replay, load and mock
+type archiveHandler struct {
+	path string
+	file *os.File
+}
+
+func newArchiveHandler(path string) (*archiveHandler, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveHandler{path: path, file: f}, nil
+}
+
+func (h *archiveHandler) handleEvent(event HTTPEvent) {
+	_, err := h.file.WriteString(httpEventToString(event) + "\n")
+	logErr(err)
+}
+
+func (h *archiveHandler) flushBuffer() {
+	logErr(h.file.Sync())
+}
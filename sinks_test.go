@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// - - - - - - - - - - - - -
+//        UTILITIES
+// - - - - - - - - - - - - -
+
+// Handlers for "test" sinks, picked by their handler option
+var testSinks = map[string]eventHandler{}
+
+func init() {
+	registerSink("test", func(options *yaml.Node) (eventHandler, error) {
+		config := struct {
+			Handler string `yaml:"handler"`
+		}{}
+		if err := decodeSinkOptions(options, &config); err != nil {
+			return nil, err
+		}
+		return testSinks[config.Handler], nil
+	})
+}
+
+func testSinkConfig(t *testing.T, name string, handler eventHandler, filter sinkFilter) sinkConfig {
+	testSinks[name] = handler
+	c := sinkConfig{Name: name, Type: "test", Filter: filter}
+	if err := yaml.Unmarshal([]byte("handler: "+name), &c.Options); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Panics on every event
+type panickingHandler struct{}
+
+func (h *panickingHandler) handleEvent(HTTPEvent) { panic("sink is broken") }
+func (h *panickingHandler) flushBuffer()          { panic("sink is still broken") }
+
+// Blocks on every event until released
+type blockingHandler struct {
+	syncCapturingHandler
+	release chan struct{}
+	once    sync.Once
+}
+
+func (h *blockingHandler) handleEvent(e HTTPEvent) {
+	<-h.release
+	h.syncCapturingHandler.handleEvent(e)
+}
+
+func (h *blockingHandler) unblock() {
+	h.once.Do(func() { close(h.release) })
+}
+
+func eventFor(method, endpoint, status string) HTTPEvent {
+	e := generateSampleEvent()
+	e.HTTPMethod, e.Endpoint, e.ResponseCode = method, endpoint, status
+	return e
+}
+
+// - - - - - - - - - - - - -
+//          TESTS
+// - - - - - - - - - - - - -
+
+func TestSinkFilter(t *testing.T) {
+	var filterTests = []struct {
+		name     string
+		filter   sinkFilter
+		event    HTTPEvent
+		expected bool
+	}{
+		{"empty", sinkFilter{}, eventFor("GET", "/api", "200"), true},
+		{"method", sinkFilter{Methods: []string{"post", "PUT"}}, eventFor("POST", "/api", "200"), true},
+		{"other method", sinkFilter{Methods: []string{"post"}}, eventFor("GET", "/api", "200"), false},
+		{"path", sinkFilter{Paths: []string{"/api/orders/*"}}, eventFor("GET", "/api/orders/1", "200"), true},
+		{"other path", sinkFilter{Paths: []string{"/api/orders/*"}}, eventFor("GET", "/api/users/1", "200"), false},
+		{"excluded", sinkFilter{Paths: []string{"/api/*"}, ExcludePaths: []string{"/api/health"}}, eventFor("GET", "/api/health", "200"), false},
+		{"status", sinkFilter{Status: []string{"404"}}, eventFor("GET", "/api", "404"), true},
+		{"status class", sinkFilter{Status: []string{"200", "5xx"}}, eventFor("GET", "/api", "503"), true},
+		{"other status", sinkFilter{Status: []string{"5xx"}}, eventFor("GET", "/api", "404"), false},
+	}
+	for _, tt := range filterTests {
+		if err := tt.filter.validate(); err != nil {
+			t.Errorf("%s: expected a valid filter, got %v", tt.name, err)
+		}
+		if matched := tt.filter.matches(tt.event); matched != tt.expected {
+			t.Errorf("%s: expected match=%v, got %v", tt.name, tt.expected, matched)
+		}
+	}
+
+	for _, invalid := range []sinkFilter{{Paths: []string{"["}}, {ExcludePaths: []string{"["}}, {Status: []string{"5x"}}, {Status: []string{"abc"}}} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("Expected an error for filter %+v, but got <nil>", invalid)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	all, orders, errors := &syncCapturingHandler{}, &syncCapturingHandler{}, &syncCapturingHandler{}
+	f, err := newFanOut([]sinkConfig{
+		testSinkConfig(t, "all", all, sinkFilter{}),
+		testSinkConfig(t, "orders", orders, sinkFilter{Paths: []string{"/api/orders*"}}),
+		testSinkConfig(t, "errors", errors, sinkFilter{Status: []string{"5xx"}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.handleEvent(eventFor("GET", "/api/orders", "200"))
+	f.handleEvent(eventFor("GET", "/api/users", "500"))
+	f.flushBuffer()
+	f.handleEvent(eventFor("GET", "/api/orders", "500"))
+
+	if len(all.events) != 2 || len(orders.events) != 1 || len(errors.events) != 1 {
+		t.Errorf("Expected 2, 1 and 1 events, got %d, %d and %d", len(all.events), len(orders.events), len(errors.events))
+	}
+	if orders.events[0].Endpoint != "/api/orders" || errors.events[0].Endpoint != "/api/users" {
+		t.Errorf("Expected each sink to get the events matching its filter, got %+v and %+v", orders.events, errors.events)
+	}
+}
+
+func TestFanOutCopiesEvents(t *testing.T) {
+	other := &syncCapturingHandler{}
+	f, err := newFanOut([]sinkConfig{
+		testSinkConfig(t, "template", &offlineHandler{writerFactory: emptyWriter}, sinkFilter{}),
+		testSinkConfig(t, "other", other, sinkFilter{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := generateSampleEvent()
+	event.ReqHeaders = []Header{{"Replay_batch", "5"}, {"A", "1"}, {"B", "2"}}
+	expected := append([]Header(nil), event.ReqHeaders...)
+	f.handleEvent(event)
+	f.flushBuffer()
+
+	// the template sink removes Replay_ headers, which mustn't change what the others get
+	if len(other.events) != 1 {
+		t.Fatalf("Expected the other sink to get the event, got %d events", len(other.events))
+	}
+	if !reflect.DeepEqual(event.ReqHeaders, expected) || !reflect.DeepEqual(other.events[0].ReqHeaders, expected) {
+		t.Errorf("Expected headers %v to be left alone, got %v and %v", expected, event.ReqHeaders, other.events[0].ReqHeaders)
+	}
+}
+
+func TestFanOutIsolation(t *testing.T) {
+	healthy := &syncCapturingHandler{}
+	slow := &blockingHandler{release: make(chan struct{})}
+	defer slow.unblock()
+	slowConfig := testSinkConfig(t, "slow", slow, sinkFilter{})
+	slowConfig.QueueSize = 1
+	f, err := newFanOut([]sinkConfig{
+		testSinkConfig(t, "broken", &panickingHandler{}, sinkFilter{}),
+		slowConfig,
+		testSinkConfig(t, "healthy", healthy, sinkFilter{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		f.handleEvent(generateSampleEvent())
+	}
+	if h := healthy.last(); h.PairID == "" {
+		t.Fatal("Expected the healthy sink to get events while the others are stuck")
+	}
+	slow.unblock()
+	f.flushBuffer()
+
+	broken, slowRunner, healthyRunner := f.runners[0], f.runners[1], f.runners[2]
+	if broken.failed != 6 || broken.delivered != 0 {
+		t.Errorf("Expected the broken sink to fail 5 events and its flush, got %s", broken.summary())
+	}
+	// one event taken off the queue, one waiting in it, the rest dropped
+	if slowRunner.dropped == 0 || slowRunner.delivered+slowRunner.dropped != 5 || len(slow.events) != int(slowRunner.delivered) {
+		t.Errorf("Expected the slow sink to drop events once its queue was full, got %s", slowRunner.summary())
+	}
+	if healthyRunner.delivered != 5 || len(healthy.events) != 5 {
+		t.Errorf("Expected the healthy sink to get all 5 events, got %s", healthyRunner.summary())
+	}
+}
+
+func TestNewFanOutErrors(t *testing.T) {
+	unknownOption := testSinkConfig(t, "typo", &syncCapturingHandler{}, sinkFilter{})
+	if err := yaml.Unmarshal([]byte("handlr: typo"), &unknownOption.Options); err != nil {
+		t.Fatal(err)
+	}
+	var errorTests = []struct {
+		name    string
+		configs []sinkConfig
+		message string
+	}{
+		{"none", nil, "No sinks"},
+		{"unknown type", []sinkConfig{{Type: "carrier-pigeon"}}, "unknown type"},
+		{"same name", []sinkConfig{{Name: "a", Type: "test"}, {Name: "a", Type: "test"}}, "name used twice"},
+		{"bad filter", []sinkConfig{{Type: "test", Filter: sinkFilter{Status: []string{"oops"}}}}, "invalid status"},
+		{"negative queue", []sinkConfig{{Type: "test", QueueSize: -1}}, "queue_size"},
+		{"unknown option", []sinkConfig{unknownOption}, "handlr"},
+		{"archive without path", []sinkConfig{{Type: "archive"}}, "need a path"},
+		{"kinesis without stream", []sinkConfig{{Type: "kinesis"}}, "name required"},
+	}
+	for _, tt := range errorTests {
+		_, err := newFanOut(tt.configs)
+		if err == nil || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.message, err)
+		}
+	}
+}
+
+func TestLoadSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sinksFile := filepath.Join(dir, "sinks.yaml")
+	archive := filepath.Join(dir, "events.jsonl")
+	sinks := `sinks:
+  - name: karate
+    type: template
+    filter:
+      exclude_paths: [/health]
+    options:
+      template: karate
+      batch_size: 2
+      dir: ` + filepath.Join(dir, "karate") + `
+  - type: archive
+    options:
+      path: ` + archive + `
+`
+	if err := ioutil.WriteFile(sinksFile, []byte(sinks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := loadSinks(sinksFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.runners[0].name != "karate" || f.runners[1].name != "archive-2" {
+		t.Errorf("Expected sinks karate and archive-2, got %s and %s", f.runners[0].name, f.runners[1].name)
+	}
+	f.handleEvent(eventFor("GET", "/health", "200"))
+	f.handleEvent(eventFor("GET", "/api", "200"))
+	f.handleEvent(eventFor("POST", "/api", "201"))
+	f.flushBuffer()
+
+	written, err := ioutil.ReadDir(filepath.Join(dir, "karate"))
+	if err != nil || len(written) != 1 || written[0].Name() != "replay_scenarios_0.feature" {
+		t.Errorf("Expected one karate file with both /api events, got %v %v", written, err)
+	}
+	dat, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(dat)), "\n")
+	if len(lines) != 3 || parseHTTPEvent(lines[0]).Endpoint != "/health" {
+		t.Errorf("Expected all 3 events in the archive, got %q", lines)
+	}
+
+	for _, bad := range []string{"sinks: {", "sinks:\n  - type: template\n    options:\n      templat: karate\n"} {
+		if err := ioutil.WriteFile(sinksFile, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSinks(sinksFile); err == nil {
+			t.Errorf("Expected an error for sinks %q, but got <nil>", bad)
+		}
+	}
+	if _, err := loadSinks(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("Expected an error for a missing file, but got <nil>")
+	}
+}
+
+func TestFanOutFlushTimeout(t *testing.T) {
+	stuck := &blockingHandler{release: make(chan struct{})}
+	defer stuck.unblock()
+	f, err := newFanOut([]sinkConfig{testSinkConfig(t, "stuck", stuck, sinkFilter{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.handleEvent(generateSampleEvent())
+	done := make(chan struct{})
+	go func() {
+		f.flushBuffer()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Error("Expected flushing to wait for the stuck sink")
+	case <-time.After(50 * time.Millisecond):
+	}
+	stuck.unblock()
+	<-done
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What to do when the spool is full
+const (
+	spoolDropOldest = "drop-oldest" // make room by deleting the oldest undelivered events
+	spoolBlock      = "block"       // wait for deliveries to make room
+)
+
+const (
+	spoolExtension = ".json"
+	// most entries handed to a single delivery, by default
+	spoolBatchEntries = 100
+)
+
+// spool is a write-ahead directory of events waiting to be delivered. Every
+// event is saved to its own file before anything is sent, and only deleted
+// once delivered, so whatever couldn't be sent is picked up on the next run.
+type spool struct {
+	dir      string
+	maxBytes int64
+	policy   string
+	// first wait after a failed delivery, see retryBackoff
+	retryBase time.Duration
+	// most entries handed to a single delivery
+	batchEntries int
+
+	mu      sync.Mutex
+	changed *sync.Cond
+	// oldest first
+	entries []spoolEntry
+	size    int64
+	seq     int
+	dropped int
+}
+
+type spoolEntry struct {
+	name string
+	size int64
+}
+
+// openSpool creates the spool directory, or resumes the events left in it
+func openSpool(dir string, maxBytes int64, policy string) (*spool, error) {
+	if policy != spoolDropOldest && policy != spoolBlock {
+		return nil, fmt.Errorf("Unknown spool policy %q, expected one of [drop-oldest, block]", policy)
+	}
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("Spool size must be positive, got %d", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, maxBytes: maxBytes, policy: policy, retryBase: 500 * time.Millisecond, batchEntries: spoolBatchEntries}
+	s.changed = sync.NewCond(&s.mu)
+	for _, f := range files {
+		switch {
+		case strings.HasSuffix(f.Name(), ".tmp"):
+			// never finished writing, so never acknowledged
+			logErr(os.Remove(filepath.Join(dir, f.Name())))
+		case strings.HasSuffix(f.Name(), spoolExtension):
+			s.entries = append(s.entries, spoolEntry{name: f.Name(), size: f.Size()})
+			s.size += f.Size()
+		}
+	}
+	// names start with a zero padded timestamp, so they sort oldest first
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].name < s.entries[j].name })
+	if len(s.entries) > 0 {
+		log.Printf("Resuming %d spooled events (%d bytes) from %s\n", len(s.entries), s.size, dir)
+	}
+	if policy == spoolDropOldest {
+		s.mu.Lock()
+		s.makeRoom(0)
+		s.mu.Unlock()
+	}
+	return s, nil
+}
+
+// append saves an event to the spool, making room for it according to the policy
+func (s *spool) append(data []byte) error {
+	size := int64(len(data))
+	if size > s.maxBytes {
+		return fmt.Errorf("Event of %d bytes is larger than the whole spool (%d bytes)", size, s.maxBytes)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policy == spoolBlock {
+		for s.size+size > s.maxBytes {
+			s.changed.Wait()
+		}
+	} else {
+		s.makeRoom(size)
+	}
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spoolExtension)
+	if err := writeFileSynced(filepath.Join(s.dir, name), data); err != nil {
+		return fmt.Errorf("Could not spool event: %w", err)
+	}
+	s.entries = append(s.entries, spoolEntry{name: name, size: size})
+	s.size += size
+	s.changed.Broadcast()
+	return nil
+}
+
+// makeRoom drops the oldest entries until size more bytes fit (s.mu must be held)
+func (s *spool) makeRoom(size int64) {
+	for len(s.entries) > 0 && s.size+size > s.maxBytes {
+		oldest := s.entries[0]
+		if err := os.Remove(filepath.Join(s.dir, oldest.name)); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		s.entries = s.entries[1:]
+		s.size -= oldest.size
+		s.dropped++
+		logWarn(fmt.Sprintf("Spool is full, dropped the oldest event (%s)", oldest.name))
+	}
+}
+
+// writeFileSynced writes a file to disk before it shows up under its name
+func writeFileSynced(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// next waits for events to be spooled and returns the oldest ones
+func (s *spool) next() []spoolEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.entries) == 0 {
+		s.changed.Wait()
+	}
+	batch := make([]spoolEntry, min(len(s.entries), s.batchEntries))
+	copy(batch, s.entries)
+	return batch
+}
+
+// remove forgets delivered entries (some may already have been dropped)
+func (s *spool) remove(delivered []spoolEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range delivered {
+		for i, e := range s.entries {
+			if e.name == d.name {
+				s.entries = append(s.entries[:i], s.entries[i+1:]...)
+				s.size -= e.size
+				break
+			}
+		}
+		if err := os.Remove(filepath.Join(s.dir, d.name)); err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+	s.changed.Broadcast()
+}
+
+// deliver sends spooled events, oldest first, for as long as the program runs.
+// A failed delivery is retried (with the same events) after a growing delay.
+func (s *spool) deliver(send func(payloads [][]byte) error) {
+	s.deliverPartial(func(payloads [][]byte) (int, error) {
+		if err := send(payloads); err != nil {
+			return 0, err
+		}
+		return len(payloads), nil
+	})
+}
+
+// deliverPartial is deliver for senders that can get some of the events through
+// before failing: send returns how many of them (oldest first) were delivered,
+// and only the rest are retried.
+func (s *spool) deliverPartial(send func(payloads [][]byte) (int, error)) {
+	backoff := newRetryBackoff(s.retryBase, time.Minute)
+	for {
+		batch := s.next()
+		payloads := [][]byte{}
+		delivered := []spoolEntry{}
+		for _, e := range batch {
+			dat, err := ioutil.ReadFile(filepath.Join(s.dir, e.name))
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("[ERROR] Could not read spooled event, dropping it: %v\n", err)
+				}
+				// either dropped to make room, or unreadable: nothing to send
+				s.remove([]spoolEntry{e})
+				continue
+			}
+			payloads = append(payloads, dat)
+			delivered = append(delivered, e)
+		}
+		if len(payloads) == 0 {
+			continue
+		}
+		sent, err := send(payloads)
+		s.remove(delivered[:sent])
+		if err != nil {
+			wait := backoff.next()
+			log.Printf("Could not deliver %d spooled events, retrying in %s: %v\n", len(payloads)-sent, wait.Round(time.Millisecond), err)
+			time.Sleep(wait)
+			continue
+		}
+		backoff.reset()
+	}
+}
+
+// wait gives deliveries up to timeout to empty the spool, returning how many events are left
+func (s *spool) wait(timeout time.Duration) int {
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		left := len(s.entries)
+		s.mu.Unlock()
+		if left == 0 || time.Now().After(deadline) {
+			return left
+		}
+	}
+}
+
+// retryBackoff is an exponential backoff with "full jitter": the nth wait is
+// random, between 0 and base * 2^n (up to max)
+type retryBackoff struct {
+	base, max time.Duration
+	attempt   int
+	rand      *rand.Rand
+}
+
+func newRetryBackoff(base, max time.Duration) *retryBackoff {
+	return &retryBackoff{base: base, max: max, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *retryBackoff) next() time.Duration {
+	ceiling := b.max
+	if b.attempt < 32 && b.base<<uint(b.attempt) < b.max {
+		ceiling = b.base << uint(b.attempt)
+	}
+	b.attempt++
+	return time.Duration(b.rand.Int63n(int64(ceiling) + 1))
+}
+
+func (b *retryBackoff) reset() {
+	b.attempt = 0
+}
+
+// parseByteSize reads sizes like 512MB, 2GB or 1048576 (bytes)
+func parseByteSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	upper := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(upper, u.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, u.suffix))
+			multiplier = u.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid size %q, expected a positive number of bytes, KB, MB or GB (ex. 512MB)", size)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T, maxBytes int64, policy string) (*spool, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := openSpool(dir, maxBytes, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.retryBase = time.Millisecond
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func spooledFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{}
+	for _, f := range files {
+		dat, _ := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		contents = append(contents, string(dat))
+	}
+	return contents
+}
+
+func TestOpenSpool(t *testing.T) {
+	s, cleanup := newTestSpool(t, 100, spoolBlock)
+	defer cleanup()
+	for _, event := range []string{"first", "second"} {
+		if err := s.append([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.dir, "00000000000000000000-000000.json.tmp"), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := openSpool(s.dir, 100, spoolBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resumed.entries, s.entries) || resumed.size != int64(len("firstsecond")) {
+		t.Errorf("Expected the spooled events to be resumed in order, got %+v", resumed.entries)
+	}
+	if files := spooledFiles(t, s.dir); !reflect.DeepEqual(files, []string{"first", "second"}) {
+		t.Errorf("Expected the unfinished write to be cleaned up, got %v", files)
+	}
+
+	// resuming into a smaller spool drops what doesn't fit
+	resumed, err = openSpool(s.dir, 6, spoolDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := spooledFiles(t, s.dir); len(resumed.entries) != 1 || !reflect.DeepEqual(files, []string{"second"}) {
+		t.Errorf("Expected only the newest event to fit, got %v", files)
+	}
+
+	if _, err := openSpool(s.dir, 100, "explode"); err == nil {
+		t.Error("Expected an error for an unknown policy, but got <nil>")
+	}
+	if _, err := openSpool(s.dir, 0, spoolBlock); err == nil {
+		t.Error("Expected an error for an empty spool, but got <nil>")
+	}
+	notADir := filepath.Join(s.dir, "file")
+	if err := ioutil.WriteFile(notADir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openSpool(filepath.Join(notADir, "nested"), 100, spoolBlock); err == nil {
+		t.Error("Expected an error for a directory that can't be created, but got <nil>")
+	}
+}
+
+func TestSpoolDropOldest(t *testing.T) {
+	s, cleanup := newTestSpool(t, 10, spoolDropOldest)
+	defer cleanup()
+	for _, event := range []string{"aaaa", "bbbb", "cccc"} {
+		if err := s.append([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files := spooledFiles(t, s.dir); !reflect.DeepEqual(files, []string{"bbbb", "cccc"}) || s.dropped != 1 || s.size != 8 {
+		t.Errorf("Expected the oldest event to be dropped, got %v (%d dropped)", files, s.dropped)
+	}
+	if err := s.append(make([]byte, 11)); err == nil {
+		t.Error("Expected an error for an event larger than the spool, but got <nil>")
+	}
+}
+
+func TestSpoolBlock(t *testing.T) {
+	s, cleanup := newTestSpool(t, 8, spoolBlock)
+	defer cleanup()
+	for _, event := range []string{"aaaa", "bbbb"} {
+		if err := s.append([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	appended := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		if err := s.append([]byte("cccc")); err != nil {
+			t.Error(err)
+		}
+		close(appended)
+	}()
+	select {
+	case <-appended:
+		t.Fatal("Expected append to block while the spool is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.remove(s.next()[:1])
+	wg.Wait()
+	if files := spooledFiles(t, s.dir); !reflect.DeepEqual(files, []string{"bbbb", "cccc"}) || s.dropped != 0 {
+		t.Errorf("Expected the new event once there was room, got %v", files)
+	}
+}
+
+func TestSpoolDeliver(t *testing.T) {
+	s, cleanup := newTestSpool(t, 1000, spoolBlock)
+	defer cleanup()
+	var mu sync.Mutex
+	attempts := 0
+	delivered := []string{}
+	go s.deliver(func(payloads [][]byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			return errors.New("VPN is down")
+		}
+		for _, p := range payloads {
+			delivered = append(delivered, string(p))
+		}
+		return nil
+	})
+	for _, event := range []string{"a", "b", "c"} {
+		if err := s.append([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if left := s.wait(time.Second); left != 0 {
+		t.Fatalf("Expected every event to be delivered, %d left", left)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 3 || delivered[0] != "a" || attempts < 2 {
+		t.Errorf("Expected the events in order after a retry, got %v (%d attempts)", delivered, attempts)
+	}
+	if files := spooledFiles(t, s.dir); len(files) != 0 {
+		t.Errorf("Expected delivered events to be deleted, got %v", files)
+	}
+}
+
+func TestSpoolDeliverPartial(t *testing.T) {
+	s, cleanup := newTestSpool(t, 1000, spoolBlock)
+	defer cleanup()
+	for _, event := range []string{"a", "b", "c"} {
+		if err := s.append([]byte(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	sent := [][]string{}
+	go s.deliverPartial(func(payloads [][]byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		batch := []string{}
+		for _, p := range payloads {
+			batch = append(batch, string(p))
+		}
+		sent = append(sent, batch)
+		if len(sent) == 1 {
+			return 1, errors.New("throttled")
+		}
+		return len(payloads), nil
+	})
+	if left := s.wait(time.Second); left != 0 {
+		t.Fatalf("Expected every event to be delivered, %d left", left)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(sent, [][]string{{"a", "b", "c"}, {"b", "c"}}) {
+		t.Errorf("Expected only the undelivered events to be retried, got %v", sent)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	b := newRetryBackoff(10*time.Millisecond, 50*time.Millisecond)
+	ceilings := []time.Duration{10, 20, 40, 50, 50}
+	for i, ceiling := range ceilings {
+		if wait := b.next(); wait < 0 || wait > ceiling*time.Millisecond {
+			t.Errorf("attempt %d: expected a wait up to %dms, got %s", i, ceiling, wait)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		b.next()
+	}
+	if wait := b.next(); wait > 50*time.Millisecond {
+		t.Errorf("Expected waits to stay under the max, got %s", wait)
+	}
+	b.reset()
+	if b.attempt != 0 {
+		t.Errorf("Expected reset to start over, got attempt %d", b.attempt)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	var sizeTests = []struct {
+		input string
+		size  int64
+		valid bool
+	}{
+		{"512MB", 512 << 20, true},
+		{"2gb", 2 << 30, true},
+		{"64 KB", 64 << 10, true},
+		{"100B", 100, true},
+		{"1048576", 1048576, true},
+		{"0MB", 0, false},
+		{"-1", 0, false},
+		{"lots", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range sizeTests {
+		size, err := parseByteSize(tt.input)
+		if (err == nil) != tt.valid || size != tt.size {
+			t.Errorf("parseByteSize(%q): expected %d (valid=%v), got %d %v", tt.input, tt.size, tt.valid, size, err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/Masterminds/sprig"
+)
+
+// getTemplateFuncMap returns the Sprig functions plus Replay Zero specific
+// helpers for escaping recorded data into the various output formats
+func getTemplateFuncMap() template.FuncMap {
+	funcMap := sprig.TxtFuncMap()
+	funcMap["jsString"] = jsString
+	funcMap["thinkTime"] = thinkTime
+	funcMap["thinkTimeMillis"] = thinkTimeMillis
+	funcMap["goString"] = goString
+	funcMap["goIdent"] = goIdent
+	funcMap["stableHeaders"] = stableHeaders
+	funcMap["sendableHeaders"] = sendableHeaders
+	funcMap["pathWithQuery"] = pathWithQuery
+	funcMap["queryParams"] = queryParams
+	funcMap["xmlEscape"] = xmlEscape
+	funcMap["isJSON"] = isJSON
+	funcMap["jsonPathAsserts"] = jsonPathAsserts
+	funcMap["karateBody"] = karateBody
+	funcMap["isVolatileHeader"] = isVolatileHeader
+	return funcMap
+}
+
+// jsString quotes a string as a JSON (and therefore JavaScript) string literal
+func jsString(s string) string {
+	// marshalling a plain string cannot fail
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// thinkTime returns the gap in seconds between the event at `index` and
+// the one recorded before it, or 0 if either is missing a timestamp
+func thinkTime(events []HTTPEvent, index int) float64 {
+	if index <= 0 || index >= len(events) {
+		return 0
+	}
+	prev, curr := events[index-1].Timestamp, events[index].Timestamp
+	if prev == 0 || curr <= prev {
+		return 0
+	}
+	return float64(curr-prev) / 1000
+}
+
+// thinkTimeMillis is thinkTime for formats that expect whole milliseconds
+func thinkTimeMillis(events []HTTPEvent, index int) int64 {
+	return int64(thinkTime(events, index) * 1000)
+}
+
+// Response headers that change between otherwise identical requests,
+// or that the HTTP client manages itself
+var volatileHeaders = map[string]bool{
+	"Age":               true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Date":              true,
+	"Etag":              true,
+	"Expires":           true,
+	"Keep-Alive":        true,
+	"Last-Modified":     true,
+	"Set-Cookie":        true,
+	"Transfer-Encoding": true,
+}
+
+// stableHeaders filters out volatile headers so generated
+// assertions don't fail on every run
+func stableHeaders(headers []Header) []Header {
+	stable := []Header{}
+	for _, h := range headers {
+		if !volatileHeaders[http.CanonicalHeaderKey(h.Name)] {
+			stable = append(stable, h)
+		}
+	}
+	return stable
+}
+
+// Request headers the HTTP client computes on its own. Some clients
+// (ex. JMeter's HttpClient4) refuse to send a request that sets them, and
+// setting Accept-Encoding turns off Go's transparent gzip decoding.
+var clientManagedHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+}
+
+// sendableHeaders filters out request headers the client should compute itself
+func sendableHeaders(headers []Header) []Header {
+	sendable := []Header{}
+	for _, h := range headers {
+		if !clientManagedHeaders[http.CanonicalHeaderKey(h.Name)] {
+			sendable = append(sendable, h)
+		}
+	}
+	return sendable
+}
+
+// pathWithQuery returns the recorded path, plus its query string if it had one
+func pathWithQuery(event HTTPEvent) string {
+	if event.Query == "" {
+		return event.Endpoint
+	}
+	return event.Endpoint + "?" + event.Query
+}
+
+// queryParam is a query parameter with all its values, in recorded order
+type queryParam struct {
+	Name   string
+	Values []string
+}
+
+// queryParams decodes a query string, keeping the parameters in the order
+// they were recorded (unlike url.ParseQuery). Malformed pairs are skipped.
+func queryParams(query string) []queryParam {
+	params := []queryParam{}
+	index := map[string]int{}
+	for _, pair := range strings.Split(query, "&") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		name, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			continue
+		}
+		value := ""
+		if len(kv) == 2 {
+			if value, err = url.QueryUnescape(kv[1]); err != nil {
+				continue
+			}
+		}
+		if i, ok := index[name]; ok {
+			params[i].Values = append(params[i].Values, value)
+			continue
+		}
+		index[name] = len(params)
+		params = append(params, queryParam{Name: name, Values: []string{value}})
+	}
+	return params
+}
+
+// xmlEscape escapes a string for use in XML text or attribute values
+func xmlEscape(s string) string {
+	var b strings.Builder
+	// writing to a strings.Builder cannot fail
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// goString quotes a string as a Go string literal, preferring
+// a raw string for readability when it needs no escaping
+func goString(s string) string {
+	if strings.Contains(s, `"`) && strconv.CanBackquote(s) {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
+
+// goIdent converts an arbitrary string (ex. a UUID) into a valid Go identifier suffix
+func goIdent(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// isJSON reports whether a body is a JSON object or array
+func isJSON(s string) bool {
+	trimmed := strings.TrimSpace(s)
+	return (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed))
+}
+
+// jsonPathAssert is a single assertion on a JSON body,
+// ex. Path="$.items[0].id" and Predicate="== 42"
+type jsonPathAssert struct {
+	Path      string
+	Predicate string
+}
+
+var simpleJSONKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// jsonPathAsserts flattens a JSON body into one assertion per leaf value,
+// plus a count assertion per array. Non-JSON bodies produce no assertions.
+func jsonPathAsserts(body string) []jsonPathAssert {
+	if !isJSON(body) {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return nil
+	}
+	asserts := []jsonPathAssert{}
+	collectJSONPathAsserts("$", value, &asserts)
+	return asserts
+}
+
+func collectJSONPathAsserts(path string, value interface{}, asserts *[]jsonPathAssert) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			collectJSONPathAsserts(jsonPathChild(path, k), v[k], asserts)
+		}
+	case []interface{}:
+		*asserts = append(*asserts, jsonPathAssert{path, fmt.Sprintf("count == %d", len(v))})
+		for i, item := range v {
+			collectJSONPathAsserts(fmt.Sprintf("%s[%d]", path, i), item, asserts)
+		}
+	default:
+		// re-marshalling a decoded JSON leaf cannot fail
+		literal, _ := json.Marshal(v)
+		*asserts = append(*asserts, jsonPathAssert{path, "== " + string(literal)})
+	}
+}
+
+func jsonPathChild(path, key string) string {
+	if simpleJSONKey.MatchString(key) {
+		return path + "." + key
+	}
+	return fmt.Sprintf("%s['%s']", path, strings.ReplaceAll(key, "'", "\\'"))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSString(t *testing.T) {
+	var jsStringTests = []struct {
+		in       string
+		expected string
+	}{
+		{`plain`, `"plain"`},
+		{`{"a": "b"}`, `"{\"a\": \"b\"}"`},
+		{"line\nbreak\ttab", `"line\nbreak\ttab"`},
+		{`</script>`, `"\u003c/script\u003e"`},
+	}
+	for _, tt := range jsStringTests {
+		if actual := jsString(tt.in); actual != tt.expected {
+			t.Errorf("jsString(%q) = %s, expected %s", tt.in, actual, tt.expected)
+		}
+	}
+}
+
+func TestThinkTime(t *testing.T) {
+	events := []HTTPEvent{
+		{Timestamp: 1000},
+		{Timestamp: 3500},
+		{Timestamp: 0},
+		{Timestamp: 4000},
+		{Timestamp: 3000},
+	}
+	var thinkTimeTests = []struct {
+		index    int
+		expected float64
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 2.5},
+		{2, 0},
+		{3, 0},
+		{4, 0},
+		{5, 0},
+	}
+	for _, tt := range thinkTimeTests {
+		if actual := thinkTime(events, tt.index); actual != tt.expected {
+			t.Errorf("thinkTime(%d) = %v, expected %v", tt.index, actual, tt.expected)
+		}
+	}
+}
+
+func TestGoString(t *testing.T) {
+	var goStringTests = []struct {
+		in       string
+		expected string
+	}{
+		{`plain`, `"plain"`},
+		{`{"a": "b"}`, "`{\"a\": \"b\"}`"},
+		{"`{\"a\": \"b\"}`", "\"`{\\\"a\\\": \\\"b\\\"}`\""},
+		{"multi\nline \"quoted\"", `"multi\nline \"quoted\""`},
+	}
+	for _, tt := range goStringTests {
+		if actual := goString(tt.in); actual != tt.expected {
+			t.Errorf("goString(%q) = %s, expected %s", tt.in, actual, tt.expected)
+		}
+	}
+}
+
+func TestGoIdent(t *testing.T) {
+	if actual := goIdent("c1487b92-01a0.4b08é"); actual != "c1487b92_01a0_4b08_" {
+		t.Errorf("Unexpected identifier %s", actual)
+	}
+}
+
+func TestStableHeaders(t *testing.T) {
+	headers := []Header{
+		{Name: "Content-Type", Value: "application/json"},
+		{Name: "date", Value: "Tue, 18 Feb 2020 20:42:12 GMT"},
+		{Name: "ETag", Value: "abc"},
+	}
+	stable := stableHeaders(headers)
+	if len(stable) != 1 || stable[0].Name != "Content-Type" {
+		t.Errorf("Expected only Content-Type to remain, got %v", stable)
+	}
+}
+
+func TestSendableHeaders(t *testing.T) {
+	headers := []Header{
+		{Name: "Accept", Value: "*/*"},
+		{Name: "content-length", Value: "22"},
+		{Name: "Host", Value: "localhost:8080"},
+		{Name: "Accept-Encoding", Value: "gzip"},
+	}
+	sendable := sendableHeaders(headers)
+	if len(sendable) != 1 || sendable[0].Name != "Accept" {
+		t.Errorf("Expected only Accept to remain, got %v", sendable)
+	}
+}
+
+func TestPathWithQuery(t *testing.T) {
+	event := HTTPEvent{Endpoint: "/api/orders"}
+	if actual := pathWithQuery(event); actual != "/api/orders" {
+		t.Errorf("Expected /api/orders, got %s", actual)
+	}
+	event.Query = "page=2"
+	if actual := pathWithQuery(event); actual != "/api/orders?page=2" {
+		t.Errorf("Expected /api/orders?page=2, got %s", actual)
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	actual := queryParams("page=2&tag=a&flag&tag=b%20c&bad=%zz&")
+	expected := []queryParam{
+		{Name: "page", Values: []string{"2"}},
+		{Name: "tag", Values: []string{"a", "b c"}},
+		{Name: "flag", Values: []string{""}},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+	if params := queryParams(""); len(params) != 0 {
+		t.Errorf("Expected no parameters, got %v", params)
+	}
+}
+
+func TestXMLEscape(t *testing.T) {
+	actual := xmlEscape("<a href=\"x\">&'\n\x00</a>")
+	expected := "&lt;a href=&#34;x&#34;&gt;&amp;&#39;&#xA;�&lt;/a&gt;"
+	if actual != expected {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
+
+func TestThinkTimeMillis(t *testing.T) {
+	events := []HTTPEvent{{Timestamp: 1000}, {Timestamp: 2250}}
+	if actual := thinkTimeMillis(events, 1); actual != 1250 {
+		t.Errorf("Expected 1250ms, got %d", actual)
+	}
+}
+
+func TestIsJSON(t *testing.T) {
+	var isJSONTests = []struct {
+		in       string
+		expected bool
+	}{
+		{` {"a": 1} `, true},
+		{`[1, 2]`, true},
+		{`"just a string"`, false},
+		{`42`, false},
+		{`{"a": `, false},
+		{`plain text`, false},
+	}
+	for _, tt := range isJSONTests {
+		if actual := isJSON(tt.in); actual != tt.expected {
+			t.Errorf("isJSON(%q) = %v, expected %v", tt.in, actual, tt.expected)
+		}
+	}
+}
+
+func TestJSONPathAsserts(t *testing.T) {
+	body := `{"id": 7, "name": "a\"b", "tags": ["x"], "empty": [], "nested": {"ok": true, "gone": null}, "odd key": 1.5, "it's": 0}`
+	expected := []jsonPathAssert{
+		{"$.empty", "count == 0"},
+		{"$.id", "== 7"},
+		{"$['it\\'s']", "== 0"},
+		{"$.name", `== "a\"b"`},
+		{"$.nested.gone", "== null"},
+		{"$.nested.ok", "== true"},
+		{"$['odd key']", "== 1.5"},
+		{"$.tags", "count == 1"},
+		{"$.tags[0]", `== "x"`},
+	}
+	actual := jsonPathAsserts(body)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected:\n%v\ngot:\n%v", expected, actual)
+	}
+	if asserts := jsonPathAsserts("not json"); asserts != nil {
+		t.Errorf("Expected no assertions for a non-JSON body, got %v", asserts)
+	}
+}
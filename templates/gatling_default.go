@@ -33,7 +33,7 @@ val httpProtocol: HttpProtocolBuilder = http.baseURL(host)
 {{ range $index, $event := . -}}
 val scenario_{{$index}}: ScenarioBuilder = scenario("scenario_{{$index}}")
 	.exec(http("http_{{$index}}"))
-	.{{lower $event.HTTPMethod}}("{{$event.Endpoint}}")
+	.{{lower $event.HTTPMethod}}("{{ pathWithQuery $event }}")
 	{{- if gt (len $event.ReqHeaders) 0}}
 	.headers(
 		{{- range $h_index, $header := $event.ReqHeaders}}
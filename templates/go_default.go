@@ -0,0 +1,103 @@
+package templates
+
+const (
+	// GoBase is the default template for a generated Go test file
+	GoBase = `// Generated by Replay Zero at {{ now }}
+
+// TODO: rename to the package this test lives in
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReplay_{{ goIdent (index . 0).PairID }}(t *testing.T) {
+	baseURL := os.Getenv("REPLAY_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+
+	// Bodies that are both valid JSON are compared structurally, otherwise byte for byte
+	bodiesEqual := func(expected string, actual []byte) bool {
+		var e, a interface{}
+		if json.Unmarshal([]byte(expected), &e) != nil || json.Unmarshal(actual, &a) != nil {
+			return expected == string(actual)
+		}
+		return reflect.DeepEqual(e, a)
+	}
+
+	scenarios := []struct {
+		name        string
+		method      string
+		path        string
+		reqHeaders  map[string]string
+		reqBody     string
+		status      int
+		respHeaders map[string]string
+		respBody    string
+	}{
+		{{- range $index, $event := . }}
+		{
+			name:   {{ goString $event.PairID }},
+			method: {{ goString $event.HTTPMethod }},
+			path:   {{ goString (pathWithQuery $event) }},
+			reqHeaders: map[string]string{
+				{{- range $header := sendableHeaders $event.ReqHeaders }}
+				{{ goString $header.Name }}: {{ goString $header.Value }},
+				{{- end }}
+			},
+			reqBody: {{ goString $event.ReqBody }},
+			status:  {{ $event.ResponseCode }},
+			respHeaders: map[string]string{
+				{{- range $header := stableHeaders $event.RespHeaders }}
+				{{ goString $header.Name }}: {{ goString $header.Value }},
+				{{- end }}
+			},
+			respBody: {{ goString $event.RespBody }},
+		},
+		{{- end }}
+	}
+
+	for _, sc := range scenarios {
+		sc := sc
+		t.Run(sc.name, func(t *testing.T) {
+			req, err := http.NewRequest(sc.method, baseURL+sc.path, bytes.NewBufferString(sc.reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range sc.reqHeaders {
+				req.Header.Set(k, v)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != sc.status {
+				t.Errorf("Expected status %d, got %d", sc.status, resp.StatusCode)
+			}
+			for k, v := range sc.respHeaders {
+				if actual := resp.Header.Get(k); actual != v {
+					t.Errorf("Expected header %s=%q, got %q", k, v, actual)
+				}
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bodiesEqual(sc.respBody, body) {
+				t.Errorf("Expected body:\n%s\ngot:\n%s", sc.respBody, body)
+			}
+		})
+	}
+}
+`
+)
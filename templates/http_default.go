@@ -0,0 +1,20 @@
+package templates
+
+const (
+	// HTTPBase is the default template for a generated .http (REST Client) file
+	HTTPBase = `# Generated by Replay Zero at {{ now }}
+@baseUrl = http://localhost:8080
+{{ range $index, $event := . }}
+### {{ $event.PairID }}
+# Recorded response: HTTP {{ $event.ResponseCode }}
+{{ $event.HTTPMethod }} {{ "{{" }}baseUrl{{ "}}" }}{{ pathWithQuery $event }}
+{{- range $header := sendableHeaders $event.ReqHeaders }}
+{{ $header.Name }}: {{ $header.Value }}
+{{- end }}
+{{- if $event.ReqBody }}
+
+{{ $event.ReqBody }}
+{{- end }}
+{{ end -}}
+`
+)
@@ -0,0 +1,33 @@
+package templates
+
+const (
+	// HurlBase is the default template for a generated Hurl file
+	HurlBase = `# Generated by Replay Zero at {{ now }}
+# Run with: hurl --variable base_url=http://localhost:8080 replay_scenarios_N.hurl
+{{ range $index, $event := . }}
+# {{ $event.PairID }}
+{{ $event.HTTPMethod }} {{ "{{" }}base_url{{ "}}" }}{{ pathWithQuery $event }}
+{{- range $header := sendableHeaders $event.ReqHeaders }}
+{{ $header.Name }}: {{ $header.Value }}
+{{- end }}
+{{- if $event.ReqBody }}
+{{- if isJSON $event.ReqBody }}
+{{ $event.ReqBody }}
+{{- else }}
+` + "```" + `
+{{ $event.ReqBody }}
+` + "```" + `
+{{- end }}
+{{- end }}
+
+HTTP {{ $event.ResponseCode }}
+{{- $asserts := jsonPathAsserts $event.RespBody }}
+{{- if $asserts }}
+[Asserts]
+{{- range $assert := $asserts }}
+jsonpath {{ jsString $assert.Path }} {{ $assert.Predicate }}
+{{- end }}
+{{- end }}
+{{ end -}}
+`
+)
@@ -0,0 +1,92 @@
+package templates
+
+const (
+	// JMeterBase is the default template for a generated JMeter test plan
+	JMeterBase = `<?xml version="1.0" encoding="UTF-8"?>
+<!-- Generated by Replay Zero at {{ now }} -->
+<jmeterTestPlan version="1.2" properties="5.0" jmeter="5.3">
+  <hashTree>
+    <TestPlan guiclass="TestPlanGui" testclass="TestPlan" testname="Replay Zero" enabled="true">
+      <boolProp name="TestPlan.functional_mode">false</boolProp>
+      <boolProp name="TestPlan.serialize_threadgroups">false</boolProp>
+      <elementProp name="TestPlan.user_defined_variables" elementType="Arguments" guiclass="ArgumentsPanel" testclass="Arguments" testname="User Defined Variables" enabled="true">
+        <collectionProp name="Arguments.arguments">
+          {{- range $name, $default := dict "protocol" "http" "host" "localhost" "port" "8080" }}
+          <elementProp name="{{ $name }}" elementType="Argument">
+            <stringProp name="Argument.name">{{ $name }}</stringProp>
+            <stringProp name="Argument.value">${__P({{ $name }},{{ $default }})}</stringProp>
+            <stringProp name="Argument.metadata">=</stringProp>
+          </elementProp>
+          {{- end }}
+        </collectionProp>
+      </elementProp>
+    </TestPlan>
+    <hashTree>
+      <ThreadGroup guiclass="ThreadGroupGui" testclass="ThreadGroup" testname="Replay Zero Thread Group" enabled="true">
+        <stringProp name="ThreadGroup.on_sample_error">continue</stringProp>
+        <elementProp name="ThreadGroup.main_controller" elementType="LoopController" guiclass="LoopControlPanel" testclass="LoopController" testname="Loop Controller" enabled="true">
+          <boolProp name="LoopController.continue_forever">false</boolProp>
+          <stringProp name="LoopController.loops">${__P(loops,1)}</stringProp>
+        </elementProp>
+        <stringProp name="ThreadGroup.num_threads">${__P(threads,1)}</stringProp>
+        <stringProp name="ThreadGroup.ramp_time">${__P(rampup,1)}</stringProp>
+        <boolProp name="ThreadGroup.scheduler">false</boolProp>
+      </ThreadGroup>
+      <hashTree>
+        {{- range $index, $event := . }}
+        <HTTPSamplerProxy guiclass="HttpTestSampleGui" testclass="HTTPSamplerProxy" testname="http_{{ $index }} {{ xmlEscape $event.HTTPMethod }} {{ xmlEscape $event.Endpoint }}" enabled="true">
+          <boolProp name="HTTPSampler.postBodyRaw">true</boolProp>
+          <elementProp name="HTTPsampler.Arguments" elementType="Arguments">
+            <collectionProp name="Arguments.arguments">
+              <elementProp name="" elementType="HTTPArgument">
+                <boolProp name="HTTPArgument.always_encode">false</boolProp>
+                <stringProp name="Argument.value">{{ xmlEscape $event.ReqBody }}</stringProp>
+                <stringProp name="Argument.metadata">=</stringProp>
+              </elementProp>
+            </collectionProp>
+          </elementProp>
+          <stringProp name="HTTPSampler.domain">${host}</stringProp>
+          <stringProp name="HTTPSampler.port">${port}</stringProp>
+          <stringProp name="HTTPSampler.protocol">${protocol}</stringProp>
+          <stringProp name="HTTPSampler.path">{{ xmlEscape (pathWithQuery $event) }}</stringProp>
+          <stringProp name="HTTPSampler.method">{{ xmlEscape $event.HTTPMethod }}</stringProp>
+          <boolProp name="HTTPSampler.follow_redirects">false</boolProp>
+          <boolProp name="HTTPSampler.auto_redirects">false</boolProp>
+          <boolProp name="HTTPSampler.use_keepalive">true</boolProp>
+        </HTTPSamplerProxy>
+        <hashTree>
+          <HeaderManager guiclass="HeaderPanel" testclass="HeaderManager" testname="HTTP Header Manager" enabled="true">
+            <collectionProp name="HeaderManager.headers">
+              {{- range $header := sendableHeaders $event.ReqHeaders }}
+              <elementProp name="" elementType="Header">
+                <stringProp name="Header.name">{{ xmlEscape $header.Name }}</stringProp>
+                <stringProp name="Header.value">{{ xmlEscape $header.Value }}</stringProp>
+              </elementProp>
+              {{- end }}
+            </collectionProp>
+          </HeaderManager>
+          <hashTree/>
+          <ResponseAssertion guiclass="AssertionGui" testclass="ResponseAssertion" testname="Response Status" enabled="true">
+            <collectionProp name="Asserion.test_strings">
+              <stringProp name="status">{{ xmlEscape $event.ResponseCode }}</stringProp>
+            </collectionProp>
+            <stringProp name="Assertion.test_field">Assertion.response_code</stringProp>
+            <boolProp name="Assertion.assume_success">false</boolProp>
+            <intProp name="Assertion.test_type">8</intProp>
+          </ResponseAssertion>
+          <hashTree/>
+          {{- $think := thinkTimeMillis $ $index }}
+          {{- if gt $think 0 }}
+          <ConstantTimer guiclass="ConstantTimerGui" testclass="ConstantTimer" testname="Recorded think time" enabled="true">
+            <stringProp name="ConstantTimer.delay">{{ $think }}</stringProp>
+          </ConstantTimer>
+          <hashTree/>
+          {{- end }}
+        </hashTree>
+        {{- end }}
+      </hashTree>
+    </hashTree>
+  </hashTree>
+</jmeterTestPlan>
+`
+)
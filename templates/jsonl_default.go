@@ -0,0 +1,9 @@
+package templates
+
+const (
+	// JSONLBase is the default template for a JSON Lines archive of recorded events
+	JSONLBase = `{{ range . -}}
+{{ toJson . }}
+{{ end -}}
+`
+)
@@ -0,0 +1,57 @@
+package templates
+
+const (
+	// K6Base is the default template for a generated k6 script
+	K6Base = `// Generated by Replay Zero at {{ now }}
+import http from 'k6/http';
+import { check, sleep } from 'k6';
+
+const TP99_RESPONSE_TIME = 1600;
+const TP90_RESPONSE_TIME = 800;
+const TP50_RESPONSE_TIME = 600;
+const AVAILABILITY_RATE = 99;
+
+const BASE_URL = __ENV.BASE_URL || 'http://localhost:8080';
+
+export const options = {
+	vus: parseInt(__ENV.VUS || '1'),
+	duration: __ENV.DURATION || '1m',
+	thresholds: {
+		http_req_duration: [
+			'p(99)<' + TP99_RESPONSE_TIME,
+			'p(90)<' + TP90_RESPONSE_TIME,
+			'p(50)<' + TP50_RESPONSE_TIME,
+		],
+		http_req_failed: ['rate<' + (100 - AVAILABILITY_RATE) / 100],
+		checks: ['rate>' + AVAILABILITY_RATE / 100],
+	},
+};
+
+export default function () {
+	let res;
+{{ range $index, $event := . }}
+	{{- $think := thinkTime $ $index }}
+	{{- if gt $think 0.0 }}
+	sleep({{ $think }});
+{{ end }}
+	// {{ $event.PairID }}
+	res = http.request(
+		{{ jsString $event.HTTPMethod }},
+		BASE_URL + {{ jsString (pathWithQuery $event) }},
+		{{ if $event.ReqBody }}{{ jsString $event.ReqBody }}{{ else }}null{{ end }},
+		{
+			headers: {
+				{{- range $header := sendableHeaders $event.ReqHeaders }}
+				{{ jsString $header.Name }}: {{ jsString $header.Value }},
+				{{- end }}
+			},
+			tags: { name: 'http_{{ $index }}' },
+		}
+	);
+	check(res, {
+		'http_{{ $index }} status is {{ $event.ResponseCode }}': (r) => r.status === {{ $event.ResponseCode }},
+	});
+{{ end -}}
+}
+`
+)
@@ -10,7 +10,11 @@ Feature:
 {{ range $index, $event := . }}
 	Scenario: test scenario {{.PairID}}
 		Given path '{{ $event.Endpoint }}'
-		{{/* add request headers if present */ -}}
+		{{/* add query parameters if present */ -}}
+		{{ range $param := queryParams $event.Query -}}
+		And param {{$param.Name}} = {{ if eq (len $param.Values) 1 }}'{{ index $param.Values 0 }}'{{ else }}[{{ range $i, $value := $param.Values }}{{ if $i }}, {{ end }}'{{ $value }}'{{ end }}]{{ end }}
+		{{end }}
+		{{- /* add request headers if present */ -}}
 		{{ range $header := $event.ReqHeaders -}}
 		And header {{$header.Name}} = '{{$header.Value}}'
 		{{end }}
@@ -26,13 +30,13 @@ Feature:
 		Then status {{ $event.ResponseCode }}
 		{{/* assert on response headers if present */ -}}
 		{{ range $header := $event.RespHeaders -}}
-		And match header {{$header.Name}} == '{{$header.Value}}'
+		And match header {{$header.Name}} == '{{ if isVolatileHeader $event $header.Name }}#string{{ else }}{{$header.Value}}{{ end }}'
 		{{end }}
 		{{- /* assert on response body if present */ -}}
 		{{ if $event.RespBody -}}
 		And match response ==
 		"""
-		{{ $event.RespBody }}
+		{{ karateBody $event }}
 		"""
 		{{- end }}
 {{ end }}
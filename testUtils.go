@@ -44,6 +44,7 @@ func generateSampleEvent() HTTPEvent {
 		},
 		RespBody:     "Test payload back atcha",
 		ResponseCode: "200",
+		Timestamp:    1582058532000,
 	}
 }
 
@@ -55,6 +56,10 @@ var sampleEvent = generateSampleEvent()
 
 type mockKinesisClient struct {
 	timesCalled int
+	// records passed to each PutRecords call
+	putRecords [][]*kinesis.PutRecordsRequestEntry
+	// number of records PutRecords fails (the first ones it gets) before accepting any
+	failRecords int
 	kinesisiface.KinesisAPI
 }
 
@@ -85,6 +90,28 @@ func (m *mockKinesisClient) PutRecord(inp *kinesis.PutRecordInput) (*kinesis.Put
 	}, nil
 }
 
+func (m *mockKinesisClient) PutRecords(inp *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	m.timesCalled++
+	m.putRecords = append(m.putRecords, inp.Records)
+	if *inp.StreamName == "simulate_error" {
+		return &kinesis.PutRecordsOutput{}, fmt.Errorf("simulated service error")
+	}
+	output := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for range inp.Records {
+		result := &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("a"), ShardId: aws.String("b")}
+		if m.failRecords > 0 {
+			m.failRecords--
+			*output.FailedRecordCount++
+			result = &kinesis.PutRecordsResultEntry{
+				ErrorCode:    aws.String(kinesis.ErrCodeProvisionedThroughputExceededException),
+				ErrorMessage: aws.String("Rate exceeded for shard"),
+			}
+		}
+		output.Records = append(output.Records, result)
+	}
+	return output, nil
+}
+
 // - - - - - - - - - - - - -
 //        I/O MOCKS
 // - - - - - - - - - - - - -
@@ -95,5 +122,12 @@ func emptyWriter(h *offlineHandler) io.Writer {
 	return ioutil.Discard
 }
 
+// Wraps a writer that has nothing to close (ex. a buffer)
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
 // Accepts a log message and does nothing with it
 func nopLog(msg string, v ...interface{}) {}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Headers signed webhook requests carry
+const (
+	webhookSignatureHeader = "X-Replay-Zero-Signature"
+	webhookTimestampHeader = "X-Replay-Zero-Timestamp"
+)
+
+// webhookConfig configures a webhook sink (see sinks.go)
+type webhookConfig struct {
+	URL string `yaml:"url"`
+	// Values can use environment variables, ex. Bearer ${TOKEN}
+	Headers map[string]string `yaml:"headers"`
+	// Events per request: 1 posts each event on its own, more posts JSON arrays
+	BatchSize int `yaml:"batch_size"`
+	// Longest time events wait for a batch to fill up
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// Per request, including reading the response
+	Timeout time.Duration `yaml:"timeout"`
+	// Attempts after the first one, when not spooling (a spool retries until delivered)
+	Retries int `yaml:"retries"`
+	// Waits between attempts grow from RetryBackoff up to RetryMaxBackoff, see retryBackoff
+	RetryBackoff    time.Duration `yaml:"retry_backoff"`
+	RetryMaxBackoff time.Duration `yaml:"retry_max_backoff"`
+	// Signs requests with HMAC-SHA256 when set, see sign
+	HMACSecret    string `yaml:"hmac_secret"`
+	HMACSecretEnv string `yaml:"hmac_secret_env"`
+	SpoolDir      string `yaml:"spool_dir"`
+	SpoolMaxSize  string `yaml:"spool_max_size"`
+	SpoolFull     string `yaml:"spool_full"`
+}
+
+// webhookDefaults are the defaults of a webhook sink
+var webhookDefaults = webhookConfig{
+	BatchSize:       1,
+	FlushInterval:   time.Second,
+	Timeout:         10 * time.Second,
+	Retries:         5,
+	RetryBackoff:    500 * time.Millisecond,
+	RetryMaxBackoff: 30 * time.Second,
+	SpoolMaxSize:    onlineDefaults.SpoolMaxSize,
+	SpoolFull:       onlineDefaults.SpoolFull,
+}
+
+func init() {
+	registerSink("webhook", newWebhookSink)
+}
+
+// newWebhookSink posts events to a URL
+func newWebhookSink(options *yaml.Node) (eventHandler, error) {
+	config := webhookDefaults
+	if err := decodeSinkOptions(options, &config); err != nil {
+		return nil, err
+	}
+	return newWebhookHandler(config)
+}
+
+// webhookStatusError is a response other than 2xx
+type webhookStatusError struct {
+	status int
+	body   string
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("Webhook answered %d: %s", e.status, e.body)
+}
+
+// permanent is true for errors sending the same request again won't fix
+func (e *webhookStatusError) permanent() bool {
+	return e.status >= 400 && e.status < 500 && e.status != http.StatusRequestTimeout && e.status != http.StatusTooManyRequests
+}
+
+// webhookHandler posts recorded events to a URL, one at a time or in batches
+type webhookHandler struct {
+	url       string
+	headers   map[string]string
+	secret    []byte
+	batchSize int
+	client    *http.Client
+	retries   int
+	retryBase time.Duration
+	retryMax  time.Duration
+	spool     *spool
+	sleep     func(time.Duration)
+	clock     func() string
+
+	mu      sync.Mutex
+	pending [][]byte
+	// held while posting so a flush waits for the batches already on their way
+	sending sync.Mutex
+
+	sent   int64
+	failed int64
+}
+
+// newWebhookHandler validates config, then resumes delivering anything left in the spool
+func newWebhookHandler(config webhookConfig) (*webhookHandler, error) {
+	target, err := url.Parse(config.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("Webhook url must be an http(s) URL, got %q", config.URL)
+	}
+	if config.BatchSize < 1 || config.Timeout <= 0 || config.Retries < 0 || config.RetryBackoff <= 0 || config.RetryMaxBackoff < config.RetryBackoff {
+		return nil, fmt.Errorf("Webhook batch_size and timeout must be positive, retries can't be negative and retry_max_backoff can't be below retry_backoff")
+	}
+	secret := config.HMACSecret
+	if config.HMACSecretEnv != "" {
+		if secret = os.Getenv(config.HMACSecretEnv); secret == "" {
+			return nil, fmt.Errorf("Environment variable %s for the HMAC secret is empty", config.HMACSecretEnv)
+		}
+	}
+	headers := map[string]string{}
+	for name, value := range config.Headers {
+		headers[name] = os.ExpandEnv(value)
+	}
+	h := &webhookHandler{
+		url:       config.URL,
+		headers:   headers,
+		secret:    []byte(secret),
+		batchSize: config.BatchSize,
+		client:    &http.Client{Timeout: config.Timeout},
+		retries:   config.Retries,
+		retryBase: config.RetryBackoff,
+		retryMax:  config.RetryMaxBackoff,
+		sleep:     time.Sleep,
+		clock:     func() string { return strconv.FormatInt(time.Now().Unix(), 10) },
+	}
+	if config.SpoolDir != "" {
+		maxSize, err := parseByteSize(config.SpoolMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		if h.spool, err = openSpool(config.SpoolDir, maxSize, config.SpoolFull); err != nil {
+			return nil, err
+		}
+		// one delivery is one request
+		h.spool.batchEntries = config.BatchSize
+		h.spool.retryBase = config.RetryBackoff
+		log.Printf("Spooling events to %s before posting them\n", config.SpoolDir)
+		go h.spool.deliver(h.sendSpooled)
+	} else if config.BatchSize > 1 && config.FlushInterval > 0 {
+		go func() {
+			for range time.Tick(config.FlushInterval) {
+				h.flush()
+			}
+		}()
+	}
+	return h, nil
+}
+
+func (h *webhookHandler) handleEvent(event HTTPEvent) {
+	event.SchemaVersion = eventSchemaVersion
+	data := []byte(httpEventToString(event))
+	if h.spool != nil {
+		logErr(h.spool.append(data))
+		return
+	}
+	h.mu.Lock()
+	h.pending = append(h.pending, data)
+	var batch [][]byte
+	if len(h.pending) >= h.batchSize {
+		batch = h.take()
+	}
+	h.mu.Unlock()
+	if batch != nil {
+		h.deliver(batch)
+	}
+}
+
+// take empties the pending batch (h.mu must be held)
+func (h *webhookHandler) take() [][]byte {
+	batch := h.pending
+	h.pending = nil
+	return batch
+}
+
+// flush posts the events waiting for a batch to fill up
+func (h *webhookHandler) flush() {
+	h.mu.Lock()
+	batch := h.take()
+	h.mu.Unlock()
+	if len(batch) > 0 {
+		h.deliver(batch)
+	}
+}
+
+// deliver posts events, retrying failures after a growing delay, and gives up
+// on them after the last retry
+func (h *webhookHandler) deliver(events [][]byte) {
+	h.sending.Lock()
+	defer h.sending.Unlock()
+	backoff := newRetryBackoff(h.retryBase, h.retryMax)
+	for attempt := 0; ; attempt++ {
+		err := h.post(events)
+		if err == nil {
+			atomic.AddInt64(&h.sent, int64(len(events)))
+			return
+		}
+		var status *webhookStatusError
+		if attempt == h.retries || (errors.As(err, &status) && status.permanent()) {
+			atomic.AddInt64(&h.failed, int64(len(events)))
+			log.Printf("[ERROR] Dropped %d events for %s after %d attempts: %v\n", len(events), h.url, attempt+1, err)
+			return
+		}
+		wait := backoff.next()
+		log.Printf("Could not post %d events to %s, retrying in %s: %v\n", len(events), h.url, wait.Round(time.Millisecond), err)
+		h.sleep(wait)
+	}
+}
+
+// sendSpooled posts a batch of spooled events. Other than for permanent
+// errors, the spool keeps the events and retries them until they're delivered.
+func (h *webhookHandler) sendSpooled(events [][]byte) error {
+	err := h.post(events)
+	var status *webhookStatusError
+	if errors.As(err, &status) && status.permanent() {
+		atomic.AddInt64(&h.failed, int64(len(events)))
+		log.Printf("[ERROR] Dropped %d spooled events rejected by %s: %v\n", len(events), h.url, err)
+		return nil
+	}
+	if err == nil {
+		atomic.AddInt64(&h.sent, int64(len(events)))
+	}
+	return err
+}
+
+// post sends a single request with events: the event itself for a batch
+// size of 1, a JSON array otherwise
+func (h *webhookHandler) post(events [][]byte) error {
+	body := events[0]
+	if h.batchSize > 1 {
+		body = append([]byte("["), bytes.Join(events, []byte(","))...)
+		body = append(body, ']')
+	}
+	request, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range h.headers {
+		request.Header.Set(name, value)
+	}
+	if len(h.secret) > 0 {
+		timestamp := h.clock()
+		request.Header.Set(webhookTimestampHeader, timestamp)
+		request.Header.Set(webhookSignatureHeader, "sha256="+h.sign(timestamp, body))
+	}
+	response, err := h.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// a short excerpt for the logs, the rest is read so the connection can be reused
+	excerpt, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &webhookStatusError{status: response.StatusCode, body: string(excerpt)}
+	}
+	return nil
+}
+
+// sign returns the hex HMAC-SHA256 of "timestamp.body", so receivers can
+// check where a request came from and reject old ones being replayed
+func (h *webhookHandler) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// Webhook: posts the events waiting for a batch, or gives the spool some time to empty
+func (h *webhookHandler) flushBuffer() {
+	if h.spool != nil {
+		if left := h.spool.wait(10 * time.Second); left > 0 {
+			log.Printf("%d events are still spooled in %s, they will be posted on the next run\n", left, h.spool.dir)
+		}
+	} else {
+		h.flush()
+	}
+	log.Printf("Webhook: sent=%d failed=%d events to %s\n", atomic.LoadInt64(&h.sent), atomic.LoadInt64(&h.failed), h.url)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// - - - - - - - - - - - - -
+//        UTILITIES
+// - - - - - - - - - - - - -
+
+// webhookServer answers with the next of its statuses (then 200s), keeping every request it got
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+		if len(s.statuses) > 0 {
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+		}
+	}))
+	return s
+}
+
+func (s *webhookServer) received() ([]*http.Request, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request{}, s.requests...), append([]string{}, s.bodies...)
+}
+
+func newTestWebhookHandler(t *testing.T, config webhookConfig) *webhookHandler {
+	h, err := newWebhookHandler(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.sleep = func(time.Duration) {}
+	return h
+}
+
+func testWebhookConfig(url string) webhookConfig {
+	config := webhookDefaults
+	config.URL = url
+	config.FlushInterval = 0
+	return config
+}
+
+// - - - - - - - - - - - - -
+//          TESTS
+// - - - - - - - - - - - - -
+
+func TestWebhookHandler(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	os.Setenv("REPLAY_ZERO_TEST_TOKEN", "abc")
+	defer os.Unsetenv("REPLAY_ZERO_TEST_TOKEN")
+	config := testWebhookConfig(server.URL)
+	config.Headers = map[string]string{"Authorization": "Bearer ${REPLAY_ZERO_TEST_TOKEN}"}
+	config.HMACSecret = "shh"
+	h := newTestWebhookHandler(t, config)
+	h.clock = func() string { return "1600000000" }
+
+	event := generateSampleEvent()
+	h.handleEvent(event)
+	h.flushBuffer()
+
+	requests, bodies := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(requests))
+	}
+	r := requests[0]
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer abc" {
+		t.Errorf("Expected a JSON POST with the custom header, got %s %v", r.Method, r.Header)
+	}
+	received := parseHTTPEvent(bodies[0])
+	if received.PairID != event.PairID || received.SchemaVersion != eventSchemaVersion {
+		t.Errorf("Expected the event as the body, got %q", bodies[0])
+	}
+	signature := "sha256=" + h.sign("1600000000", []byte(bodies[0]))
+	if r.Header.Get(webhookTimestampHeader) != "1600000000" || r.Header.Get(webhookSignatureHeader) != signature {
+		t.Errorf("Expected signature %s, got %v", signature, r.Header)
+	}
+	if h.sign("1600000001", []byte(bodies[0])) == h.sign("1600000000", []byte(bodies[0])) {
+		t.Error("Expected the signature to cover the timestamp")
+	}
+	if h.sent != 1 || h.failed != 0 {
+		t.Errorf("Expected sent=1 failed=0, got sent=%d failed=%d", h.sent, h.failed)
+	}
+}
+
+func TestWebhookBatches(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	config := testWebhookConfig(server.URL)
+	config.BatchSize = 3
+	h := newTestWebhookHandler(t, config)
+
+	for i := 0; i < 4; i++ {
+		h.handleEvent(generateSampleEvent())
+	}
+	if _, bodies := server.received(); len(bodies) != 1 {
+		t.Fatalf("Expected the 4th event to wait for a batch, got %d requests", len(bodies))
+	}
+	h.flushBuffer()
+
+	_, bodies := server.received()
+	for i, expected := range []int{3, 1} {
+		batch := []HTTPEvent{}
+		if err := json.Unmarshal([]byte(bodies[i]), &batch); err != nil || len(batch) != expected {
+			t.Errorf("Expected request %d to hold an array of %d events, got %q %v", i, expected, bodies[i], err)
+		}
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var retryTests = []struct {
+		name     string
+		statuses []int
+		requests int
+		sent     int64
+	}{
+		{"recovers", []int{500, 429, 201}, 3, 1},
+		{"gives up", []int{503, 503, 503}, 3, 0},
+		{"permanent", []int{400}, 1, 0},
+	}
+	for _, tt := range retryTests {
+		server := newWebhookServer(tt.statuses...)
+		config := testWebhookConfig(server.URL)
+		config.Retries = 2
+		h := newTestWebhookHandler(t, config)
+		h.handleEvent(generateSampleEvent())
+		server.Close()
+
+		if requests, _ := server.received(); len(requests) != tt.requests || h.sent != tt.sent || h.failed != 1-tt.sent {
+			t.Errorf("%s: expected %d requests and sent=%d, got %d requests, sent=%d failed=%d", tt.name, tt.requests, tt.sent, len(requests), h.sent, h.failed)
+		}
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	config := testWebhookConfig(server.URL)
+	config.Timeout = 20 * time.Millisecond
+	config.Retries = 0
+	h := newTestWebhookHandler(t, config)
+	h.handleEvent(generateSampleEvent())
+	if h.failed != 1 {
+		t.Errorf("Expected a request timing out to fail, got sent=%d failed=%d", h.sent, h.failed)
+	}
+}
+
+func TestWebhookSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := newWebhookServer(500, 500, 422)
+	defer server.Close()
+	config := testWebhookConfig(server.URL)
+	config.BatchSize = 2
+	config.RetryBackoff = time.Millisecond
+	config.SpoolDir = dir
+	h := newTestWebhookHandler(t, config)
+
+	rejected := generateSampleEvent()
+	rejected.Endpoint = "/rejected"
+	h.handleEvent(rejected)
+	// waits for the failing deliveries
+	for deadline := time.Now().Add(time.Second); h.spool.wait(0) > 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	h.handleEvent(generateSampleEvent())
+	h.handleEvent(generateSampleEvent())
+	h.flushBuffer()
+
+	requests, bodies := server.received()
+	// the last 2 events are posted together, unless the first is delivered before the second is spooled
+	if len(requests) < 4 || h.sent != 2 || h.failed != 1 {
+		t.Fatalf("Expected 2 retries, a rejected event and 2 more events, got %d requests, sent=%d failed=%d", len(requests), h.sent, h.failed)
+	}
+	if !strings.Contains(bodies[2], "/rejected") || strings.Contains(strings.Join(bodies[3:], ""), "/rejected") {
+		t.Errorf("Expected the rejected event to be dropped, got %q", bodies)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected an empty spool, got %d files", len(files))
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	sinks := []sinkConfig{{Type: "webhook", Filter: sinkFilter{Methods: []string{"GET"}}}}
+	if err := yaml.Unmarshal([]byte("url: "+server.URL+"\nbatch_size: 2\ntimeout: 5s\n"), &sinks[0].Options); err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFanOut(sinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.handleEvent(eventFor("GET", "/a", "200"))
+	f.handleEvent(eventFor("POST", "/b", "200"))
+	f.handleEvent(eventFor("GET", "/c", "200"))
+	f.flushBuffer()
+	if _, bodies := server.received(); len(bodies) != 1 || strings.Contains(bodies[0], "/b") {
+		t.Errorf("Expected one batch of the GET events, got %q", bodies)
+	}
+
+	var invalidTests = []struct {
+		name    string
+		options string
+	}{
+		{"no url", "batch_size: 2"},
+		{"not http", "url: ftp://example.com"},
+		{"batch size", "url: http://localhost\nbatch_size: 0"},
+		{"backoff", "url: http://localhost\nretry_backoff: 1m\nretry_max_backoff: 1s"},
+		{"missing secret", "url: http://localhost\nhmac_secret_env: REPLAY_ZERO_TEST_MISSING"},
+		{"spool policy", "url: http://localhost\nspool_dir: " + os.TempDir() + "\nspool_full: explode"},
+	}
+	for _, tt := range invalidTests {
+		sinks := []sinkConfig{{Type: "webhook"}}
+		if err := yaml.Unmarshal([]byte(tt.options), &sinks[0].Options); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newFanOut(sinks); err == nil {
+			t.Errorf("%s: expected an error, but got <nil>", tt.name)
+		}
+	}
+}